@@ -9,9 +9,16 @@ import (
 	"time"
 
 	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/consistency"
 	"github.com/clems4ever/ethereum-cache/internal/database"
 	"github.com/clems4ever/ethereum-cache/internal/exporter"
+	"github.com/clems4ever/ethereum-cache/internal/logging"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+	"github.com/clems4ever/ethereum-cache/internal/proxy"
+	"github.com/clems4ever/ethereum-cache/internal/reorg"
+	"github.com/clems4ever/ethereum-cache/internal/selftest"
 	"github.com/clems4ever/ethereum-cache/internal/server"
+	"github.com/clems4ever/ethereum-cache/internal/shard"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -28,36 +35,167 @@ func main() {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			// Bind environment variables to config keys
 			_ = viper.BindEnv("port")
+			_ = viper.BindEnv("listen_addrs")
+			_ = viper.BindEnv("enable_h2c")
+			_ = viper.BindEnv("log_level")
+			_ = viper.BindEnv("log_format")
 			_ = viper.BindEnv("upstream_url")
+			_ = viper.BindEnv("upstream_path")
+			_ = viper.BindEnv("upstream_auth_token")
+			_ = viper.BindEnv("upstream_max_idle_conns_per_host")
+			_ = viper.BindEnv("upstream_max_conns_per_host")
+			_ = viper.BindEnv("upstream_idle_conn_timeout")
+			_ = viper.BindEnv("upstream_proxy_url")
 			_ = viper.BindEnv("database_dsn")
+			_ = viper.BindEnv("database_shards")
 			_ = viper.BindEnv("auth_token")
+			_ = viper.BindEnv("basic_auth_user")
+			_ = viper.BindEnv("basic_auth_password")
+			_ = viper.BindEnv("admin_addr")
+			_ = viper.BindEnv("admin_token")
 			_ = viper.BindEnv("max_cache_size_bytes")
+			_ = viper.BindEnv("max_item_count")
+			_ = viper.BindEnv("default_max_cacheable_bytes")
+			_ = viper.BindEnv("adaptive_size_filter")
+			_ = viper.BindEnv("max_cacheable_params_bytes")
+			_ = viper.BindEnv("max_cacheable_params_depth")
+			_ = viper.BindEnv("negative_caching")
+			_ = viper.BindEnv("compress_min_bytes")
 			_ = viper.BindEnv("cleanup_slack_ratio")
+			_ = viper.BindEnv("vacuum_interval")
+			_ = viper.BindEnv("prune_batch_bytes")
+			_ = viper.BindEnv("idle_timeout")
+			_ = viper.BindEnv("shutdown_timeout")
 			_ = viper.BindEnv("rate_limit")
+			_ = viper.BindEnv("record_file")
+			_ = viper.BindEnv("replay_file")
+			_ = viper.BindEnv("request_timeout")
+			_ = viper.BindEnv("allow_cache_bypass_header")
+			_ = viper.BindEnv("allow_rpc_cache_control")
+			_ = viper.BindEnv("rewrite_upstream_ids")
+			_ = viper.BindEnv("expose_cache_key_header")
+			_ = viper.BindEnv("index_tx_blocks")
+			_ = viper.BindEnv("chain_namespace")
+			_ = viper.BindEnv("cache_key_hash")
+			_ = viper.BindEnv("verify_cache_key")
+			_ = viper.BindEnv("max_stored_params_bytes")
+			_ = viper.BindEnv("canonicalize_proof_keys")
+			_ = viper.BindEnv("minify_responses")
+			_ = viper.BindEnv("cached_response_headers")
+			_ = viper.BindEnv("strict_content_type")
+			_ = viper.BindEnv("strict_jsonrpc")
+			_ = viper.BindEnv("allow_get_requests")
+			_ = viper.BindEnv("allowed_methods")
+			_ = viper.BindEnv("denied_methods")
+			_ = viper.BindEnv("rewrite_method_aliases")
+			_ = viper.BindEnv("cache_block_traces")
+			_ = viper.BindEnv("cache_parity_traces")
+			_ = viper.BindEnv("cache_import_max_bytes")
+			_ = viper.BindEnv("warmup_dump_file")
+			_ = viper.BindEnv("fallback_cache_size")
+			_ = viper.BindEnv("fallback_cache_ttl")
+			_ = viper.BindEnv("fallback_cache_bytes")
+			_ = viper.BindEnv("dedupe_cache_size")
+			_ = viper.BindEnv("dedupe_window")
+			_ = viper.BindEnv("stale_while_revalidate")
+			_ = viper.BindEnv("freshness_window")
+			_ = viper.BindEnv("staleness_window")
+			_ = viper.BindEnv("min_cache_ttl")
+			_ = viper.BindEnv("expiring_soon_window")
+			_ = viper.BindEnv("serve_stale_on_error")
+			_ = viper.BindEnv("reorg_watch_interval")
+			_ = viper.BindEnv("reorg_confirmation_depth")
+			_ = viper.BindEnv("cache_finalized_only")
+			_ = viper.BindEnv("resolve_block_tags")
+			_ = viper.BindEnv("consistency_check_interval")
+			_ = viper.BindEnv("consistency_check_sample_rate")
+			_ = viper.BindEnv("db_max_conns")
+			_ = viper.BindEnv("db_min_conns")
+			_ = viper.BindEnv("db_max_conn_lifetime")
+			_ = viper.BindEnv("db_connect_retries")
+			_ = viper.BindEnv("db_connect_retry_delay")
+			_ = viper.BindEnv("read_replica_dsn")
+			_ = viper.BindEnv("db_latency_threshold")
+			_ = viper.BindEnv("db_latency_cooldown")
+			_ = viper.BindEnv("startup_selftest")
+			_ = viper.BindEnv("verify_integrity")
+			_ = viper.BindEnv("eviction_policy")
 
 			var cfg config.Config
 			if err := viper.Unmarshal(&cfg); err != nil {
 				return fmt.Errorf("unable to decode into struct: %w", err)
 			}
 
-			if cfg.UpstreamURL == "" {
-				return fmt.Errorf("upstream_url is required")
+			configuredLogger, err := logging.New(cfg.LogLevel, cfg.LogFormat)
+			if err != nil {
+				return fmt.Errorf("failed to create logger: %w", err)
+			}
+			defer configuredLogger.Sync()
+			logger = configuredLogger
+
+			if cfg.UpstreamURL == "" && len(cfg.Upstreams) == 0 {
+				return fmt.Errorf("upstream_url or upstreams is required")
+			}
+			upstreams, err := cfg.GetUpstreams()
+			if err != nil {
+				return err
+			}
+			if cfg.DatabaseDSN == "" && len(cfg.DatabaseShards) == 0 {
+				return fmt.Errorf("database_dsn or database_shards is required")
 			}
-			if cfg.DatabaseDSN == "" {
-				return fmt.Errorf("database_dsn is required")
+			if cfg.ReadReplicaDSN != "" && len(cfg.DatabaseShards) > 0 {
+				return fmt.Errorf("read_replica_dsn is not supported with database_shards")
 			}
 			if cfg.Port == "" {
 				cfg.Port = "8080"
 			}
 
+			compressMinBytes, err := config.ParseBytes(cfg.CompressMinBytes)
+			if err != nil {
+				return fmt.Errorf("invalid compress_min_bytes: %w", err)
+			}
+
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
-			db, err := database.NewDB(ctx, cfg.DatabaseDSN)
-			if err != nil {
-				return fmt.Errorf("failed to connect to database: %w", err)
+			dsns := cfg.DatabaseShards
+			if len(dsns) == 0 {
+				dsns = []string{cfg.DatabaseDSN}
+			}
+			backends := make([]shard.Backend, 0, len(dsns))
+			for i, dsn := range dsns {
+				db, err := database.NewDBWithOptions(ctx, dsn, database.Options{
+					Logger:            logger,
+					MaxConns:          cfg.DBMaxConns,
+					MinConns:          cfg.DBMinConns,
+					MaxConnLifetime:   cfg.DBMaxConnLifetime,
+					ConnectRetries:    cfg.DBConnectRetries,
+					ConnectRetryDelay: cfg.DBConnectRetryDelay,
+					CompressMinBytes:  compressMinBytes,
+					ReadReplicaDSN:    cfg.ReadReplicaDSN,
+					VerifyIntegrity:   cfg.VerifyIntegrity,
+					EvictionPolicy:    cfg.EvictionPolicy,
+				})
+				if err != nil {
+					// The DSN holds credentials, only its position is reported
+					return fmt.Errorf("failed to connect to database %d: %w", i, err)
+				}
+				defer db.Close()
+				if cfg.StartupSelftest {
+					if err := selftest.Run(ctx, db); err != nil {
+						return fmt.Errorf("startup self-test failed on database %d: %w", i, err)
+					}
+					logger.Info("startup self-test passed", zap.Int("database", i))
+				}
+				backends = append(backends, db)
+			}
+
+			var db shard.Backend = backends[0]
+			if len(backends) > 1 {
+				if db, err = shard.New(backends); err != nil {
+					return err
+				}
 			}
-			defer db.Close()
 
 			maxCacheSize, err := cfg.GetMaxCacheSizeBytes()
 			if err != nil {
@@ -66,16 +204,47 @@ func main() {
 
 			logger.Info("Cache configuration",
 				zap.Int64("max_cache_size_bytes", maxCacheSize),
+				zap.Int64("max_item_count", cfg.MaxItemCount),
 				zap.Float64("cleanup_slack_ratio", cfg.CleanupSlackRatio),
+				zap.Duration("vacuum_interval", cfg.VacuumInterval),
 			)
 
-			exp := exporter.New(logger, db, 30*time.Second)
-			go exp.Start(ctx)
+			// The background workers reach the upstream like the proxied
+			// calls do
+			upstreamClient, err := proxy.NewUpstreamClient(cfg, 30*time.Second)
+			if err != nil {
+				return err
+			}
+
+			srv, err := server.New(logger, db, cfg)
+			if err != nil {
+				return fmt.Errorf("failed to create server: %w", err)
+			}
 
-			srv := server.New(logger, ":"+cfg.Port, cfg.UpstreamURL, db, cfg.AuthToken, maxCacheSize, cfg.CleanupSlackRatio, cfg.RateLimit)
+			if cfg.ReorgWatchInterval > 0 {
+				upstreamURLs := make([]string, len(upstreams))
+				for i, u := range upstreams {
+					upstreamURLs[i] = u.URL
+				}
+				watcher := reorg.New(logger, db, upstreamURLs, cfg.GetUpstreamHeaders(), upstreamClient, cfg.ReorgWatchInterval, cfg.ReorgConfirmationDepth)
+				go watcher.Start(ctx)
+			}
+
+			if cfg.ConsistencyCheckInterval > 0 {
+				// Each entry is checked against the upstream of its partition
+				entryUpstream := func(entry database.CacheEntry) (string, bool) {
+					u, ok := srv.Handler().EntryUpstream(entry)
+					return u.URL, ok
+				}
+				checker := consistency.New(logger, db, entryUpstream, cfg.GetUpstreamHeaders(), upstreamClient, cfg.ConsistencyCheckInterval, cfg.ConsistencyCheckSampleRate)
+				go checker.Start(ctx)
+			}
+
+			exp := exporter.New(logger, db, 30*time.Second, srv.IdleTracker(), cfg.GetFreshnessWindow(), cfg.ExpiringSoonWindow)
+			go exp.Start(ctx)
 
 			go func() {
-				logger.Info("Starting server", zap.String("port", cfg.Port))
+				logger.Info("Starting server", zap.String("port", cfg.Port), zap.Strings("listen_addrs", cfg.ListenAddrs))
 				if err := srv.Start(); err != nil {
 					logger.Fatal("server error", zap.Error(err))
 				}
@@ -86,12 +255,26 @@ func main() {
 			<-quit
 
 			logger.Info("Shutting down server...")
-			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), srv.ShutdownTimeout())
 			defer shutdownCancel()
 
-			if err := srv.Shutdown(shutdownCtx); err != nil {
-				return fmt.Errorf("server forced to shutdown: %w", err)
+			shutdownErr := srv.Shutdown(shutdownCtx)
+
+			// /metrics is no longer served, log the final cache gauges
+			// instead, even when the shutdown was forced
+			collectCtx, collectCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer collectCancel()
+			exp.Collect(collectCtx)
+			logger.Info("final cache state",
+				zap.Int64("cache_size_bytes", int64(metrics.Total(metrics.CacheSizeBytes))),
+				zap.Int64("cache_items", int64(metrics.Total(metrics.CacheItemsCount))))
+
+			if shutdownErr != nil {
+				logger.Warn("shutdown forced, in-flight requests were cut",
+					zap.Duration("shutdown_timeout", srv.ShutdownTimeout()), zap.Error(shutdownErr))
+				return fmt.Errorf("server forced to shutdown: %w", shutdownErr)
 			}
+			logger.Info("shutdown completed cleanly")
 
 			logger.Info("Server exited")
 			return nil
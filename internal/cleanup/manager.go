@@ -3,35 +3,62 @@ package cleanup
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/idle"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
 	"go.uber.org/zap"
 )
 
+// Store is the storage the manager keeps under its limits. It is implemented
+// by *database.DB.
+type Store interface {
+	GetCacheSize(ctx context.Context) (int64, error)
+	GetCacheItemCount(ctx context.Context) (int64, error)
+	PruneCache(ctx context.Context, bytesToFree int64) (int64, int64, error)
+	PruneCacheByCount(ctx context.Context, itemsToDelete int64) (int64, int64, error)
+	Vacuum(ctx context.Context) error
+}
+
+var _ Store = (*database.DB)(nil)
+
+// pruneBatchPause is the pause between two prune batches, letting the
+// queries waiting on the table lock through.
+const pruneBatchPause = 10 * time.Millisecond
+
 type Manager struct {
-	logger     *zap.Logger
-	db         *database.DB
-	maxSize    int64
-	slackRatio float64
-	trigger    chan struct{}
-	wg         sync.WaitGroup
-	ctx        context.Context
-	cancel     context.CancelFunc
+	logger         *zap.Logger
+	db             Store
+	maxSize        int64
+	maxItems       int64
+	slackRatio     float64
+	vacuumInterval time.Duration
+	pruneBatch     int64
+	idle           *idle.Tracker
+	trigger        chan struct{}
+	wg             sync.WaitGroup
+	ctx            context.Context
+	cancel         context.CancelFunc
 }
 
-func NewManager(logger *zap.Logger, db *database.DB, maxSize int64, slackRatio float64) *Manager {
+func NewManager(logger *zap.Logger, db Store, maxSize int64, maxItems int64, slackRatio float64, vacuumInterval time.Duration, pruneBatch int64, idle *idle.Tracker) *Manager {
 	if slackRatio <= 0 {
 		slackRatio = 0.2 // Default 20%
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Manager{
-		logger:     logger,
-		db:         db,
-		maxSize:    maxSize,
-		slackRatio: slackRatio,
-		trigger:    make(chan struct{}, 1),
-		ctx:        ctx,
-		cancel:     cancel,
+		logger:         logger,
+		db:             db,
+		maxSize:        maxSize,
+		maxItems:       maxItems,
+		slackRatio:     slackRatio,
+		vacuumInterval: vacuumInterval,
+		pruneBatch:     pruneBatch,
+		idle:           idle,
+		trigger:        make(chan struct{}, 1),
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 }
 
@@ -55,17 +82,51 @@ func (m *Manager) NotifyWrite() {
 
 func (m *Manager) run() {
 	defer m.wg.Done()
+
+	// A nil channel never fires, leaving the maintenance disabled
+	var vacuumTick <-chan time.Time
+	if m.vacuumInterval > 0 {
+		ticker := time.NewTicker(m.vacuumInterval)
+		defer ticker.Stop()
+		vacuumTick = ticker.C
+	}
+
 	for {
 		select {
 		case <-m.ctx.Done():
 			return
 		case <-m.trigger:
 			m.cleanup()
+		case <-vacuumTick:
+			// Writes only happen on requests, the vacuum is the only work
+			// left to pause while idle
+			if m.idle.Idle() {
+				continue
+			}
+			m.vacuum()
 		}
 	}
 }
 
+func (m *Manager) vacuum() {
+	start := time.Now()
+	if err := m.db.Vacuum(m.ctx); err != nil {
+		m.logger.Error("failed to vacuum cache table", zap.Duration("duration", time.Since(start)), zap.Error(err))
+		return
+	}
+	m.logger.Info("vacuumed cache table", zap.Duration("duration", time.Since(start)))
+}
+
 func (m *Manager) cleanup() {
+	if m.maxSize > 0 {
+		m.cleanupBySize()
+	}
+	if m.maxItems > 0 {
+		m.cleanupByCount()
+	}
+}
+
+func (m *Manager) cleanupBySize() {
 	currentSize, err := m.db.GetCacheSize(m.ctx)
 	if err != nil {
 		m.logger.Error("failed to get cache size", zap.Error(err))
@@ -76,15 +137,86 @@ func (m *Manager) cleanup() {
 		targetSize := int64(float64(m.maxSize) * (1.0 - m.slackRatio))
 		toFree := currentSize - targetSize
 		if toFree > 0 {
-			freed, err := m.db.PruneCache(m.ctx, toFree)
+			freed, deleted, batches, err := m.pruneInBatches(toFree)
+			// Batches pruned before a failure are evictions too
+			observeEvictions("size", freed, deleted)
 			if err != nil {
-				m.logger.Error("failed to prune cache", zap.Error(err))
+				m.logger.Error("failed to prune cache", zap.Int64("freed_bytes", freed), zap.Error(err))
 			} else {
 				m.logger.Info("pruned cache",
 					zap.Int64("freed_bytes", freed),
+					zap.Int64("deleted_items", deleted),
+					zap.Int("batches", batches),
 					zap.Int64("target_size", targetSize),
 					zap.Int64("current_size", currentSize))
 			}
 		}
 	}
 }
+
+// pruneInBatches frees toFree bytes, in batches of at most pruneBatch bytes
+// when set so that no single statement holds the table for too long. It
+// returns the freed bytes, the number of deleted entries and the number of
+// batches.
+func (m *Manager) pruneInBatches(toFree int64) (int64, int64, int, error) {
+	var freed, deleted int64
+	var batches int
+	for freed < toFree {
+		if batches > 0 {
+			select {
+			case <-m.ctx.Done():
+				return freed, deleted, batches, m.ctx.Err()
+			case <-time.After(pruneBatchPause):
+			}
+		}
+		batch := toFree - freed
+		if m.pruneBatch > 0 {
+			batch = min(batch, m.pruneBatch)
+		}
+		n, items, err := m.db.PruneCache(m.ctx, batch)
+		if err != nil {
+			return freed, deleted, batches, err
+		}
+		freed += n
+		deleted += items
+		batches++
+		if n == 0 {
+			// Nothing left to prune
+			break
+		}
+	}
+	return freed, deleted, batches, nil
+}
+
+func (m *Manager) cleanupByCount() {
+	currentCount, err := m.db.GetCacheItemCount(m.ctx)
+	if err != nil {
+		m.logger.Error("failed to get cache item count", zap.Error(err))
+		return
+	}
+
+	if currentCount > m.maxItems {
+		targetCount := int64(float64(m.maxItems) * (1.0 - m.slackRatio))
+		toDelete := currentCount - targetCount
+		if toDelete > 0 {
+			deleted, freed, err := m.db.PruneCacheByCount(m.ctx, toDelete)
+			if err != nil {
+				m.logger.Error("failed to prune cache by count", zap.Error(err))
+			} else {
+				observeEvictions("count", freed, deleted)
+				m.logger.Info("pruned cache by count",
+					zap.Int64("deleted_items", deleted),
+					zap.Int64("freed_bytes", freed),
+					zap.Int64("target_count", targetCount),
+					zap.Int64("current_count", currentCount))
+			}
+		}
+	}
+}
+
+// observeEvictions counts the entries evicted to enforce the limit named by
+// reason.
+func observeEvictions(reason string, freed int64, deleted int64) {
+	metrics.EvictedBytes.WithLabelValues(reason).Add(float64(freed))
+	metrics.Evictions.WithLabelValues(reason).Add(float64(deleted))
+}
@@ -0,0 +1,94 @@
+package cleanup_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/cleanup"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const entrySize = 100
+
+// sizeStore holds entries of entrySize bytes and records the prune calls.
+type sizeStore struct {
+	mu      sync.Mutex
+	size    int64
+	batches []int64
+}
+
+func (s *sizeStore) GetCacheSize(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size, nil
+}
+
+func (s *sizeStore) GetCacheItemCount(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size / entrySize, nil
+}
+
+// PruneCache frees whole entries until bytesToFree is reached, like the
+// database does.
+func (s *sizeStore) PruneCache(ctx context.Context, bytesToFree int64) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, bytesToFree)
+	freed := min((bytesToFree+entrySize-1)/entrySize*entrySize, s.size)
+	s.size -= freed
+	return freed, freed / entrySize, nil
+}
+
+func (s *sizeStore) PruneCacheByCount(ctx context.Context, itemsToDelete int64) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := min(itemsToDelete, s.size/entrySize)
+	s.size -= deleted * entrySize
+	return deleted, deleted * entrySize, nil
+}
+
+func (s *sizeStore) Vacuum(ctx context.Context) error {
+	return nil
+}
+
+func TestPruneInBatches(t *testing.T) {
+	// 5000 bytes for a limit of 1000, pruned down to 800
+	store := &sizeStore{size: 5000}
+	manager := cleanup.NewManager(zap.NewNop(), store, 1000, 0, 0.2, 0, 1000, nil)
+	manager.Start()
+	defer manager.Stop()
+
+	manager.NotifyWrite()
+	require.Eventually(t, func() bool {
+		size, _ := store.GetCacheSize(context.Background())
+		return size <= 800
+	}, time.Second, 10*time.Millisecond)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	require.Equal(t, []int64{1000, 1000, 1000, 1000, 200}, store.batches)
+	require.Equal(t, int64(800), store.size)
+}
+
+func TestEvictionMetrics(t *testing.T) {
+	bytesBefore := testutil.ToFloat64(metrics.EvictedBytes.WithLabelValues("count"))
+	evictionsBefore := testutil.ToFloat64(metrics.Evictions.WithLabelValues("count"))
+
+	// 50 entries for a limit of 10, pruned down to 8
+	store := &sizeStore{size: 50 * entrySize}
+	manager := cleanup.NewManager(zap.NewNop(), store, 0, 10, 0.2, 0, 0, nil)
+	manager.Start()
+	defer manager.Stop()
+
+	manager.NotifyWrite()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.Evictions.WithLabelValues("count")) == evictionsBefore+42
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, bytesBefore+42*entrySize, testutil.ToFloat64(metrics.EvictedBytes.WithLabelValues("count")))
+}
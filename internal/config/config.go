@@ -1,24 +1,244 @@
 package config
 
 import (
+	"fmt"
+	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/redact"
 )
 
 type Config struct {
-	Port              string  `mapstructure:"port"`
-	UpstreamURL       string  `mapstructure:"upstream_url"`
-	DatabaseDSN       string  `mapstructure:"database_dsn"`
-	AuthToken         string  `mapstructure:"auth_token"`
-	MaxCacheSize      string  `mapstructure:"max_cache_size_bytes"`
-	CleanupSlackRatio float64 `mapstructure:"cleanup_slack_ratio"`
-	RateLimit         float64 `mapstructure:"rate_limit"`
+	Port                   string              `mapstructure:"port"`
+	ListenAddrs            []string            `mapstructure:"listen_addrs"`
+	EnableH2C              bool                `mapstructure:"enable_h2c"`
+	LogLevel               string              `mapstructure:"log_level"`
+	LogFormat              string              `mapstructure:"log_format"`
+	UpstreamURL            string              `mapstructure:"upstream_url"`
+	UpstreamPath           string              `mapstructure:"upstream_path"`
+	UpstreamAuthToken      string              `mapstructure:"upstream_auth_token"`
+	UpstreamHeaders        map[string]string   `mapstructure:"upstream_headers"`
+	Upstreams              []Upstream          `mapstructure:"upstreams"`
+	DatabaseDSN            string              `mapstructure:"database_dsn"`
+	DatabaseShards         []string            `mapstructure:"database_shards"`
+	AuthToken              string              `mapstructure:"auth_token"`
+	BasicAuthUser          string              `mapstructure:"basic_auth_user"`
+	BasicAuthPassword      string              `mapstructure:"basic_auth_password"`
+	AdminAddr              string              `mapstructure:"admin_addr"`
+	AdminToken             string              `mapstructure:"admin_token"`
+	MaxCacheSize           string              `mapstructure:"max_cache_size_bytes"`
+	MaxItemCount           int64               `mapstructure:"max_item_count"`
+	MaxCacheableBytes      map[string]string   `mapstructure:"max_cacheable_bytes"`
+	AdaptiveSizeFilter     bool                `mapstructure:"adaptive_size_filter"`
+	DefaultMaxCacheable    string              `mapstructure:"default_max_cacheable_bytes"`
+	MaxParamsBytes         string              `mapstructure:"max_cacheable_params_bytes"`
+	MaxParamsDepth         int                 `mapstructure:"max_cacheable_params_depth"`
+	NegativeCaching        bool                `mapstructure:"negative_caching"`
+	CompressMinBytes       string              `mapstructure:"compress_min_bytes"`
+	PruneBatchBytes        string              `mapstructure:"prune_batch_bytes"`
+	CleanupSlackRatio      float64             `mapstructure:"cleanup_slack_ratio"`
+	VacuumInterval         time.Duration       `mapstructure:"vacuum_interval"`
+	IdleTimeout            time.Duration       `mapstructure:"idle_timeout"`
+	ShutdownTimeout        time.Duration       `mapstructure:"shutdown_timeout"`
+	RateLimit              float64             `mapstructure:"rate_limit"`
+	PerMethodRateLimit     map[string]float64  `mapstructure:"per_method_rate_limit"`
+	CacheResultRequires    map[string][]string `mapstructure:"cache_result_requires"`
+	AbsentBlockDefaults    map[string]string   `mapstructure:"absent_block_defaults"`
+	CacheWriteSampleRate   map[string]float64  `mapstructure:"cache_write_sample_rate"`
+	RecordFile             string              `mapstructure:"record_file"`
+	ReplayFile             string              `mapstructure:"replay_file"`
+	RequestTimeout         time.Duration       `mapstructure:"request_timeout"`
+	AllowCacheBypassHeader bool                `mapstructure:"allow_cache_bypass_header"`
+	AllowRPCCacheControl   bool                `mapstructure:"allow_rpc_cache_control"`
+	RewriteUpstreamIDs     bool                `mapstructure:"rewrite_upstream_ids"`
+	ExposeCacheKeyHeader   bool                `mapstructure:"expose_cache_key_header"`
+	IndexTxBlocks          bool                `mapstructure:"index_tx_blocks"`
+	ChainNamespace         string              `mapstructure:"chain_namespace"`
+	CacheKeyHash           string              `mapstructure:"cache_key_hash"`
+	VerifyCacheKey         bool                `mapstructure:"verify_cache_key"`
+	MaxStoredParamsBytes   string              `mapstructure:"max_stored_params_bytes"`
+	CanonicalizeProofKeys  bool                `mapstructure:"canonicalize_proof_keys"`
+	MinifyResponses        bool                `mapstructure:"minify_responses"`
+	CachedResponseHeaders  []string            `mapstructure:"cached_response_headers"`
+	StrictContentType      bool                `mapstructure:"strict_content_type"`
+	StrictJSONRPC          bool                `mapstructure:"strict_jsonrpc"`
+	AllowGetRequests       bool                `mapstructure:"allow_get_requests"`
+	AllowedMethods         []string            `mapstructure:"allowed_methods"`
+	DeniedMethods          []string            `mapstructure:"denied_methods"`
+	MethodAliases          map[string]string   `mapstructure:"method_aliases"`
+	RewriteMethodAliases   bool                `mapstructure:"rewrite_method_aliases"`
+	CacheBlockTraces       bool                `mapstructure:"cache_block_traces"`
+	CacheParityTraces      bool                `mapstructure:"cache_parity_traces"`
+	CacheImportMaxBytes    string              `mapstructure:"cache_import_max_bytes"`
+	WarmupDumpFile         string              `mapstructure:"warmup_dump_file"`
+
+	FallbackCacheSize  int           `mapstructure:"fallback_cache_size"`
+	FallbackCacheTTL   time.Duration `mapstructure:"fallback_cache_ttl"`
+	FallbackCacheBytes string        `mapstructure:"fallback_cache_bytes"`
+	DedupeCacheSize    int           `mapstructure:"dedupe_cache_size"`
+	DedupeWindow       time.Duration `mapstructure:"dedupe_window"`
+
+	StaleWhileRevalidate bool          `mapstructure:"stale_while_revalidate"`
+	FreshnessWindow      time.Duration `mapstructure:"freshness_window"`
+	StalenessWindow      time.Duration `mapstructure:"staleness_window"`
+	ExpiringSoonWindow   time.Duration `mapstructure:"expiring_soon_window"`
+	MinCacheTTL          time.Duration `mapstructure:"min_cache_ttl"`
+	ServeStaleOnError    bool          `mapstructure:"serve_stale_on_error"`
+	CacheFinalizedOnly   bool          `mapstructure:"cache_finalized_only"`
+	ResolveBlockTags     bool          `mapstructure:"resolve_block_tags"`
+
+	ReorgWatchInterval     time.Duration `mapstructure:"reorg_watch_interval"`
+	ReorgConfirmationDepth uint64        `mapstructure:"reorg_confirmation_depth"`
+
+	ConsistencyCheckInterval   time.Duration `mapstructure:"consistency_check_interval"`
+	ConsistencyCheckSampleRate float64       `mapstructure:"consistency_check_sample_rate"`
+
+	UpstreamMaxIdleConnsPerHost int           `mapstructure:"upstream_max_idle_conns_per_host"`
+	UpstreamMaxConnsPerHost     int           `mapstructure:"upstream_max_conns_per_host"`
+	UpstreamIdleConnTimeout     time.Duration `mapstructure:"upstream_idle_conn_timeout"`
+	UpstreamProxyURL            string        `mapstructure:"upstream_proxy_url"`
+
+	DBMaxConns          int32         `mapstructure:"db_max_conns"`
+	DBMinConns          int32         `mapstructure:"db_min_conns"`
+	DBMaxConnLifetime   time.Duration `mapstructure:"db_max_conn_lifetime"`
+	DBConnectRetries    int           `mapstructure:"db_connect_retries"`
+	DBConnectRetryDelay time.Duration `mapstructure:"db_connect_retry_delay"`
+	ReadReplicaDSN      string        `mapstructure:"read_replica_dsn"`
+	DBLatencyThreshold  time.Duration `mapstructure:"db_latency_threshold"`
+	DBLatencyCooldown   time.Duration `mapstructure:"db_latency_cooldown"`
+	StartupSelftest     bool          `mapstructure:"startup_selftest"`
+	VerifyIntegrity     bool          `mapstructure:"verify_integrity"`
+	EvictionPolicy      string        `mapstructure:"eviction_policy"`
+}
+
+// NamespaceSeparator separates the chain namespace from the upstream id in
+// the namespace of a cache partition. Neither may contain it, so that two
+// partitions never share a namespace.
+const NamespaceSeparator = "@"
+
+// Upstream is an upstream node requests are routed to, in proportion of its
+// weight. Its id partitions the cache so that the results of different nodes
+// never mix.
+type Upstream struct {
+	ID     string `mapstructure:"id"`
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// GetUpstreams returns the upstreams to route requests to. Without explicit
+// upstreams, the upstream URL is used as a single upstream with an empty id,
+// which leaves the cache keys unchanged. A zero weight defaults to 1.
+func (c *Config) GetUpstreams() ([]Upstream, error) {
+	if len(c.Upstreams) == 0 {
+		upstreamURL, err := c.GetUpstreamURL()
+		if err != nil {
+			return nil, err
+		}
+		return []Upstream{{URL: upstreamURL, Weight: 1}}, nil
+	}
+
+	upstreams := make([]Upstream, 0, len(c.Upstreams))
+	seen := make(map[string]bool, len(c.Upstreams))
+	for i, u := range c.Upstreams {
+		if u.ID == "" {
+			return nil, fmt.Errorf("upstreams[%d]: id is required", i)
+		}
+		if strings.Contains(u.ID, NamespaceSeparator) {
+			return nil, fmt.Errorf("upstreams[%d]: id must not contain %q", i, NamespaceSeparator)
+		}
+		if seen[u.ID] {
+			return nil, fmt.Errorf("upstreams[%d]: duplicate id %q", i, u.ID)
+		}
+		seen[u.ID] = true
+		if u.URL == "" {
+			return nil, fmt.Errorf("upstreams[%d]: url is required", i)
+		}
+		if _, err := url.Parse(u.URL); err != nil {
+			return nil, fmt.Errorf("upstreams[%d]: invalid url: %w", i, redact.Error(err))
+		}
+		if u.Weight < 0 {
+			return nil, fmt.Errorf("upstreams[%d]: weight must not be negative", i)
+		}
+		if u.Weight == 0 {
+			u.Weight = 1
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+// GetChainNamespace returns the namespace mixed into the cache keys.
+func (c *Config) GetChainNamespace() (string, error) {
+	if strings.Contains(c.ChainNamespace, NamespaceSeparator) {
+		return "", fmt.Errorf("invalid chain_namespace: must not contain %q", NamespaceSeparator)
+	}
+	return c.ChainNamespace, nil
+}
+
+// GetUpstreamURL returns the upstream URL with the upstream path, if any,
+// appended to its path. The query of the upstream URL is preserved.
+func (c *Config) GetUpstreamURL() (string, error) {
+	if c.UpstreamPath == "" {
+		return c.UpstreamURL, nil
+	}
+	u, err := url.Parse(c.UpstreamURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid upstream_url: %w", redact.Error(err))
+	}
+	return u.JoinPath(c.UpstreamPath).String(), nil
+}
+
+// GetUpstreamHeaders returns the headers to send with every upstream request.
+// The upstream auth token, if any, takes precedence over an Authorization
+// entry of the upstream headers.
+func (c *Config) GetUpstreamHeaders() http.Header {
+	headers := make(http.Header, len(c.UpstreamHeaders)+1)
+	for k, v := range c.UpstreamHeaders {
+		headers.Set(k, v)
+	}
+	if c.UpstreamAuthToken != "" {
+		headers.Set("Authorization", "Bearer "+c.UpstreamAuthToken)
+	}
+	return headers
+}
+
+// GetFreshnessWindow returns the age after which entries are revalidated,
+// raised to min_cache_ttl. It is zero when stale_while_revalidate is
+// disabled since entries then never expire.
+func (c *Config) GetFreshnessWindow() time.Duration {
+	if !c.StaleWhileRevalidate {
+		return 0
+	}
+	return max(c.FreshnessWindow, c.MinCacheTTL)
 }
 
 func (c *Config) GetMaxCacheSizeBytes() (int64, error) {
 	return ParseBytes(c.MaxCacheSize)
 }
 
+// GetMaxCacheableBytes returns the per-method limits above which responses
+// are not cached, keyed by lower-cased method name since viper lower-cases
+// map keys, along with the default limit. Zero means unlimited.
+func (c *Config) GetMaxCacheableBytes() (map[string]int64, int64, error) {
+	limits := make(map[string]int64, len(c.MaxCacheableBytes))
+	for method, size := range c.MaxCacheableBytes {
+		limit, err := ParseBytes(size)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid max_cacheable_bytes for %s: %w", method, err)
+		}
+		limits[strings.ToLower(method)] = limit
+	}
+
+	defaultLimit, err := ParseBytes(c.DefaultMaxCacheable)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid default_max_cacheable_bytes: %w", err)
+	}
+	return limits, defaultLimit, nil
+}
+
 func ParseBytes(s string) (int64, error) {
 	s = strings.TrimSpace(s)
 	if s == "" {
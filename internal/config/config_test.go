@@ -40,3 +40,104 @@ func TestParseBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestGetUpstreamHeaders(t *testing.T) {
+	cfg := Config{
+		UpstreamHeaders: map[string]string{
+			"x-api-key":     "key",
+			"authorization": "Basic overridden",
+		},
+		UpstreamAuthToken: "token",
+	}
+
+	headers := cfg.GetUpstreamHeaders()
+	assert.Equal(t, "key", headers.Get("X-Api-Key"))
+	assert.Equal(t, "Bearer token", headers.Get("Authorization"))
+	assert.Len(t, headers, 2)
+}
+
+func TestGetMaxCacheableBytes(t *testing.T) {
+	cfg := Config{
+		MaxCacheableBytes: map[string]string{
+			"debug_traceTransaction": "1MB",
+			"eth_getProof":           "0",
+		},
+		DefaultMaxCacheable: "10k",
+	}
+
+	limits, defaultLimit, err := cfg.GetMaxCacheableBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{
+		"debug_tracetransaction": 1024 * 1024,
+		"eth_getproof":           0,
+	}, limits)
+	assert.Equal(t, int64(10*1024), defaultLimit)
+
+	cfg.MaxCacheableBytes["eth_call"] = "invalid"
+	_, _, err = cfg.GetMaxCacheableBytes()
+	assert.Error(t, err)
+}
+
+func TestGetUpstreamURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		path     string
+		expected string
+	}{
+		{"https://node.example.com/v3/key", "", "https://node.example.com/v3/key"},
+		{"https://node.example.com", "/rpc", "https://node.example.com/rpc"},
+		{"https://node.example.com/v3/", "key", "https://node.example.com/v3/key"},
+		{"https://node.example.com?apikey=secret", "rpc", "https://node.example.com/rpc?apikey=secret"},
+	}
+
+	for _, test := range tests {
+		cfg := Config{UpstreamURL: test.url, UpstreamPath: test.path}
+		val, err := cfg.GetUpstreamURL()
+		assert.NoError(t, err, "url: %s, path: %s", test.url, test.path)
+		assert.Equal(t, test.expected, val, "url: %s, path: %s", test.url, test.path)
+	}
+}
+
+func TestGetUpstreams(t *testing.T) {
+	// Without upstreams, the upstream URL is the only upstream
+	cfg := Config{UpstreamURL: "https://node.example.com", UpstreamPath: "/rpc"}
+	upstreams, err := cfg.GetUpstreams()
+	assert.NoError(t, err)
+	assert.Equal(t, []Upstream{{URL: "https://node.example.com/rpc", Weight: 1}}, upstreams)
+
+	cfg = Config{Upstreams: []Upstream{
+		{ID: "a", URL: "https://a.example.com", Weight: 9},
+		{ID: "b", URL: "https://b.example.com"},
+	}}
+	upstreams, err = cfg.GetUpstreams()
+	assert.NoError(t, err)
+	assert.Equal(t, []Upstream{
+		{ID: "a", URL: "https://a.example.com", Weight: 9},
+		{ID: "b", URL: "https://b.example.com", Weight: 1},
+	}, upstreams)
+
+	invalid := [][]Upstream{
+		{{URL: "https://a.example.com"}},
+		{{ID: "a"}},
+		{{ID: "a", URL: "https://a.example.com"}, {ID: "a", URL: "https://b.example.com"}},
+		{{ID: "a", URL: "https://a.example.com", Weight: -1}},
+		{{ID: "a@b", URL: "https://a.example.com"}},
+	}
+	for _, upstreams := range invalid {
+		cfg := Config{Upstreams: upstreams}
+		_, err := cfg.GetUpstreams()
+		assert.Error(t, err, "upstreams: %v", upstreams)
+	}
+}
+
+func TestGetChainNamespace(t *testing.T) {
+	cfg := Config{ChainNamespace: "mainnet"}
+	namespace, err := cfg.GetChainNamespace()
+	assert.NoError(t, err)
+	assert.Equal(t, "mainnet", namespace)
+
+	// Would share the partition of upstream b with the namespace mainnet
+	cfg = Config{ChainNamespace: "mainnet@b"}
+	_, err = cfg.GetChainNamespace()
+	assert.Error(t, err)
+}
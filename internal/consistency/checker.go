@@ -0,0 +1,197 @@
+package consistency
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+	"github.com/clems4ever/ethereum-cache/internal/redact"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSampleRate = 0.001
+	// maxSampleSize bounds the upstream calls made by a single check
+	maxSampleSize = 100
+	// defaultCallTimeout bounds the upstream calls of the default client
+	defaultCallTimeout = 30 * time.Second
+)
+
+// immutableMethods are the sampled methods. Their cached responses must never
+// change, and their stored params, which are normalized, can be sent back to
+// the upstream as is since they contain no objects.
+var immutableMethods = []string{
+	"eth_getTransactionByHash",
+	"eth_getTransactionReceipt",
+	"eth_getStorageAt",
+	"eth_getProof",
+}
+
+// Store is the storage whose entries are checked. It is implemented by
+// *database.DB.
+type Store interface {
+	SampleCacheEntries(ctx context.Context, methods []string, percent float64, limit int) ([]database.CacheEntry, error)
+	DeleteCacheEntry(ctx context.Context, key string) (bool, error)
+}
+
+var _ Store = (*database.DB)(nil)
+
+// UpstreamResolver returns the URL of the upstream owning the cache partition
+// of an entry, or false when it cannot be told.
+type UpstreamResolver func(entry database.CacheEntry) (string, bool)
+
+// Checker periodically refetches a random sample of cached entries from the
+// upstream and evicts the entries whose response differs.
+type Checker struct {
+	logger     *zap.Logger
+	db         Store
+	upstreams  UpstreamResolver
+	headers    http.Header
+	httpClient *http.Client
+	interval   time.Duration
+	sampleRate float64
+}
+
+// New creates a Checker sampling, on every interval, the sampleRate fraction
+// of the cached entries of immutable methods. Each entry is refetched from the
+// upstream given by upstreams, with httpClient, or with a client bounding the
+// calls to 30 seconds when nil.
+func New(logger *zap.Logger, db Store, upstreams UpstreamResolver, headers http.Header, httpClient *http.Client, interval time.Duration, sampleRate float64) *Checker {
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = defaultSampleRate
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultCallTimeout}
+	}
+	return &Checker{
+		logger:     logger,
+		db:         db,
+		upstreams:  upstreams,
+		headers:    headers,
+		httpClient: httpClient,
+		interval:   interval,
+		sampleRate: sampleRate,
+	}
+}
+
+func (c *Checker) Start(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.check(ctx)
+		}
+	}
+}
+
+func (c *Checker) check(ctx context.Context) {
+	entries, err := c.db.SampleCacheEntries(ctx, immutableMethods, c.sampleRate*100, maxSampleSize)
+	if err != nil {
+		c.logger.Error("failed to sample cache entries", zap.Error(err))
+		return
+	}
+
+	for _, entry := range entries {
+		if bytes.HasPrefix(entry.Params, []byte(database.ParamsDigestPrefix)) {
+			// Only the digest of the params is known
+			continue
+		}
+		upstreamURL, ok := c.upstreams(entry)
+		if !ok {
+			// Another upstream may legitimately answer differently
+			continue
+		}
+		result, err := c.call(ctx, upstreamURL, entry.Method, entry.Params)
+		if err != nil {
+			c.logger.Error("failed to refetch cache entry", zap.String("method", entry.Method), zap.Error(err))
+			continue
+		}
+		if result == nil {
+			// The upstream does not know the data (anymore), do not take
+			// the risk of evicting a valid entry
+			continue
+		}
+		if equalJSON(result, entry.Response) {
+			continue
+		}
+
+		metrics.CacheMismatches.WithLabelValues(entry.Method).Inc()
+		c.logger.Warn("cached response differs from the upstream, evicting it",
+			zap.String("key", entry.Key),
+			zap.String("method", entry.Method),
+			zap.ByteString("params", entry.Params))
+		if _, err := c.db.DeleteCacheEntry(ctx, entry.Key); err != nil {
+			c.logger.Error("failed to evict cache entry", zap.String("key", entry.Key), zap.Error(err))
+		}
+	}
+}
+
+// call returns the raw result of the call, or nil if it is null.
+func (c *Checker) call(ctx context.Context, upstreamURL string, method string, params json.RawMessage) (json.RawMessage, error) {
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+		"id":      1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, redact.Error(err)
+	}
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// The URL may embed an API key
+		return nil, redact.Error(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var rpcResp struct {
+		Result json.RawMessage `json:"result"`
+		Error  any             `json:"error"`
+	}
+	if err := json.Unmarshal(respBody, &rpcResp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if rpcResp.Error != nil {
+		return nil, fmt.Errorf("upstream error: %v", rpcResp.Error)
+	}
+	if len(rpcResp.Result) == 0 || string(rpcResp.Result) == "null" {
+		return nil, nil
+	}
+	return rpcResp.Result, nil
+}
+
+// equalJSON compares two JSON documents regardless of their whitespace and
+// object key order, which the cache may not preserve.
+func equalJSON(a, b []byte) bool {
+	var valueA, valueB any
+	if json.Unmarshal(a, &valueA) != nil || json.Unmarshal(b, &valueB) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(valueA, valueB)
+}
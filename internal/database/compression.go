@@ -0,0 +1,54 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Storage formats of the response column, recorded in the format column.
+const (
+	formatRaw  int16 = 0
+	formatGzip int16 = 1
+)
+
+// encodeResponse returns the response as it must be stored along with its
+// format. Responses are gzipped when compression is enabled and they reach
+// the threshold, smaller ones would barely shrink or even grow.
+func (s *DB) encodeResponse(response []byte) ([]byte, int16, error) {
+	if s.compressMinBytes <= 0 || int64(len(response)) < s.compressMinBytes {
+		return response, formatRaw, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(response); err != nil {
+		return nil, 0, fmt.Errorf("failed to compress response: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, 0, fmt.Errorf("failed to compress response: %w", err)
+	}
+	return buf.Bytes(), formatGzip, nil
+}
+
+// decodeResponse returns the original response of data stored in format.
+func decodeResponse(data []byte, format int16) ([]byte, error) {
+	switch format {
+	case formatRaw:
+		return data, nil
+	case formatGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress response: %w", err)
+		}
+		defer zr.Close()
+		response, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress response: %w", err)
+		}
+		return response, nil
+	default:
+		return nil, fmt.Errorf("unknown response format: %d", format)
+	}
+}
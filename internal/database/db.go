@@ -4,26 +4,176 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
 )
 
 type DB struct {
 	pool *pgxpool.Pool
+	// readPool serves the cache lookups and the size queries. It is pool
+	// itself unless a read replica is configured.
+	readPool         *pgxpool.Pool
+	compressMinBytes int64
+	verifyIntegrity  bool
+	// evictionOrder orders the entries from the first to be evicted
+	evictionOrder string
+	// evictionIndexes back evictionOrder when the cache indexes do not
+	evictionIndexes []cacheIndex
+}
+
+// CacheEntry is a stored rpc_cache row. Response is always decompressed while
+// ResultLength is the stored, possibly compressed, size.
+type CacheEntry struct {
+	Key            string
+	Method         string
+	Response       []byte
+	ResultLength   int64
+	CreatedAt      time.Time
+	LastAccessedAt time.Time
+	// Source tells how the entry entered the cache. It is only filled by
+	// GetCacheEntry.
+	Source string
+	// Params holds the normalized params of the call, if stored. It is only
+	// filled by SampleCacheEntries.
+	Params []byte
+}
+
+// ParamsDigestPrefix prefixes the hex SHA-256 digest stored instead of the
+// normalized params when they are too long. Such params can be compared to
+// the ones of a request but not sent to the upstream.
+const ParamsDigestPrefix = "sha256:"
+
+// Sources of cache entries, recorded for auditing.
+const (
+	// SourceClient entries were fetched from the upstream on a client miss.
+	SourceClient = "client"
+	// SourceImport entries were loaded from a cache dump.
+	SourceImport = "import"
+)
+
+const (
+	// initLockID is the advisory lock serializing the schema migrations
+	initLockID = 0x65746863616368 // "ethcach"
+
+	defaultConnectRetryDelay = time.Second
+	maxConnectRetryDelay     = 30 * time.Second
+)
+
+// Options tunes the connection pool and the startup connection attempts.
+// Zero values keep the pgxpool defaults and fail on the first attempt.
+type Options struct {
+	Logger          *zap.Logger
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	// ConnectRetries is the number of additional connection attempts made
+	// when the database is not reachable yet. The delay between attempts
+	// starts at ConnectRetryDelay and doubles after each failure.
+	ConnectRetries    int
+	ConnectRetryDelay time.Duration
+	// CompressMinBytes is the size from which responses are stored
+	// gzipped. Zero disables compression.
+	CompressMinBytes int64
+	// ReadReplicaDSN is a read replica of the database serving the cache
+	// lookups and the size queries, connected with the same options.
+	ReadReplicaDSN string
+	// VerifyIntegrity stores a checksum of the responses and verifies it on
+	// lookups, a corrupted response being a miss.
+	VerifyIntegrity bool
+	// EvictionPolicy is the order entries are pruned in: EvictionLRU, the
+	// default, or EvictionLRUProtect.
+	EvictionPolicy string
+}
+
+// Eviction policies.
+const (
+	// EvictionLRU prunes the least recently accessed entries first.
+	EvictionLRU = "lru"
+	// EvictionLRUProtect prunes the entries never read since they were
+	// written first, least recently accessed first, so that a burst of
+	// one-shot queries does not evict the entries which are reused.
+	EvictionLRUProtect = "lru-protect"
+)
+
+var evictionOrders = map[string]string{
+	"":                 "last_accessed_at ASC, result_length DESC",
+	EvictionLRU:        "last_accessed_at ASC, result_length DESC",
+	EvictionLRUProtect: "(access_count = 1) DESC, last_accessed_at ASC, result_length DESC",
+}
+
+// evictionIndexes back the eviction orders which rpc_cache_last_accessed_at_idx
+// does not. They are only built under their policy, every hit updating
+// access_count.
+var evictionIndexes = map[string][]cacheIndex{
+	EvictionLRUProtect: {
+		{"rpc_cache_lru_protect_idx", "(access_count = 1) DESC, last_accessed_at ASC, result_length DESC"},
+	},
+}
+
+func (o Options) validate() error {
+	if o.MaxConns < 0 {
+		return fmt.Errorf("max conns must not be negative: %d", o.MaxConns)
+	}
+	if o.MinConns < 0 {
+		return fmt.Errorf("min conns must not be negative: %d", o.MinConns)
+	}
+	if o.MaxConns > 0 && o.MinConns > o.MaxConns {
+		return fmt.Errorf("min conns (%d) must not exceed max conns (%d)", o.MinConns, o.MaxConns)
+	}
+	if o.MaxConnLifetime < 0 {
+		return fmt.Errorf("max conn lifetime must not be negative: %s", o.MaxConnLifetime)
+	}
+	if o.ConnectRetries < 0 {
+		return fmt.Errorf("connect retries must not be negative: %d", o.ConnectRetries)
+	}
+	if o.ConnectRetryDelay < 0 {
+		return fmt.Errorf("connect retry delay must not be negative: %s", o.ConnectRetryDelay)
+	}
+	if o.CompressMinBytes < 0 {
+		return fmt.Errorf("compress min bytes must not be negative: %d", o.CompressMinBytes)
+	}
+	if _, ok := evictionOrders[o.EvictionPolicy]; !ok {
+		return fmt.Errorf("unknown eviction policy %q, expected %s or %s", o.EvictionPolicy, EvictionLRU, EvictionLRUProtect)
+	}
+	return nil
 }
 
 func NewDB(ctx context.Context, dsn string) (*DB, error) {
-	pool, err := pgxpool.New(ctx, dsn)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create connection pool: %w", err)
+	return NewDBWithOptions(ctx, dsn, Options{})
+}
+
+func NewDBWithOptions(ctx context.Context, dsn string, opts Options) (*DB, error) {
+	if err := opts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid pool options: %w", err)
 	}
 
-	if err := pool.Ping(ctx); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+	pool, err := connectWithRetries(ctx, dsn, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	s := &DB{pool: pool}
+	s := &DB{
+		pool:             pool,
+		readPool:         pool,
+		compressMinBytes: opts.CompressMinBytes,
+		verifyIntegrity:  opts.VerifyIntegrity,
+		evictionOrder:    evictionOrders[opts.EvictionPolicy],
+		evictionIndexes:  evictionIndexes[opts.EvictionPolicy],
+	}
+	if opts.ReadReplicaDSN != "" {
+		readPool, err := connectWithRetries(ctx, opts.ReadReplicaDSN, opts)
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("failed to connect to read replica: %w", err)
+		}
+		s.readPool = readPool
+	}
 	if err := s.init(ctx); err != nil {
 		return nil, fmt.Errorf("failed to init database: %w", err)
 	}
@@ -31,10 +181,112 @@ func NewDB(ctx context.Context, dsn string) (*DB, error) {
 	return s, nil
 }
 
+// connectWithRetries connects to dsn with the pool options, retrying while
+// the database is not reachable.
+func connectWithRetries(ctx context.Context, dsn string, opts Options) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database dsn: %w", err)
+	}
+	if opts.MaxConns > 0 {
+		poolConfig.MaxConns = opts.MaxConns
+	}
+	if opts.MinConns > 0 {
+		poolConfig.MinConns = opts.MinConns
+	}
+	if opts.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = opts.MaxConnLifetime
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	delay := opts.ConnectRetryDelay
+	if delay == 0 {
+		delay = defaultConnectRetryDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+		pool, err := connect(ctx, poolConfig)
+		if err == nil {
+			return pool, nil
+		}
+		if attempt > opts.ConnectRetries {
+			return nil, err
+		}
+
+		logger.Warn("failed to connect to database, retrying",
+			zap.Int("attempt", attempt),
+			zap.Int("max_attempts", opts.ConnectRetries+1),
+			zap.Duration("delay", delay),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up connecting to database: %w", ctx.Err())
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxConnectRetryDelay)
+	}
+}
+
+func connect(ctx context.Context, poolConfig *pgxpool.Config) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection pool: %w", err)
+	}
+
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	return pool, nil
+}
+
 func (s *DB) Close() {
+	if s.readPool != s.pool {
+		s.readPool.Close()
+	}
 	s.pool.Close()
 }
 
+// readRow runs a read-only query on the read pool, falling back to the
+// primary when the read replica fails.
+func (s *DB) readRow(ctx context.Context, dest []any, query string, args ...any) error {
+	err := s.readPool.QueryRow(ctx, query, args...).Scan(dest...)
+	if err == nil || errors.Is(err, pgx.ErrNoRows) || s.readPool == s.pool {
+		return err
+	}
+	return s.pool.QueryRow(ctx, query, args...).Scan(dest...)
+}
+
+// Stat returns a snapshot of the connection pool statistics.
+func (s *DB) Stat() *pgxpool.Stat {
+	return s.pool.Stat()
+}
+
+// PoolStats is a snapshot of the connection counts of the primary pool.
+type PoolStats struct {
+	Total    int32
+	Acquired int32
+	Idle     int32
+}
+
+// PoolStats returns the connection counts of the primary pool.
+func (s *DB) PoolStats() PoolStats {
+	stat := s.pool.Stat()
+	return PoolStats{
+		Total:    stat.TotalConns(),
+		Acquired: stat.AcquiredConns(),
+		Idle:     stat.IdleConns(),
+	}
+}
+
+func observeDuration(operation string, start time.Time) {
+	metrics.DBDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
 func (s *DB) init(ctx context.Context) error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS rpc_cache (
@@ -45,93 +297,630 @@ func (s *DB) init(ctx context.Context) error {
 			created_at TIMESTAMP NOT NULL,
 			last_accessed_at TIMESTAMP NOT NULL
 		)`,
+		`ALTER TABLE rpc_cache ADD COLUMN IF NOT EXISTS format SMALLINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE rpc_cache ADD COLUMN IF NOT EXISTS params BYTEA`,
+		`ALTER TABLE rpc_cache ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'client'`,
+		`ALTER TABLE rpc_cache ADD COLUMN IF NOT EXISTS headers BYTEA`,
+		`ALTER TABLE rpc_cache ADD COLUMN IF NOT EXISTS checksum BIGINT`,
+		// Counts the write and the reads of an entry
+		`ALTER TABLE rpc_cache ADD COLUMN IF NOT EXISTS access_count BIGINT NOT NULL DEFAULT 1`,
+		`CREATE TABLE IF NOT EXISTS tx_block_index (
+			tx_hash TEXT PRIMARY KEY,
+			block_number BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS rpc_cache_blocks (
+			key TEXT PRIMARY KEY,
+			block_number BIGINT NOT NULL,
+			block_hash TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS rpc_cache_blocks_block_number_idx ON rpc_cache_blocks (block_number)`,
+	}
+
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if err := migrate(ctx, conn, queries); err != nil {
+		return err
+	}
+
+	// Built once the lock is released: a concurrent build waits for the
+	// transactions of the instances waiting for the lock, which would
+	// deadlock
+	for _, index := range slices.Concat(cacheIndexes, s.evictionIndexes) {
+		if err := createIndex(ctx, conn, index.name, index.columns); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+// migrate runs the schema queries under an advisory lock, instances starting
+// together would otherwise race on the catalog.
+func migrate(ctx context.Context, conn *pgxpool.Conn, queries []string) error {
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, initLockID); err != nil {
+		return fmt.Errorf("failed to lock schema: %w", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, initLockID)
+
 	for _, query := range queries {
-		if _, err := s.pool.Exec(ctx, query); err != nil {
+		if _, err := conn.Exec(ctx, query); err != nil {
 			return fmt.Errorf("failed to execute query %s: %w", query, err)
 		}
 	}
+	return nil
+}
 
+// cacheIndex is an index of rpc_cache on columns, which may be expressions.
+type cacheIndex struct {
+	name    string
+	columns string
+}
+
+// cacheIndexes are the indexes of rpc_cache backing the default eviction order
+// and the age and per-method queries.
+var cacheIndexes = []cacheIndex{
+	{"rpc_cache_last_accessed_at_idx", "last_accessed_at ASC, result_length DESC"},
+	{"rpc_cache_created_at_idx", "created_at"},
+	{"rpc_cache_method_idx", "method"},
+}
+
+// createIndex creates an index of rpc_cache without blocking the writes of
+// the running instances, which matters on an already large table. A build
+// interrupted by a crash leaves an invalid index behind, which is rebuilt,
+// unless it is still being built by another instance.
+func createIndex(ctx context.Context, conn *pgxpool.Conn, name string, columns string) error {
+	var valid, building bool
+	err := conn.QueryRow(ctx, `
+		SELECT i.indisvalid, EXISTS (
+			SELECT 1 FROM pg_stat_progress_create_index p WHERE p.index_relid = i.indexrelid
+		)
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE c.relname = $1 AND pg_table_is_visible(c.oid)
+	`, name).Scan(&valid, &building)
+	switch {
+	case err == nil && (valid || building):
+		return nil
+	case err == nil:
+		if _, err := conn.Exec(ctx, `DROP INDEX CONCURRENTLY IF EXISTS `+name); err != nil {
+			return fmt.Errorf("failed to drop invalid index %s: %w", name, err)
+		}
+	case !errors.Is(err, pgx.ErrNoRows):
+		return fmt.Errorf("failed to check index %s: %w", name, err)
+	}
+
+	if _, err := conn.Exec(ctx, `CREATE INDEX CONCURRENTLY IF NOT EXISTS `+name+` ON rpc_cache (`+columns+`)`); err != nil {
+		return fmt.Errorf("failed to create index %s: %w", name, err)
+	}
 	return nil
 }
 
 func (s *DB) GetCachedRPCResult(ctx context.Context, key string) ([]byte, error) {
-	var response []byte
-	// We update last_accessed_at on read
+	response, _, err := s.GetCachedRPCResultWithAge(ctx, key)
+	return response, err
+}
+
+// GetCachedRPCResultWithAge returns the cached response along with the time
+// elapsed since it was stored. The age is computed by the database to not
+// depend on clock or timezone differences.
+func (s *DB) GetCachedRPCResultWithAge(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	response, _, age, err := s.GetCachedRPCResultWithParams(ctx, key)
+	return response, age, err
+}
+
+// GetCachedRPCResultWithParams is GetCachedRPCResultWithAge also returning the
+// params stored along with the response, nil if none were.
+func (s *DB) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	defer observeDuration("get", time.Now())
+
+	var response, params []byte
+	var format int16
+	var checksum *int64
+	var ageSeconds float64
+	var err error
+	if s.readPool != s.pool {
+		// The replica is read-only, the access is recorded on the primary
+		err = s.readRow(ctx, []any{&response, &format, &params, &checksum, &ageSeconds}, `
+			SELECT response, format, params, checksum, EXTRACT(EPOCH FROM (NOW() - created_at))::float8
+			FROM rpc_cache
+			WHERE key = $1
+		`, key)
+		if err == nil {
+			// Only orders evictions, a failure must not fail the lookup
+			_, _ = s.pool.Exec(ctx, `UPDATE rpc_cache SET last_accessed_at = NOW(), access_count = access_count + 1 WHERE key = $1`, key)
+		}
+	} else {
+		// We update last_accessed_at on read
+		err = s.pool.QueryRow(ctx, `
+			UPDATE rpc_cache 
+			SET last_accessed_at = NOW(), access_count = access_count + 1
+			WHERE key = $1 
+			RETURNING response, format, params, checksum, EXTRACT(EPOCH FROM (NOW() - created_at))::float8
+		`, key).Scan(&response, &format, &params, &checksum, &ageSeconds)
+	}
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, 0, nil
+		}
+		return nil, nil, 0, fmt.Errorf("failed to get cached rpc result: %w", classifyError(err))
+	}
+
+	response, err = decodeResponse(response, format)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to get cached rpc result: %w", err)
+	}
+	if !s.intact(response, checksum) {
+		// Served as a miss, the entry is overwritten by the next write
+		metrics.CorruptedEntries.Inc()
+		return nil, nil, 0, nil
+	}
+	return response, params, time.Duration(ageSeconds * float64(time.Second)), nil
+}
+
+// GetCacheEntry returns the stored entry for key without updating its
+// last_accessed_at, or nil if there is none.
+func (s *DB) GetCacheEntry(ctx context.Context, key string) (*CacheEntry, error) {
+	defer observeDuration("get", time.Now())
+
+	var entry CacheEntry
+	var format int16
 	err := s.pool.QueryRow(ctx, `
-		UPDATE rpc_cache 
-		SET last_accessed_at = NOW() 
-		WHERE key = $1 
-		RETURNING response
-	`, key).Scan(&response)
+		SELECT key, method, response, format, result_length, created_at, last_accessed_at, source
+		FROM rpc_cache
+		WHERE key = $1
+	`, key).Scan(&entry.Key, &entry.Method, &entry.Response, &format, &entry.ResultLength, &entry.CreatedAt, &entry.LastAccessedAt, &entry.Source)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("failed to get cached rpc result: %w", err)
+		return nil, fmt.Errorf("failed to get cache entry: %w", classifyError(err))
 	}
 
-	return response, nil
+	entry.Response, err = decodeResponse(entry.Response, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cache entry: %w", err)
+	}
+	return &entry, nil
 }
 
-func (s *DB) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte) error {
-	_, err := s.pool.Exec(ctx, `
-		INSERT INTO rpc_cache (key, method, response, result_length, created_at, last_accessed_at)
-		VALUES ($1, $2, $3, $4, NOW(), NOW())
-		ON CONFLICT (key) DO UPDATE
-		SET response = $3, result_length = $4, last_accessed_at = NOW()
-	`, key, method, response, len(response))
+// ExportCacheEntries calls fn with every stored entry, streaming them from the
+// database. The export stops at the first error returned by fn.
+func (s *DB) ExportCacheEntries(ctx context.Context, fn func(CacheEntry) error) error {
+	rows, err := s.pool.Query(ctx, `
+		SELECT key, method, response, format, result_length, created_at, last_accessed_at
+		FROM rpc_cache
+		ORDER BY key
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to export cache entries: %w", classifyError(err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry CacheEntry
+		var format int16
+		if err := rows.Scan(&entry.Key, &entry.Method, &entry.Response, &format, &entry.ResultLength, &entry.CreatedAt, &entry.LastAccessedAt); err != nil {
+			return fmt.Errorf("failed to scan cache entry: %w", classifyError(err))
+		}
+		if entry.Response, err = decodeResponse(entry.Response, format); err != nil {
+			return fmt.Errorf("failed to export cache entry %s: %w", entry.Key, err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to export cache entries: %w", classifyError(err))
+	}
+	return nil
+}
+
+// ImportCacheEntries inserts entries in a single batch, keeping their
+// created_at and recording source. Entries whose key is already stored are
+// skipped so that an import never overwrites fresher data. It returns the
+// number of inserted entries.
+func (s *DB) ImportCacheEntries(ctx context.Context, entries []CacheEntry, source string) (int64, error) {
+	defer observeDuration("set", time.Now())
 
+	batch := &pgx.Batch{}
+	for _, entry := range entries {
+		stored, format, err := s.encodeResponse(entry.Response)
+		if err != nil {
+			return 0, fmt.Errorf("failed to import cache entries: %w", err)
+		}
+		batch.Queue(`
+			INSERT INTO rpc_cache (key, method, response, format, result_length, created_at, last_accessed_at, source, checksum)
+			VALUES ($1, $2, $3, $4, $5, $6, NOW(), $7, $8)
+			ON CONFLICT (key) DO NOTHING
+		`, entry.Key, entry.Method, stored, format, len(stored), entry.CreatedAt, source, s.checksum(entry.Response))
+	}
+
+	results := s.pool.SendBatch(ctx, batch)
+	defer results.Close()
+
+	var imported int64
+	for range entries {
+		tag, err := results.Exec()
+		if err != nil {
+			return imported, fmt.Errorf("failed to import cache entries: %w", classifyError(err))
+		}
+		imported += tag.RowsAffected()
+	}
+	return imported, nil
+}
+
+// SetCachedRPCResult stores the response for key. When the key already
+// exists, for instance because two concurrent misses raced to write it, only
+// the response, its length and last_accessed_at are updated: created_at
+// always keeps the time of the first write so that age based logic is not
+// reset by a duplicate write. Use RefreshCachedRPCResult to reset it. The
+// params the key was derived from are stored as well when not nil. source
+// records where the response comes from and defaults to SourceClient.
+func (s *DB) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	defer observeDuration("set", time.Now())
+
+	if source == "" {
+		source = SourceClient
+	}
+	stored, format, err := s.encodeResponse(response)
 	if err != nil {
 		return fmt.Errorf("failed to set cached rpc result: %w", err)
 	}
+	_, err = s.pool.Exec(ctx, `
+		INSERT INTO rpc_cache (key, method, response, format, result_length, params, created_at, last_accessed_at, source, checksum)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW(), $7, $8)
+		ON CONFLICT (key) DO UPDATE
+		SET response = $3, format = $4, result_length = $5, params = $6, last_accessed_at = NOW(), source = $7, checksum = $8
+	`, key, method, stored, format, len(stored), params, source, s.checksum(response))
+
+	if err != nil {
+		return fmt.Errorf("failed to set cached rpc result: %w", classifyError(err))
+	}
+	return nil
+}
+
+// RefreshCachedRPCResult stores the response for key like SetCachedRPCResult
+// but also resets created_at, marking an existing entry as freshly fetched.
+func (s *DB) RefreshCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	defer observeDuration("set", time.Now())
+
+	if source == "" {
+		source = SourceClient
+	}
+	stored, format, err := s.encodeResponse(response)
+	if err != nil {
+		return fmt.Errorf("failed to refresh cached rpc result: %w", err)
+	}
+	_, err = s.pool.Exec(ctx, `
+		INSERT INTO rpc_cache (key, method, response, format, result_length, params, created_at, last_accessed_at, source, checksum)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW(), $7, $8)
+		ON CONFLICT (key) DO UPDATE
+		SET response = $3, format = $4, result_length = $5, params = $6, created_at = NOW(), last_accessed_at = NOW(), source = $7, checksum = $8
+	`, key, method, stored, format, len(stored), params, source, s.checksum(response))
+
+	if err != nil {
+		return fmt.Errorf("failed to refresh cached rpc result: %w", classifyError(err))
+	}
 	return nil
 }
 
+// SetCachedHeaders stores the upstream response headers replayed with the
+// cached response of key. Nil clears them. The entry must already exist.
+func (s *DB) SetCachedHeaders(ctx context.Context, key string, headers []byte) error {
+	defer observeDuration("set", time.Now())
+
+	_, err := s.pool.Exec(ctx, `UPDATE rpc_cache SET headers = $2 WHERE key = $1`, key, headers)
+	if err != nil {
+		return fmt.Errorf("failed to set cached headers: %w", classifyError(err))
+	}
+	return nil
+}
+
+// GetCachedHeaders returns the headers stored with the cached response of
+// key, nil if there are none.
+func (s *DB) GetCachedHeaders(ctx context.Context, key string) ([]byte, error) {
+	defer observeDuration("get", time.Now())
+
+	var headers []byte
+	err := s.readRow(ctx, []any{&headers}, `SELECT headers FROM rpc_cache WHERE key = $1`, key)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get cached headers: %w", classifyError(err))
+	}
+	return headers, nil
+}
+
 func (s *DB) GetCacheSize(ctx context.Context) (int64, error) {
+	defer observeDuration("size", time.Now())
+
 	var size int64
-	err := s.pool.QueryRow(ctx, `
+	err := s.readRow(ctx, []any{&size}, `
 		SELECT COALESCE(SUM(result_length + 64), 0) FROM rpc_cache
-	`).Scan(&size)
+	`)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get cache size: %w", err)
+		return 0, fmt.Errorf("failed to get cache size: %w", classifyError(err))
 	}
 	return size, nil
 }
 
 func (s *DB) GetCacheItemCount(ctx context.Context) (int64, error) {
+	defer observeDuration("count", time.Now())
+
 	var count int64
-	err := s.pool.QueryRow(ctx, `
+	err := s.readRow(ctx, []any{&count}, `
 		SELECT COUNT(*) FROM rpc_cache
-	`).Scan(&count)
+	`)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get cache item count: %w", err)
+		return 0, fmt.Errorf("failed to get cache item count: %w", classifyError(err))
 	}
 	return count, nil
 }
 
-func (s *DB) PruneCache(ctx context.Context, bytesToFree int64) (int64, error) {
-	var freedBytes int64
-	err := s.pool.QueryRow(ctx, `
+// CountExpiringBefore returns the number of entries whose ttl, counted from
+// their creation, ends before cutoff. The cutoff is made relative to the
+// clock of the database, which sets created_at.
+func (s *DB) CountExpiringBefore(ctx context.Context, cutoff time.Time, ttl time.Duration) (int64, error) {
+	defer observeDuration("count", time.Now())
+
+	var count int64
+	err := s.readRow(ctx, []any{&count}, `
+		SELECT COUNT(*) FROM rpc_cache WHERE created_at < NOW() + make_interval(secs => $1)
+	`, (time.Until(cutoff) - ttl).Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to count expiring entries: %w", classifyError(err))
+	}
+	return count, nil
+}
+
+// GetCacheItemCountBySource returns the number of entries per source.
+func (s *DB) GetCacheItemCountBySource(ctx context.Context) (map[string]int64, error) {
+	defer observeDuration("count", time.Now())
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT source, COUNT(*) FROM rpc_cache GROUP BY source
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cache item count by source: %w", classifyError(err))
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var source string
+		var count int64
+		if err := rows.Scan(&source, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan cache item count: %w", classifyError(err))
+		}
+		counts[source] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get cache item count by source: %w", classifyError(err))
+	}
+	return counts, nil
+}
+
+// PruneCache deletes the entries in the order of the eviction policy until
+// bytesToFree bytes are freed. It returns the freed bytes and the number of
+// deleted entries.
+func (s *DB) PruneCache(ctx context.Context, bytesToFree int64) (int64, int64, error) {
+	defer observeDuration("prune", time.Now())
+
+	var freedBytes, deleted int64
+	err := s.pool.QueryRow(ctx, fmt.Sprintf(`
 		WITH deleted AS (
 			DELETE FROM rpc_cache
 			WHERE key IN (
 				SELECT key
 				FROM (
-					SELECT key, result_length + 64 as item_size, SUM(result_length + 64) OVER (ORDER BY last_accessed_at ASC, result_length DESC) as running_total
+					SELECT key, result_length + 64 as item_size, SUM(result_length + 64) OVER (ORDER BY %s) as running_total
 					FROM rpc_cache
 				) t
 				WHERE running_total - item_size < $1
 			)
 			RETURNING result_length
 		)
-		SELECT COALESCE(SUM(result_length + 64), 0) FROM deleted;
-	`, bytesToFree).Scan(&freedBytes)
+		SELECT COALESCE(SUM(result_length + 64), 0), COUNT(*) FROM deleted;
+	`, s.evictionOrder), bytesToFree).Scan(&freedBytes, &deleted)
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to prune cache: %w", classifyError(err))
+	}
+	return freedBytes, deleted, nil
+}
+
+// PruneCacheByCount deletes the itemsToDelete first entries in the order of
+// the eviction policy, like PruneCache. It returns the number of deleted
+// entries and the freed bytes.
+func (s *DB) PruneCacheByCount(ctx context.Context, itemsToDelete int64) (int64, int64, error) {
+	defer observeDuration("prune", time.Now())
+
+	var deleted, freedBytes int64
+	err := s.pool.QueryRow(ctx, fmt.Sprintf(`
+		WITH deleted AS (
+			DELETE FROM rpc_cache
+			WHERE key IN (
+				SELECT key
+				FROM rpc_cache
+				ORDER BY %s
+				LIMIT $1
+			)
+			RETURNING result_length
+		)
+		SELECT COUNT(*), COALESCE(SUM(result_length + 64), 0) FROM deleted;
+	`, s.evictionOrder), itemsToDelete).Scan(&deleted, &freedBytes)
+
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to prune cache by count: %w", classifyError(err))
+	}
+	return deleted, freedBytes, nil
+}
+
+// SetBlockNumberForTx records the block number a transaction was included in.
+func (s *DB) SetBlockNumberForTx(ctx context.Context, txHash string, blockNumber uint64) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO tx_block_index (tx_hash, block_number)
+		VALUES ($1, $2)
+		ON CONFLICT (tx_hash) DO UPDATE
+		SET block_number = $2
+	`, strings.ToLower(txHash), int64(blockNumber))
+
+	if err != nil {
+		return fmt.Errorf("failed to set block number for tx: %w", classifyError(err))
+	}
+	return nil
+}
+
+// GetBlockNumberForTx returns the block number recorded for a transaction.
+// The boolean is false when the transaction is not indexed.
+func (s *DB) GetBlockNumberForTx(ctx context.Context, txHash string) (uint64, bool, error) {
+	var blockNumber int64
+	err := s.pool.QueryRow(ctx, `
+		SELECT block_number FROM tx_block_index WHERE tx_hash = $1
+	`, strings.ToLower(txHash)).Scan(&blockNumber)
+
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to get block number for tx: %w", classifyError(err))
+	}
+	return uint64(blockNumber), true, nil
+}
+
+// TrackBlockEntry records the block a cached entry was derived from so that
+// the entry can be invalidated if that block is reorged.
+func (s *DB) TrackBlockEntry(ctx context.Context, key string, blockNumber uint64, blockHash string) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO rpc_cache_blocks (key, block_number, block_hash)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE
+		SET block_number = $2, block_hash = $3
+	`, key, int64(blockNumber), strings.ToLower(blockHash))
+
+	if err != nil {
+		return fmt.Errorf("failed to track block entry: %w", classifyError(err))
+	}
+	return nil
+}
+
+// GetTrackedBlockNumbers returns the distinct block numbers of tracked
+// entries at or above fromBlock.
+func (s *DB) GetTrackedBlockNumbers(ctx context.Context, fromBlock uint64) ([]uint64, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT DISTINCT block_number FROM rpc_cache_blocks
+		WHERE block_number >= $1
+		ORDER BY block_number
+	`, int64(fromBlock))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tracked block numbers: %w", classifyError(err))
+	}
+
+	numbers, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (uint64, error) {
+		var n int64
+		err := row.Scan(&n)
+		return uint64(n), err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tracked block numbers: %w", classifyError(err))
+	}
+	return numbers, nil
+}
+
+// SampleCacheEntries returns a random sample of about percent percent of the
+// entries of methods which have their params stored, at most limit of them.
+func (s *DB) SampleCacheEntries(ctx context.Context, methods []string, percent float64, limit int) ([]CacheEntry, error) {
+	defer observeDuration("get", time.Now())
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT key, method, response, format, params
+		FROM rpc_cache TABLESAMPLE BERNOULLI ($1)
+		WHERE params IS NOT NULL AND method = ANY($2)
+		LIMIT $3
+	`, percent, methods, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample cache entries: %w", classifyError(err))
+	}
+	defer rows.Close()
+
+	var entries []CacheEntry
+	for rows.Next() {
+		var entry CacheEntry
+		var format int16
+		if err := rows.Scan(&entry.Key, &entry.Method, &entry.Response, &format, &entry.Params); err != nil {
+			return nil, fmt.Errorf("failed to scan cache entry: %w", classifyError(err))
+		}
+		if entry.Response, err = decodeResponse(entry.Response, format); err != nil {
+			return nil, fmt.Errorf("failed to sample cache entry %s: %w", entry.Key, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to sample cache entries: %w", classifyError(err))
+	}
+	return entries, nil
+}
+
+// DeleteCacheEntry deletes the entry stored for key. It returns false if
+// there was none.
+func (s *DB) DeleteCacheEntry(ctx context.Context, key string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `
+		DELETE FROM rpc_cache WHERE key = $1
+	`, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete cache entry: %w", classifyError(err))
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// DeleteNonCanonicalEntries deletes the cached entries derived from the given
+// block number whose block hash differs from the canonical one. It returns
+// the number of deleted cache entries.
+func (s *DB) DeleteNonCanonicalEntries(ctx context.Context, blockNumber uint64, canonicalHash string) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `
+		WITH stale AS (
+			DELETE FROM rpc_cache_blocks
+			WHERE block_number = $1 AND block_hash <> $2
+			RETURNING key
+		)
+		DELETE FROM rpc_cache WHERE key IN (SELECT key FROM stale)
+	`, int64(blockNumber), strings.ToLower(canonicalHash))
 
 	if err != nil {
-		return 0, fmt.Errorf("failed to prune cache: %w", err)
+		return 0, fmt.Errorf("failed to delete non-canonical entries: %w", classifyError(err))
 	}
-	return freedBytes, nil
+	return tag.RowsAffected(), nil
+}
+
+// ForgetTrackedBlocksBefore stops tracking the entries derived from blocks
+// below blockNumber, which are considered final.
+func (s *DB) ForgetTrackedBlocksBefore(ctx context.Context, blockNumber uint64) error {
+	_, err := s.pool.Exec(ctx, `
+		DELETE FROM rpc_cache_blocks WHERE block_number < $1
+	`, int64(blockNumber))
+
+	if err != nil {
+		return fmt.Errorf("failed to forget tracked blocks: %w", classifyError(err))
+	}
+	return nil
+}
+
+// Vacuum reclaims the dead tuples left by evictions and rewrites of the cache
+// table and refreshes its planner statistics.
+func (s *DB) Vacuum(ctx context.Context) error {
+	defer observeDuration("vacuum", time.Now())
+
+	// VACUUM cannot run inside a transaction, Exec without arguments uses
+	// the simple protocol and runs it on its own
+	if _, err := s.pool.Exec(ctx, `VACUUM (ANALYZE) rpc_cache`); err != nil {
+		return fmt.Errorf("failed to vacuum cache table: %w", classifyError(err))
+	}
+	return nil
 }
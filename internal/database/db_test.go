@@ -2,11 +2,19 @@ package database_test
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/clems4ever/ethereum-cache/internal/database"
 	"github.com/clems4ever/ethereum-cache/testdb"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -25,7 +33,7 @@ func TestDB(t *testing.T) {
 		response := []byte(`{"result":"success"}`)
 
 		// Set
-		err := db.SetCachedRPCResult(ctx, key, method, response)
+		err := db.SetCachedRPCResult(ctx, key, method, response, nil, "")
 		require.NoError(t, err)
 
 		// Get
@@ -47,11 +55,11 @@ func TestDB(t *testing.T) {
 		response2 := []byte(`{"result":"2"}`)
 
 		// Set initial
-		err := db.SetCachedRPCResult(ctx, key, method, response1)
+		err := db.SetCachedRPCResult(ctx, key, method, response1, nil, "")
 		require.NoError(t, err)
 
 		// Update
-		err = db.SetCachedRPCResult(ctx, key, method, response2)
+		err = db.SetCachedRPCResult(ctx, key, method, response2, nil, "")
 		require.NoError(t, err)
 
 		// Get
@@ -65,7 +73,7 @@ func TestDB(t *testing.T) {
 		method := "eth_test"
 		response := []byte("12345") // length 5
 
-		err := db.SetCachedRPCResult(ctx, key, method, response)
+		err := db.SetCachedRPCResult(ctx, key, method, response, nil, "")
 		require.NoError(t, err)
 
 		// Verify length in DB directly
@@ -80,7 +88,7 @@ func TestDB(t *testing.T) {
 		method := "eth_test"
 		response := []byte(`{}`)
 
-		err := db.SetCachedRPCResult(ctx, key, method, response)
+		err := db.SetCachedRPCResult(ctx, key, method, response, nil, "")
 		require.NoError(t, err)
 
 		// Get initial last_accessed_at
@@ -101,4 +109,585 @@ func TestDB(t *testing.T) {
 
 		assert.True(t, newAccess.After(initialAccess), "last_accessed_at should be updated")
 	})
+
+	t.Run("Rewrite Preserves Created At", func(t *testing.T) {
+		key := "test-key-rewrite"
+		method := "eth_test"
+
+		err := db.SetCachedRPCResult(ctx, key, method, []byte(`{"result":"1"}`), nil, "")
+		require.NoError(t, err)
+
+		var initialCreated, initialAccess time.Time
+		err = tdb.Pool().QueryRow(ctx, "SELECT created_at, last_accessed_at FROM rpc_cache WHERE key = $1", key).Scan(&initialCreated, &initialAccess)
+		require.NoError(t, err)
+
+		time.Sleep(100 * time.Millisecond) // Ensure time difference
+
+		// A concurrent miss writing the same key again
+		err = db.SetCachedRPCResult(ctx, key, method, []byte(`{"result":"2"}`), nil, "")
+		require.NoError(t, err)
+
+		var newCreated, newAccess time.Time
+		err = tdb.Pool().QueryRow(ctx, "SELECT created_at, last_accessed_at FROM rpc_cache WHERE key = $1", key).Scan(&newCreated, &newAccess)
+		require.NoError(t, err)
+
+		assert.Equal(t, initialCreated, newCreated, "created_at should be preserved")
+		assert.True(t, newAccess.After(initialAccess), "last_accessed_at should be updated")
+
+		// A refresh resets created_at
+		err = db.RefreshCachedRPCResult(ctx, key, method, []byte(`{"result":"3"}`), nil, "")
+		require.NoError(t, err)
+
+		err = tdb.Pool().QueryRow(ctx, "SELECT created_at FROM rpc_cache WHERE key = $1", key).Scan(&newCreated)
+		require.NoError(t, err)
+		assert.True(t, newCreated.After(initialCreated), "created_at should be reset")
+	})
+
+	t.Run("Stored Params", func(t *testing.T) {
+		err := db.SetCachedRPCResult(ctx, "test-key-params", "eth_test", []byte(`"0x1"`), []byte(`["0x123"]`), "")
+		require.NoError(t, err)
+
+		cached, params, _, err := db.GetCachedRPCResultWithParams(ctx, "test-key-params")
+		require.NoError(t, err)
+		assert.Equal(t, []byte(`"0x1"`), cached)
+		assert.Equal(t, []byte(`["0x123"]`), params)
+
+		// Entries stored without params have none
+		_, params, _, err = db.GetCachedRPCResultWithParams(ctx, "test-key-1")
+		require.NoError(t, err)
+		assert.Nil(t, params)
+	})
+
+	t.Run("Tx Block Index", func(t *testing.T) {
+		_, found, err := db.GetBlockNumberForTx(ctx, "0xABC")
+		require.NoError(t, err)
+		assert.False(t, found)
+
+		err = db.SetBlockNumberForTx(ctx, "0xABC", 42)
+		require.NoError(t, err)
+
+		// Hashes are matched case-insensitively
+		blockNumber, found, err := db.GetBlockNumberForTx(ctx, "0xabc")
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, uint64(42), blockNumber)
+	})
+}
+
+func TestNewDBWithOptions(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDBWithOptions(context.Background(), tdb.ConnString(), database.Options{
+		MaxConns:        7,
+		MinConns:        1,
+		MaxConnLifetime: time.Hour,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	assert.Equal(t, int32(7), db.Stat().MaxConns())
+}
+
+func TestNewDBWithInvalidOptions(t *testing.T) {
+	tests := []database.Options{
+		{MaxConns: -1},
+		{MinConns: -1},
+		{MaxConns: 2, MinConns: 3},
+		{MaxConnLifetime: -time.Second},
+		{EvictionPolicy: "lfu"},
+	}
+
+	for _, opts := range tests {
+		_, err := database.NewDBWithOptions(context.Background(), "postgres://localhost/unused", opts)
+		assert.Error(t, err, "options: %+v", opts)
+	}
+}
+
+func TestNewDBWithRetries(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	target := tdb.Conn().Config()
+
+	// Reserve a port which only starts forwarding to Postgres after a delay
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	forwarder := make(chan net.Listener, 1)
+	defer func() {
+		if l := <-forwarder; l != nil {
+			l.Close()
+		}
+	}()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Logf("failed to listen: %v", err)
+			forwarder <- nil
+			return
+		}
+		forwarder <- l
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go func() { io.Copy(upstream, conn); upstream.Close() }()
+			go func() { io.Copy(conn, upstream); conn.Close() }()
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, target.User, target.Password, target.Database)
+
+	db, err := database.NewDBWithOptions(context.Background(), dsn, database.Options{
+		ConnectRetries:    10,
+		ConnectRetryDelay: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+}
+
+func TestNewDBRetriesExhausted(t *testing.T) {
+	start := time.Now()
+	_, err := database.NewDBWithOptions(context.Background(), "postgres://postgres@127.0.0.1:1/postgres?connect_timeout=1", database.Options{
+		ConnectRetries:    2,
+		ConnectRetryDelay: 50 * time.Millisecond,
+	})
+	require.Error(t, err)
+	// Two retries wait 50ms then 100ms
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestDBDurationMetrics(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	initialGets := getHistogramCount("ethereum_cache_db_duration_seconds", "operation", "get")
+	initialSets := getHistogramCount("ethereum_cache_db_duration_seconds", "operation", "set")
+
+	err = db.SetCachedRPCResult(ctx, "test-key-metrics", "eth_test", []byte(`{}`), nil, "")
+	require.NoError(t, err)
+	_, err = db.GetCachedRPCResult(ctx, "test-key-metrics")
+	require.NoError(t, err)
+
+	assert.Equal(t, initialSets+1, getHistogramCount("ethereum_cache_db_duration_seconds", "operation", "set"))
+	assert.Equal(t, initialGets+1, getHistogramCount("ethereum_cache_db_duration_seconds", "operation", "get"))
+}
+
+func TestResponseCompression(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDBWithOptions(context.Background(), tdb.ConnString(), database.Options{
+		CompressMinBytes: 1024,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	small := []byte(`"0x1"`)
+	large := []byte(`"0x` + strings.Repeat("00", 4096) + `"`)
+
+	require.NoError(t, db.SetCachedRPCResult(ctx, "small", "eth_test", small, nil, ""))
+	require.NoError(t, db.SetCachedRPCResult(ctx, "large", "eth_test", large, nil, ""))
+
+	getStored := func(key string) (int16, int64) {
+		var format int16
+		var length int64
+		err := tdb.Pool().QueryRow(ctx, "SELECT format, result_length FROM rpc_cache WHERE key = $1", key).Scan(&format, &length)
+		require.NoError(t, err)
+		return format, length
+	}
+
+	// Below the threshold the response is stored raw
+	format, length := getStored("small")
+	assert.Equal(t, int16(0), format)
+	assert.Equal(t, int64(len(small)), length)
+
+	// Above it the response is stored gzipped
+	format, length = getStored("large")
+	assert.Equal(t, int16(1), format)
+	assert.Less(t, length, int64(len(large)))
+
+	// Both round-trip
+	cached, err := db.GetCachedRPCResult(ctx, "small")
+	require.NoError(t, err)
+	assert.Equal(t, small, cached)
+
+	cached, err = db.GetCachedRPCResult(ctx, "large")
+	require.NoError(t, err)
+	assert.Equal(t, large, cached)
+
+	entry, err := db.GetCacheEntry(ctx, "large")
+	require.NoError(t, err)
+	assert.Equal(t, large, entry.Response)
+}
+
+func TestVacuumAfterChurn(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	// Rewrites and evictions leave dead tuples behind
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			err := db.SetCachedRPCResult(ctx, fmt.Sprintf("churn-key-%d", i), "eth_test", []byte(fmt.Sprintf(`"%d-%d"`, round, i)), nil, "")
+			require.NoError(t, err)
+		}
+		_, _, err := db.PruneCacheByCount(ctx, 100)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, db.Vacuum(ctx))
+
+	count, err := db.GetCacheItemCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), count)
+}
+
+func getHistogramCount(name, labelName, labelValue string) uint64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return 0
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == labelName && label.GetValue() == labelValue {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestCacheEntrySources(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	require.NoError(t, db.SetCachedRPCResult(ctx, "client-1", "eth_test", []byte(`"0x1"`), nil, ""))
+	require.NoError(t, db.SetCachedRPCResult(ctx, "client-2", "eth_test", []byte(`"0x2"`), nil, database.SourceClient))
+	imported, err := db.ImportCacheEntries(ctx, []database.CacheEntry{
+		{Key: "import-1", Method: "eth_test", Response: []byte(`"0x3"`), CreatedAt: time.Now()},
+	}, database.SourceImport)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), imported)
+
+	counts, err := db.GetCacheItemCountBySource(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{database.SourceClient: 2, database.SourceImport: 1}, counts)
+
+	entry, err := db.GetCacheEntry(ctx, "import-1")
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, database.SourceImport, entry.Source)
+
+	// A client write takes over an imported entry
+	require.NoError(t, db.SetCachedRPCResult(ctx, "import-1", "eth_test", []byte(`"0x4"`), nil, ""))
+	counts, err = db.GetCacheItemCountBySource(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{database.SourceClient: 3}, counts)
+}
+
+func TestReadReplica(t *testing.T) {
+	ctx := context.Background()
+
+	// Distinct databases stand for the primary and its replica, telling
+	// which one served each query
+	primaryDB := testdb.NewDatabase(t)
+	replicaDB := testdb.NewDatabase(t)
+	replica, err := database.NewDB(ctx, replicaDB.ConnString())
+	require.NoError(t, err)
+	defer replica.Close()
+	require.NoError(t, replica.SetCachedRPCResult(ctx, "replicated", "eth_test", []byte(`"0x1"`), nil, ""))
+
+	db, err := database.NewDBWithOptions(ctx, primaryDB.ConnString(), database.Options{ReadReplicaDSN: replicaDB.ConnString()})
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Writes go to the primary
+	require.NoError(t, db.SetCachedRPCResult(ctx, "written", "eth_test", []byte(`"0x2"`), nil, ""))
+
+	// Lookups and counts are served by the replica
+	cached, err := db.GetCachedRPCResult(ctx, "replicated")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`"0x1"`), cached)
+	cached, err = db.GetCachedRPCResult(ctx, "written")
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+
+	count, err := db.GetCacheItemCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	size, err := db.GetCacheSize(ctx)
+	require.NoError(t, err)
+	replicaSize, err := replica.GetCacheSize(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, replicaSize, size)
+
+	// The entry is on the primary
+	primary, err := database.NewDB(ctx, primaryDB.ConnString())
+	require.NoError(t, err)
+	defer primary.Close()
+	cached, err = primary.GetCachedRPCResult(ctx, "written")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`"0x2"`), cached)
+}
+
+func TestCacheIndexes(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	ctx := context.Background()
+
+	// Instances starting together do not block each other
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := database.NewDB(ctx, tdb.ConnString())
+			if err == nil {
+				db.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// Initializing again, like a restart, keeps the existing indexes
+	db, err := database.NewDB(ctx, tdb.ConnString())
+	require.NoError(t, err)
+	db.Close()
+
+	rows, err := tdb.Pool().Query(ctx, `
+		SELECT c.relname
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_class t ON t.oid = i.indrelid
+		WHERE t.relname = 'rpc_cache' AND i.indisvalid
+	`)
+	require.NoError(t, err)
+	defer rows.Close()
+	var indexes []string
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		indexes = append(indexes, name)
+	}
+	require.NoError(t, rows.Err())
+
+	assert.Subset(t, indexes, []string{
+		"rpc_cache_last_accessed_at_idx",
+		"rpc_cache_created_at_idx",
+		"rpc_cache_method_idx",
+	})
+}
+
+func TestCountExpiringBefore(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	imported, err := db.ImportCacheEntries(ctx, []database.CacheEntry{
+		{Key: "old", Method: "eth_test", Response: []byte(`"0x1"`), CreatedAt: time.Now().Add(-55 * time.Minute)},
+		{Key: "recent", Method: "eth_test", Response: []byte(`"0x2"`), CreatedAt: time.Now().Add(-10 * time.Minute)},
+	}, database.SourceImport)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), imported)
+
+	// With a one hour ttl, only the old entry expires in the next 10 minutes
+	count, err := db.CountExpiringBefore(ctx, time.Now().Add(10*time.Minute), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	count, err = db.CountExpiringBefore(ctx, time.Now().Add(time.Hour), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestErrorSentinels(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// A missing key is a miss, not an error
+	cached, err := db.GetCachedRPCResult(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+
+	// Once the pool is closed the database is unreachable
+	db.Close()
+	_, err = db.GetCachedRPCResult(ctx, "missing")
+	assert.ErrorIs(t, err, database.ErrConnection)
+	assert.NotErrorIs(t, err, database.ErrQuery)
+	err = db.SetCachedRPCResult(ctx, "key", "eth_test", []byte(`"0x1"`), nil, "")
+	assert.ErrorIs(t, err, database.ErrConnection)
+	_, err = db.GetCacheItemCount(ctx)
+	assert.ErrorIs(t, err, database.ErrConnection)
+}
+
+func TestCachedHeaders(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	require.NoError(t, db.SetCachedRPCResult(ctx, "key", "eth_test", []byte(`"0x1"`), nil, ""))
+
+	headers, err := db.GetCachedHeaders(ctx, "key")
+	require.NoError(t, err)
+	assert.Nil(t, headers)
+
+	require.NoError(t, db.SetCachedHeaders(ctx, "key", []byte(`{"X-Block-Height":"0x10"}`)))
+	headers, err = db.GetCachedHeaders(ctx, "key")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"X-Block-Height":"0x10"}`, string(headers))
+
+	// Overwriting the response keeps the headers
+	require.NoError(t, db.SetCachedRPCResult(ctx, "key", "eth_test", []byte(`"0x2"`), nil, ""))
+	headers, err = db.GetCachedHeaders(ctx, "key")
+	require.NoError(t, err)
+	assert.NotNil(t, headers)
+
+	headers, err = db.GetCachedHeaders(ctx, "missing")
+	require.NoError(t, err)
+	assert.Nil(t, headers)
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	tdb := testdb.NewDatabase(t)
+	ctx := context.Background()
+	db, err := database.NewDBWithOptions(ctx, tdb.ConnString(), database.Options{VerifyIntegrity: true})
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SetCachedRPCResult(ctx, "key", "eth_test", []byte(`"0x1234"`), nil, ""))
+	cached, err := db.GetCachedRPCResult(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, `"0x1234"`, string(cached))
+
+	// Flip a byte behind the cache's back
+	conn, err := pgx.Connect(ctx, tdb.ConnString())
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, `UPDATE rpc_cache SET response = $1 WHERE key = 'key'`, []byte(`"0x1235"`))
+	require.NoError(t, err)
+
+	cached, err = db.GetCachedRPCResult(ctx, "key")
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+
+	// The next write repairs the entry
+	require.NoError(t, db.SetCachedRPCResult(ctx, "key", "eth_test", []byte(`"0x1234"`), nil, ""))
+	cached, err = db.GetCachedRPCResult(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, `"0x1234"`, string(cached))
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		// evicted is the first entry evicted
+		evicted string
+	}{
+		{database.EvictionLRU, "reused"},
+		{database.EvictionLRUProtect, "once-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			tdb := testdb.NewDatabase(t)
+			ctx := context.Background()
+			db, err := database.NewDBWithOptions(ctx, tdb.ConnString(), database.Options{EvictionPolicy: tt.policy})
+			require.NoError(t, err)
+			defer db.Close()
+
+			for _, key := range []string{"reused", "once-1", "once-2"} {
+				require.NoError(t, db.SetCachedRPCResult(ctx, key, "eth_test", []byte(`"0x1"`), nil, ""))
+			}
+			// Read again, but longer ago than the one-shot entries were
+			cached, err := db.GetCachedRPCResult(ctx, "reused")
+			require.NoError(t, err)
+			require.NotNil(t, cached)
+
+			conn, err := pgx.Connect(ctx, tdb.ConnString())
+			require.NoError(t, err)
+			defer conn.Close(ctx)
+			_, err = conn.Exec(ctx, `
+				UPDATE rpc_cache SET last_accessed_at = NOW() - CASE key
+					WHEN 'reused' THEN INTERVAL '3 hours'
+					WHEN 'once-1' THEN INTERVAL '2 hours'
+					ELSE INTERVAL '1 hour'
+				END
+			`)
+			require.NoError(t, err)
+
+			deleted, _, err := db.PruneCacheByCount(ctx, 1)
+			require.NoError(t, err)
+			require.Equal(t, int64(1), deleted)
+			cached, err = db.GetCachedRPCResult(ctx, tt.evicted)
+			require.NoError(t, err)
+			assert.Nil(t, cached)
+		})
+	}
+
+	// The reused entry survives until the one-shot entries are exhausted
+	tdb := testdb.NewDatabase(t)
+	ctx := context.Background()
+	db, err := database.NewDBWithOptions(ctx, tdb.ConnString(), database.Options{EvictionPolicy: database.EvictionLRUProtect})
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SetCachedRPCResult(ctx, "reused", "eth_test", []byte(`"0x1"`), nil, ""))
+	_, err = db.GetCachedRPCResult(ctx, "reused")
+	require.NoError(t, err)
+	require.NoError(t, db.SetCachedRPCResult(ctx, "once-1", "eth_test", []byte(`"0x1"`), nil, ""))
+	require.NoError(t, db.SetCachedRPCResult(ctx, "once-2", "eth_test", []byte(`"0x1"`), nil, ""))
+
+	_, deleted, err := db.PruneCache(ctx, 2*(5+64))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	count, err := db.GetCacheItemCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	cached, err := db.GetCachedRPCResult(ctx, "reused")
+	require.NoError(t, err)
+	assert.NotNil(t, cached)
+
+	// The eviction order has its own index
+	var valid bool
+	require.NoError(t, tdb.Pool().QueryRow(ctx, `
+		SELECT i.indisvalid
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE c.relname = 'rpc_cache_lru_protect_idx'
+	`).Scan(&valid))
+	assert.True(t, valid)
 }
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/puddle/v2"
+)
+
+// The errors of the DB methods wrap one of these, when they come from the
+// database, so that callers can tell an unavailable database from a failed
+// query with errors.Is. A missing entry is not an error: lookups return a nil
+// result.
+var (
+	// ErrConnection means the database could not be reached: the
+	// connection failed or was lost, timed out, or the pool is closed.
+	ErrConnection = errors.New("database connection error")
+	// ErrQuery means the database was reached but rejected the query.
+	ErrQuery = errors.New("database query error")
+)
+
+// classifyError wraps err with ErrConnection or ErrQuery. Errors which do not
+// come from the database, e.g. decoding errors, are returned as is.
+func classifyError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Class 08 is connection exception, 57P the server shutting down
+		// or being unavailable
+		if strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "57P") {
+			return fmt.Errorf("%w: %w", ErrConnection, err)
+		}
+		return fmt.Errorf("%w: %w", ErrQuery, err)
+	}
+
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	if errors.Is(err, puddle.ErrClosedPool) || errors.As(err, &connectErr) || errors.As(err, &netErr) ||
+		pgconn.Timeout(err) || pgconn.SafeToRetry(err) {
+		return fmt.Errorf("%w: %w", ErrConnection, err)
+	}
+	return err
+}
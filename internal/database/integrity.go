@@ -0,0 +1,25 @@
+package database
+
+import "hash/crc32"
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the checksum stored along with response, nil when the
+// integrity verification is disabled.
+func (s *DB) checksum(response []byte) *int64 {
+	if !s.verifyIntegrity {
+		return nil
+	}
+	sum := int64(crc32.Checksum(response, crc32c))
+	return &sum
+}
+
+// intact returns false when response does not match its stored checksum.
+// Entries stored without a checksum, before the verification was enabled,
+// cannot be verified and are trusted.
+func (s *DB) intact(response []byte, checksum *int64) bool {
+	if !s.verifyIntegrity || checksum == nil {
+		return true
+	}
+	return int64(crc32.Checksum(response, crc32c)) == *checksum
+}
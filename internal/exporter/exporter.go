@@ -5,21 +5,51 @@ import (
 	"time"
 
 	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/idle"
 	"github.com/clems4ever/ethereum-cache/internal/metrics"
 	"go.uber.org/zap"
 )
 
+// Store is the storage whose size is exported. It is implemented by
+// *database.DB.
+type Store interface {
+	GetCacheSize(ctx context.Context) (int64, error)
+	GetCacheItemCount(ctx context.Context) (int64, error)
+	CountExpiringBefore(ctx context.Context, cutoff time.Time, ttl time.Duration) (int64, error)
+}
+
+var _ Store = (*database.DB)(nil)
+
+// PoolStore is implemented by the stores whose connection pool is exported
+// along with the cache size.
+type PoolStore interface {
+	PoolStats() database.PoolStats
+}
+
+var _ PoolStore = (*database.DB)(nil)
+
 type Exporter struct {
 	logger   *zap.Logger
-	db       *database.DB
+	db       Store
 	interval time.Duration
+	idle     *idle.Tracker
+	// ttl is the freshness window of the entries and expiringWindow how
+	// close to its end an entry counts as expiring soon
+	ttl            time.Duration
+	expiringWindow time.Duration
 }
 
-func New(logger *zap.Logger, db *database.DB, interval time.Duration) *Exporter {
+// New creates an Exporter collecting every interval, except while idle
+// reports no recent client request. The entries expiring soon are only
+// counted when both ttl and expiringWindow are set.
+func New(logger *zap.Logger, db Store, interval time.Duration, idle *idle.Tracker, ttl time.Duration, expiringWindow time.Duration) *Exporter {
 	return &Exporter{
-		logger:   logger,
-		db:       db,
-		interval: interval,
+		logger:         logger,
+		db:             db,
+		interval:       interval,
+		idle:           idle,
+		ttl:            ttl,
+		expiringWindow: expiringWindow,
 	}
 }
 
@@ -28,19 +58,24 @@ func (e *Exporter) Start(ctx context.Context) {
 	defer ticker.Stop()
 
 	// Run immediately
-	e.collect(ctx)
+	e.Collect(ctx)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			e.collect(ctx)
+			if e.idle.Idle() {
+				continue
+			}
+			e.Collect(ctx)
 		}
 	}
 }
 
-func (e *Exporter) collect(ctx context.Context) {
+// Collect refreshes the cache size, item count, expiring soon and, when the
+// store has a connection pool, pool gauges.
+func (e *Exporter) Collect(ctx context.Context) {
 	size, err := e.db.GetCacheSize(ctx)
 	if err != nil {
 		e.logger.Error("failed to get cache size", zap.Error(err))
@@ -54,4 +89,20 @@ func (e *Exporter) collect(ctx context.Context) {
 	} else {
 		metrics.CacheItemsCount.Set(float64(count))
 	}
+
+	if pool, ok := e.db.(PoolStore); ok {
+		stats := pool.PoolStats()
+		metrics.DBConnsTotal.Set(float64(stats.Total))
+		metrics.DBConnsAcquired.Set(float64(stats.Acquired))
+		metrics.DBConnsIdle.Set(float64(stats.Idle))
+	}
+
+	if e.ttl > 0 && e.expiringWindow > 0 {
+		expiring, err := e.db.CountExpiringBefore(ctx, time.Now().Add(e.expiringWindow), e.ttl)
+		if err != nil {
+			e.logger.Error("failed to count expiring cache items", zap.Error(err))
+		} else {
+			metrics.ExpiringSoonItems.Set(float64(expiring))
+		}
+	}
 }
@@ -2,11 +2,13 @@ package exporter_test
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/clems4ever/ethereum-cache/internal/database"
 	"github.com/clems4ever/ethereum-cache/internal/exporter"
+	"github.com/clems4ever/ethereum-cache/internal/idle"
 	"github.com/clems4ever/ethereum-cache/testdb"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
@@ -23,17 +25,17 @@ func TestExporter(t *testing.T) {
 	// 2. Insert Data
 	ctx := context.Background()
 	// Item 1: 9 bytes + 64 overhead = 73 bytes
-	err = db.SetCachedRPCResult(ctx, "key1", "method1", []byte("response1"))
+	err = db.SetCachedRPCResult(ctx, "key1", "method1", []byte("response1"), nil, "")
 	require.NoError(t, err)
 	// Item 2: 9 bytes + 64 overhead = 73 bytes
-	err = db.SetCachedRPCResult(ctx, "key2", "method1", []byte("response2"))
+	err = db.SetCachedRPCResult(ctx, "key2", "method1", []byte("response2"), nil, "")
 	require.NoError(t, err)
 
 	// Total expected size: 146 bytes
 	// Total expected count: 2
 
 	// 3. Start Exporter
-	exp := exporter.New(zap.NewNop(), db, 100*time.Millisecond)
+	exp := exporter.New(zap.NewNop(), db, 100*time.Millisecond, nil, 0, 0)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -46,6 +48,105 @@ func TestExporter(t *testing.T) {
 		size := getMetricValue("ethereum_cache_size_bytes")
 		return count == 2 && size == 146
 	}, 2*time.Second, 50*time.Millisecond, "Metrics did not reach expected values")
+
+	// The connections used by the writes are in the pool
+	require.GreaterOrEqual(t, getMetricValue("ethereum_cache_db_conns_total"), float64(1))
+	require.Equal(t, getMetricValue("ethereum_cache_db_conns_total"),
+		getMetricValue("ethereum_cache_db_conns_acquired")+getMetricValue("ethereum_cache_db_conns_idle"))
+}
+
+// countingStore counts the collections.
+type countingStore struct {
+	collects atomic.Int32
+}
+
+func (s *countingStore) GetCacheSize(ctx context.Context) (int64, error) {
+	s.collects.Add(1)
+	return 0, nil
+}
+
+func (s *countingStore) GetCacheItemCount(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (s *countingStore) CountExpiringBefore(ctx context.Context, cutoff time.Time, ttl time.Duration) (int64, error) {
+	return 0, nil
+}
+
+func TestExporterPausesWhileIdle(t *testing.T) {
+	store := &countingStore{}
+	tracker := idle.NewTracker(100 * time.Millisecond)
+	exp := exporter.New(zap.NewNop(), store, 10*time.Millisecond, tracker, 0, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go exp.Start(ctx)
+
+	// Collections stop once no request was seen for the idle timeout
+	require.Eventually(t, tracker.Idle, time.Second, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	paused := store.collects.Load()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, paused, store.collects.Load())
+
+	// A request resumes them
+	tracker.Touch()
+	require.Eventually(t, func() bool {
+		return store.collects.Load() > paused
+	}, time.Second, 10*time.Millisecond)
+}
+
+// expiringStore holds entries created at the given times.
+type expiringStore struct {
+	countingStore
+	createdAt []time.Time
+}
+
+func (s *expiringStore) CountExpiringBefore(ctx context.Context, cutoff time.Time, ttl time.Duration) (int64, error) {
+	var count int64
+	for _, createdAt := range s.createdAt {
+		if createdAt.Add(ttl).Before(cutoff) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func TestExporterExpiringSoon(t *testing.T) {
+	now := time.Now()
+	store := &expiringStore{createdAt: []time.Time{
+		now.Add(-55 * time.Minute), // Expires in 5 minutes
+		now.Add(-58 * time.Minute), // Expires in 2 minutes
+		now.Add(-30 * time.Minute), // Expires in 30 minutes
+	}}
+
+	// Entries expire after an hour, the ones expiring in the next 10
+	// minutes are counted
+	exporter.New(zap.NewNop(), store, time.Minute, nil, time.Hour, 10*time.Minute).Collect(context.Background())
+	require.Equal(t, float64(2), getMetricValue("ethereum_cache_expiring_soon_items"))
+
+	// No ttl, nothing expires
+	store.createdAt = append(store.createdAt, now.Add(-2*time.Hour))
+	exporter.New(zap.NewNop(), store, time.Minute, nil, 0, 10*time.Minute).Collect(context.Background())
+	require.Equal(t, float64(2), getMetricValue("ethereum_cache_expiring_soon_items"))
+}
+
+// poolStore has a connection pool.
+type poolStore struct {
+	countingStore
+	stats database.PoolStats
+}
+
+func (s *poolStore) PoolStats() database.PoolStats {
+	return s.stats
+}
+
+func TestExporterPoolStats(t *testing.T) {
+	store := &poolStore{stats: database.PoolStats{Total: 5, Acquired: 2, Idle: 3}}
+	exporter.New(zap.NewNop(), store, time.Minute, nil, 0, 0).Collect(context.Background())
+	require.Equal(t, float64(5), getMetricValue("ethereum_cache_db_conns_total"))
+	require.Equal(t, float64(2), getMetricValue("ethereum_cache_db_conns_acquired"))
+	require.Equal(t, float64(3), getMetricValue("ethereum_cache_db_conns_idle"))
 }
 
 func getMetricValue(name string) float64 {
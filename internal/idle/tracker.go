@@ -0,0 +1,52 @@
+package idle
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Tracker records the time of the last client request so that background
+// loops can pause while no client is around. A nil Tracker is never idle.
+type Tracker struct {
+	timeout time.Duration
+	last    atomic.Int64
+}
+
+// NewTracker returns a Tracker considering the process idle timeout after the
+// last request, or nil if timeout is zero.
+func NewTracker(timeout time.Duration) *Tracker {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &Tracker{timeout: timeout}
+	t.Touch()
+	return t
+}
+
+// Touch records a request.
+func (t *Tracker) Touch() {
+	if t == nil {
+		return
+	}
+	t.last.Store(time.Now().UnixNano())
+}
+
+// Idle returns true when no request was recorded for the timeout.
+func (t *Tracker) Idle() bool {
+	if t == nil {
+		return false
+	}
+	return time.Since(time.Unix(0, t.last.Load())) > t.timeout
+}
+
+// Middleware records every request served by next.
+func (t *Tracker) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Touch()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Config returns the zap configuration for the given level (debug, info,
+// warn, error) and format (json, console). Empty values default to info and
+// json.
+func Config(level string, format string) (zap.Config, error) {
+	cfg := zap.NewProductionConfig()
+
+	if level != "" {
+		lvl, err := zapcore.ParseLevel(level)
+		if err != nil {
+			return zap.Config{}, fmt.Errorf("invalid log level %q: %w", level, err)
+		}
+		cfg.Level = zap.NewAtomicLevelAt(lvl)
+	}
+
+	switch format {
+	case "", "json":
+	case "console":
+		cfg.Encoding = "console"
+		cfg.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		return zap.Config{}, fmt.Errorf("invalid log format %q", format)
+	}
+
+	return cfg, nil
+}
+
+// New builds a logger for the given level and format.
+func New(level string, format string) (*zap.Logger, error) {
+	cfg, err := Config(level, format)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Build()
+}
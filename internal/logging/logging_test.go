@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestConfig(t *testing.T) {
+	tests := []struct {
+		level            string
+		format           string
+		expectedLevel    zapcore.Level
+		expectedEncoding string
+		hasError         bool
+	}{
+		{"", "", zapcore.InfoLevel, "json", false},
+		{"debug", "json", zapcore.DebugLevel, "json", false},
+		{"info", "console", zapcore.InfoLevel, "console", false},
+		{"warn", "json", zapcore.WarnLevel, "json", false},
+		{"error", "console", zapcore.ErrorLevel, "console", false},
+		{"verbose", "json", 0, "", true},
+		{"info", "xml", 0, "", true},
+	}
+
+	for _, test := range tests {
+		cfg, err := Config(test.level, test.format)
+		if test.hasError {
+			assert.Error(t, err, "level: %s, format: %s", test.level, test.format)
+			continue
+		}
+		require.NoError(t, err, "level: %s, format: %s", test.level, test.format)
+		assert.Equal(t, test.expectedLevel, cfg.Level.Level(), "level: %s, format: %s", test.level, test.format)
+		assert.Equal(t, test.expectedEncoding, cfg.Encoding, "level: %s, format: %s", test.level, test.format)
+	}
+}
+
+func TestNew(t *testing.T) {
+	logger, err := New("warn", "console")
+	require.NoError(t, err)
+	assert.False(t, logger.Core().Enabled(zapcore.InfoLevel))
+	assert.True(t, logger.Core().Enabled(zapcore.WarnLevel))
+}
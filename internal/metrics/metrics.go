@@ -3,6 +3,7 @@ package metrics
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
@@ -16,6 +17,26 @@ var (
 		Help: "The total number of cache misses",
 	}, []string{"method"})
 
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_requests_total",
+		Help: "The total number of JSON-RPC requests by cache result",
+	}, []string{"method", "result"})
+
+	InflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_inflight_requests",
+		Help: "The number of JSON-RPC requests being served",
+	})
+
+	InflightUpstreamRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_inflight_upstream_requests",
+		Help: "The number of upstream calls in flight",
+	})
+
+	ServedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ethereum_cache_served_bytes_total",
+		Help: "The total number of JSON-RPC response bytes served to clients",
+	})
+
 	CacheSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "ethereum_cache_size_bytes",
 		Help: "The current size of the cache in bytes",
@@ -25,4 +46,130 @@ var (
 		Name: "ethereum_cache_items_count",
 		Help: "The current number of items in the cache",
 	})
+
+	InternalMemoryBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_internal_memory_bytes",
+		Help: "Estimate of the memory held by the in-process structures: the fallback cache entries and the response size trackers",
+	})
+
+	ExpiringSoonItems = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_expiring_soon_items",
+		Help: "The current number of items reaching the end of their freshness window within the expiring soon window",
+	})
+
+	DBDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_db_degraded",
+		Help: "1 when the last cache database operation failed, 0 otherwise",
+	})
+
+	DBConnsTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_db_conns_total",
+		Help: "The current number of connections in the database pool",
+	})
+
+	DBConnsAcquired = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_db_conns_acquired",
+		Help: "The current number of database pool connections in use",
+	})
+
+	DBConnsIdle = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_db_conns_idle",
+		Help: "The current number of idle database pool connections",
+	})
+
+	DBBypassed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ethereum_cache_db_bypassed",
+		Help: "1 while the cache is bypassed because of a high database latency, 0 otherwise",
+	})
+
+	EmptyResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_empty_results_total",
+		Help: "The total number of upstream responses without error nor result",
+	}, []string{"method"})
+
+	StaleOnError = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_stale_on_error_total",
+		Help: "The total number of expired cache entries served because the upstream failed",
+	}, []string{"method"})
+
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_upstream_errors_total",
+		Help: "The total number of upstream calls which failed or returned an invalid response",
+	}, []string{"method", "reason"})
+
+	CacheWriteErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_write_errors_total",
+		Help: "The total number of failed cache writes",
+	}, []string{"method"})
+
+	KeyErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_key_errors_total",
+		Help: "The total number of cacheable calls not cached because no cache key could be derived from their params",
+	}, []string{"method"})
+
+	CorruptedEntries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ethereum_cache_corrupted_entries_total",
+		Help: "The total number of cached responses not matching their checksum, served as misses",
+	})
+
+	EvictedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_evicted_bytes_total",
+		Help: "The total number of bytes freed by evicting cache entries, by the limit that triggered the eviction",
+	}, []string{"reason"})
+
+	Evictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_evictions_total",
+		Help: "The total number of evicted cache entries, by the limit that triggered the eviction",
+	}, []string{"reason"})
+
+	ParamsLimitExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_params_limit_exceeded_total",
+		Help: "The total number of requests not cached because their params exceed the configured size or depth",
+	}, []string{"method", "limit"})
+
+	CacheCollisions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ethereum_cache_collisions_total",
+		Help: "The total number of cache hits whose stored params did not match the request",
+	})
+
+	CacheMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_mismatch_total",
+		Help: "The total number of sampled cache entries which differed from the upstream response",
+	}, []string{"method"})
+
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ethereum_cache_rate_limited_total",
+		Help: "The total number of requests rejected by the upstream rate limit",
+	}, []string{"scope"})
+
+	DBDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ethereum_cache_db_duration_seconds",
+		Help:    "The duration of database operations in seconds",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	ResponseBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ethereum_cache_response_bytes",
+		Help: "The size in bytes of the JSON-RPC responses served to clients",
+		// From 100B to ~26MB
+		Buckets: prometheus.ExponentialBuckets(100, 4, 10),
+	}, []string{"method"})
 )
+
+// Total returns the sum of the values of all the counters or gauges of c.
+func Total(c prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var total float64
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err == nil {
+			total += pb.GetCounter().GetValue() + pb.GetGauge().GetValue()
+		}
+	}
+	return total
+}
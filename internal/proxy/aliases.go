@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// methodAliases maps provider-specific methods to the standard method they
+// are equivalent to, so that both share their cache entries. Aliases are
+// keyed in lower case since viper lower-cases map keys.
+type methodAliases struct {
+	canonical map[string]string
+	// rewrite forwards the canonical method instead of the alias
+	rewrite bool
+}
+
+// resolve returns the canonical method of method, which is method itself
+// when it is not an alias.
+func (a methodAliases) resolve(method string) string {
+	if canonical, ok := a.canonical[strings.ToLower(method)]; ok {
+		return canonical
+	}
+	return method
+}
+
+// rewriteMethod replaces the method member of a request body.
+func rewriteMethod(body []byte, method string) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	members["method"], _ = json.Marshal(method)
+	return json.Marshal(members)
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"golang.org/x/sync/singleflight"
+)
+
+// blockTagTTL is how long a resolved block tag is reused before being
+// resolved again. The safe and finalized blocks move at most once per epoch.
+const blockTagTTL = 12 * time.Second
+
+// blockTagResolver resolves the safe and finalized block tags to the block
+// number they currently designate on an upstream, so that calls on them share
+// the cache entries of the calls on that number. A nil resolver resolves
+// nothing.
+type blockTagResolver struct {
+	fetch   func(ctx context.Context, upstream config.Upstream, tag string) (uint64, error)
+	fetches singleflight.Group
+
+	mu sync.Mutex
+	// blocks is keyed by upstream id and tag, upstreams lagging behind
+	// each other
+	blocks map[string]resolvedTag
+}
+
+// resolvedTag is the last resolution of a tag, failed when resolved is
+// false.
+type resolvedTag struct {
+	number     uint64
+	resolved   bool
+	resolvedAt time.Time
+}
+
+func newBlockTagResolver(enabled bool, fetch func(ctx context.Context, upstream config.Upstream, tag string) (uint64, error)) *blockTagResolver {
+	if !enabled {
+		return nil
+	}
+	return &blockTagResolver{fetch: fetch, blocks: make(map[string]resolvedTag)}
+}
+
+// resolve returns the block number designated by tag on upstream. It returns
+// false for the tags which are not resolved, latest and pending moving too
+// fast for their number to be worth caching, and when the tag cannot be
+// fetched. A failed fetch is not retried before blockTagTTL.
+func (r *blockTagResolver) resolve(ctx context.Context, upstream config.Upstream, tag string) (uint64, bool) {
+	if r == nil || (tag != "safe" && tag != "finalized") {
+		return 0, false
+	}
+	key := upstream.ID + "/" + tag
+	r.mu.Lock()
+	block, ok := r.blocks[key]
+	r.mu.Unlock()
+	if ok && time.Since(block.resolvedAt) <= blockTagTTL {
+		return block.number, block.resolved
+	}
+
+	// Concurrent requests share a single fetch per upstream and tag, made
+	// without holding the lock
+	ch := r.fetches.DoChan(key, func() (any, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedFetchTimeout)
+		defer cancel()
+
+		n, err := r.fetch(fetchCtx, upstream, tag)
+		r.mu.Lock()
+		r.blocks[key] = resolvedTag{number: n, resolved: err == nil, resolvedAt: time.Now()}
+		r.mu.Unlock()
+		return n, err
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return 0, false
+		}
+		return res.Val.(uint64), true
+	case <-ctx.Done():
+		return 0, false
+	}
+}
+
+// resolveBlockTag rewrites the safe or finalized block param of req, and of
+// its body, to the number of the block on upstream, which the request is
+// forwarded to. The request is returned unchanged when it has no such param
+// or the tag cannot be resolved.
+func (h *Handler) resolveBlockTag(ctx context.Context, upstream config.Upstream, req JSONRPCRequest, body []byte) (JSONRPCRequest, []byte) {
+	if h.blockTags == nil {
+		return req, body
+	}
+	index, ok := blockParamIndex(req.Method)
+	if !ok {
+		return req, body
+	}
+	var args []json.RawMessage
+	if err := json.Unmarshal(req.Params, &args); err != nil || len(args) <= index {
+		return req, body
+	}
+	var tag string
+	if err := json.Unmarshal(args[index], &tag); err != nil {
+		return req, body
+	}
+	number, ok := h.blockTags.resolve(ctx, upstream, tag)
+	if !ok {
+		return req, body
+	}
+	args[index], _ = json.Marshal(fmt.Sprintf("0x%x", number))
+	params, err := json.Marshal(args)
+	if err != nil {
+		return req, body
+	}
+	rewritten, err := rewriteParams(body, params)
+	if err != nil {
+		return req, body
+	}
+	req.Params = params
+	return req, rewritten
+}
+
+// rewriteParams replaces the params of a request body.
+func rewriteParams(body []byte, params json.RawMessage) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	members["params"] = params
+	return json.Marshal(members)
+}
+
+// fetchTaggedBlock returns the number of the block designated by tag on
+// upstream.
+func (h *Handler) fetchTaggedBlock(ctx context.Context, upstream config.Upstream, tag string) (uint64, error) {
+	result, err := h.callUpstream(ctx, upstream, fmt.Appendf(nil, `{"jsonrpc":"2.0","method":"eth_getBlockByNumber","params":[%q,false],"id":1}`, tag))
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch %s block: %w", tag, err)
+	}
+	var block struct {
+		Number string `json:"number"`
+	}
+	if err := json.Unmarshal(result, &block); err != nil {
+		return 0, fmt.Errorf("invalid %s block: %w", tag, err)
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(block.Number, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s block number %q: %w", tag, block.Number, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+)
+
+const (
+	defaultDBLatencyCooldown = 10 * time.Second
+	// latencyWeight is the weight of a new sample in the moving average
+	latencyWeight = 0.2
+)
+
+// latencyBreaker bypasses the cache while the database is too slow for it to
+// be worth it. It tracks a moving average of the latency of the cache reads
+// and writes and, once above the threshold, bypasses the cache for the
+// cooldown. The average then starts over from the next operations. A nil
+// breaker never bypasses.
+type latencyBreaker struct {
+	threshold time.Duration
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	average   time.Duration
+	samples   int
+	openUntil time.Time
+}
+
+func newLatencyBreaker(threshold time.Duration, cooldown time.Duration) *latencyBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = defaultDBLatencyCooldown
+	}
+	return &latencyBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns false while the cache is bypassed.
+func (b *latencyBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = time.Time{}
+	metrics.DBBypassed.Set(0)
+	return true
+}
+
+// observe records the latency of a database operation.
+func (b *latencyBreaker) observe(latency time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.openUntil.IsZero() {
+		// Operations started before the bypass engaged
+		return
+	}
+	if b.samples == 0 {
+		b.average = latency
+	} else {
+		b.average += time.Duration(latencyWeight * float64(latency-b.average))
+	}
+	b.samples++
+
+	if b.average > b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.average, b.samples = 0, 0
+		metrics.DBBypassed.Set(1)
+	}
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"encoding/json"
+)
+
+// Values of the non-standard cacheControl member of a request object.
+const (
+	// cacheControlNoStore skips both the cache read and write of the call.
+	cacheControlNoStore = "no-store"
+	// cacheControlNoCache skips the cache read and overwrites the stored
+	// entry with the fresh response.
+	cacheControlNoCache = "no-cache"
+)
+
+// stripCacheControl removes the cacheControl member from a request body so
+// that it never reaches the upstream.
+func stripCacheControl(body []byte) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	delete(members, "cacheControl")
+	return json.Marshal(members)
+}
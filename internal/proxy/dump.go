@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultImportMaxBytes = 100 * 1024 * 1024
+	importBatchSize       = 1000
+)
+
+// dumpEntry is a line of a cache dump.
+type dumpEntry struct {
+	Key       string          `json:"key"`
+	Method    string          `json:"method"`
+	Response  json.RawMessage `json:"response"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type importResponse struct {
+	Imported int64 `json:"imported"`
+	Skipped  int64 `json:"skipped"`
+}
+
+// ServeCacheExport streams every cache entry as newline-delimited JSON.
+func (h *Handler) ServeCacheExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	err := h.db.ExportCacheEntries(r.Context(), func(entry database.CacheEntry) error {
+		return enc.Encode(dumpEntry{
+			Key:       entry.Key,
+			Method:    entry.Method,
+			Response:  entry.Response,
+			CreatedAt: entry.CreatedAt,
+		})
+	})
+	if err != nil {
+		// The status has likely been sent already, the client notices the
+		// truncated dump from the connection being closed
+		h.logger.Error("failed to export cache entries", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ServeCacheImport inserts the entries of a newline-delimited JSON dump, as
+// produced by ServeCacheExport, in batches. Entries already in the cache are
+// skipped.
+func (h *Handler) ServeCacheImport(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, h.importMaxBytes)
+	resp, err := h.importDump(r.Context(), body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		var dumpErr *dumpError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			http.Error(w, "dump too large", http.StatusRequestEntityTooLarge)
+		case errors.As(err, &dumpErr):
+			http.Error(w, dumpErr.Error(), http.StatusBadRequest)
+		default:
+			h.logger.Error("failed to import cache entries", zap.Error(err))
+			http.Error(w, "failed to import cache entries", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// WarmUp imports the cache dump at path, so that its entries are served from
+// the cache as soon as the proxy starts. A dump which cannot be read or
+// imported is only logged, the entries imported before the failure are kept.
+func (h *Handler) WarmUp(ctx context.Context, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		h.logger.Warn("failed to open the warmup dump, starting cold", zap.String("file", path), zap.Error(err))
+		return
+	}
+	defer f.Close()
+
+	if _, err := h.importDump(ctx, f); err != nil {
+		h.logger.Warn("failed to import the warmup dump", zap.String("file", path), zap.Error(err))
+	}
+}
+
+// dumpError reports an entry of a dump which cannot be imported.
+type dumpError struct {
+	line   int
+	reason string
+}
+
+func (e *dumpError) Error() string {
+	return fmt.Sprintf("%s entry on line %d", e.reason, e.line)
+}
+
+// importDump inserts the entries of a newline-delimited JSON dump in
+// batches, skipping the entries already in the cache. It stops at the first
+// entry which cannot be decoded.
+func (h *Handler) importDump(ctx context.Context, r io.Reader) (importResponse, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var resp importResponse
+	batch := make([]database.CacheEntry, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		imported, err := h.db.ImportCacheEntries(ctx, batch, database.SourceImport)
+		resp.Imported += imported
+		resp.Skipped += int64(len(batch)) - imported
+		batch = batch[:0]
+		if err != nil {
+			return fmt.Errorf("failed to import cache entries: %w", err)
+		}
+		return nil
+	}
+	defer func() {
+		if resp.Imported > 0 && h.cleanupManager != nil {
+			h.cleanupManager.NotifyWrite()
+		}
+	}()
+
+	for line := 1; dec.More(); line++ {
+		var entry dumpEntry
+		if err := dec.Decode(&entry); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if !errors.As(err, &maxBytesErr) {
+				err = &dumpError{line: line, reason: "invalid"}
+			}
+			// The entries preceding the failure are imported anyway
+			return resp, errors.Join(err, flush())
+		}
+		if entry.Key == "" || entry.Method == "" || len(entry.Response) == 0 {
+			return resp, errors.Join(&dumpError{line: line, reason: "incomplete"}, flush())
+		}
+		if entry.CreatedAt.IsZero() {
+			entry.CreatedAt = time.Now().UTC()
+		}
+
+		batch = append(batch, database.CacheEntry{
+			Key:       entry.Key,
+			Method:    entry.Method,
+			Response:  entry.Response,
+			CreatedAt: entry.CreatedAt,
+		})
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return resp, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return resp, err
+	}
+
+	h.logger.Info("imported cache entries",
+		zap.Int64("imported", resp.Imported),
+		zap.Int64("skipped", resp.Skipped))
+	return resp, nil
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type cacheEntryResponse struct {
+	Key            string          `json:"key"`
+	Method         string          `json:"method"`
+	Response       json.RawMessage `json:"response"`
+	ResultLength   int64           `json:"result_length"`
+	CreatedAt      time.Time       `json:"created_at"`
+	LastAccessedAt time.Time       `json:"last_accessed_at"`
+	Source         string          `json:"source"`
+}
+
+// ServeCacheEntry returns the cached entry of the call described by the
+// method and params query parameters, in the cache partition of the upstream
+// query parameter if any. The key is derived exactly like in ServeHTTP.
+func (h *Handler) ServeCacheEntry(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		http.Error(w, "method is required", http.StatusBadRequest)
+		return
+	}
+	params := json.RawMessage(r.URL.Query().Get("params"))
+	upstream, ok := h.upstreamByID(r.URL.Query().Get("upstream"))
+	if !ok {
+		http.Error(w, "unknown upstream", http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.cacheKey(upstream, method, params)
+	if err != nil {
+		h.logger.Warn("invalid params", zap.Error(err))
+		http.Error(w, "invalid params", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := h.db.GetCacheEntry(r.Context(), key)
+	if err != nil {
+		h.logger.Error("failed to get cache entry", zap.Error(err))
+		http.Error(w, "failed to get cache entry", http.StatusInternalServerError)
+		return
+	}
+	if entry == nil {
+		http.Error(w, "cache entry not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(cacheEntryResponse{
+		Key:            entry.Key,
+		Method:         entry.Method,
+		Response:       entry.Response,
+		ResultLength:   entry.ResultLength,
+		CreatedAt:      entry.CreatedAt,
+		LastAccessedAt: entry.LastAccessedAt,
+		Source:         entry.Source,
+	})
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	parseErrorCode     = -32700
+	invalidRequestCode = -32600
+	methodNotFoundCode = -32601
+	internalErrorCode  = -32603
+)
+
+type JSONRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError responds with a JSON-RPC error carrying id, which is null when
+// the request could not be parsed. Like nodes do, the HTTP status is 200:
+// non-200 statuses are reserved to transport-level failures such as
+// authentication or rate limiting.
+func writeError(w http.ResponseWriter, id json.RawMessage, code int, message string) {
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(JSONRPCResponse{
+		JSONRPC: "2.0",
+		Error:   JSONRPCError{Code: code, Message: message},
+		ID:      id,
+	})
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+)
+
+const (
+	defaultFallbackCacheTTL = 30 * time.Second
+	defaultDedupeWindow     = time.Second
+)
+
+// fallbackCache is a bounded in-process LRU cache absorbing repeated requests
+// for a short time. It holds either the results whose write to the database
+// failed, while the database is failing, or the results just served, against
+// clients retrying right away, along with their cached headers. Besides the number of entries, their total
+// size is bounded by maxBytes when set. A nil cache is disabled.
+type fallbackCache struct {
+	mu       sync.Mutex
+	size     int
+	maxBytes int64
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+	// bytes is the estimated memory held by the entries
+	bytes int64
+}
+
+type fallbackEntry struct {
+	key      string
+	result   []byte
+	headers  []byte
+	storedAt time.Time
+}
+
+func newFallbackCache(size int, ttl time.Duration, maxBytes int64) *fallbackCache {
+	if size <= 0 {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = defaultFallbackCacheTTL
+	}
+	return &fallbackCache{
+		size:     size,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// entryBytes estimates the memory held by an entry.
+func entryBytes(entry *fallbackEntry) int64 {
+	return int64(len(entry.key) + len(entry.result) + len(entry.headers))
+}
+
+// get returns the result of key and its headers.
+func (c *fallbackCache) get(key string) ([]byte, []byte, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*fallbackEntry)
+	if time.Since(entry.storedAt) > c.ttl {
+		c.remove(elem)
+		return nil, nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.result, entry.headers, true
+}
+
+// add stores the result of key along with its headers, which may be nil.
+func (c *fallbackCache) add(key string, result []byte, headers []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &fallbackEntry{key: key, result: result, headers: headers, storedAt: time.Now()}
+	size := entryBytes(entry)
+	if c.maxBytes > 0 && size > c.maxBytes {
+		// Would evict everything else and still not fit
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += size
+	metrics.InternalMemoryBytes.Add(float64(size))
+	for c.order.Len() > c.size || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.order.Back())
+	}
+}
+
+// forget drops the entry of key, if any.
+func (c *fallbackCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *fallbackCache) remove(elem *list.Element) {
+	entry := elem.Value.(*fallbackEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	size := entryBytes(entry)
+	c.bytes -= size
+	metrics.InternalMemoryBytes.Sub(float64(size))
+}
+
+// observeDBError flags the database as degraded while its operations fail.
+func observeDBError(err error) {
+	if err != nil {
+		metrics.DBDegraded.Set(1)
+		return
+	}
+	metrics.DBDegraded.Set(0)
+}
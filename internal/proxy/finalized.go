@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultConfirmationDepth = 64
+	// headTTL is how long the head block number is reused before being
+	// fetched again
+	headTTL = 2 * time.Second
+	// sharedFetchTimeout bounds the fetches shared by concurrent requests,
+	// which outlive the request that started them
+	sharedFetchTimeout = 10 * time.Second
+)
+
+// headTracker caches the head block number of each upstream to tell whether
+// a block served by that upstream is deep enough to be final. A nil tracker
+// considers every block final.
+type headTracker struct {
+	depth   uint64
+	fetch   func(ctx context.Context, upstream config.Upstream) (uint64, error)
+	fetches singleflight.Group
+
+	mu sync.Mutex
+	// heads is keyed by upstream id, upstreams lagging behind each other
+	heads map[string]trackedHead
+}
+
+// trackedHead is the last fetch of the head of an upstream, failed when
+// fetched is false.
+type trackedHead struct {
+	number    uint64
+	fetched   bool
+	fetchedAt time.Time
+}
+
+func newHeadTracker(enabled bool, depth uint64, fetch func(ctx context.Context, upstream config.Upstream) (uint64, error)) *headTracker {
+	if !enabled {
+		return nil
+	}
+	if depth == 0 {
+		depth = defaultConfirmationDepth
+	}
+	return &headTracker{depth: depth, fetch: fetch, heads: make(map[string]trackedHead)}
+}
+
+// isFinal returns true when block is at least depth blocks below the head of
+// upstream. It returns false when the head cannot be fetched.
+func (t *headTracker) isFinal(ctx context.Context, upstream config.Upstream, block uint64) bool {
+	if t == nil {
+		return true
+	}
+	head, ok := t.current(ctx, upstream)
+	return ok && head >= t.depth && block <= head-t.depth
+}
+
+// current returns the head block number of upstream, fetched at most once
+// per headTTL. A failed fetch is not retried before headTTL either, so that
+// an unavailable upstream is not called on every request.
+func (t *headTracker) current(ctx context.Context, upstream config.Upstream) (uint64, bool) {
+	t.mu.Lock()
+	head, ok := t.heads[upstream.ID]
+	t.mu.Unlock()
+	if ok && time.Since(head.fetchedAt) <= headTTL {
+		return head.number, head.fetched
+	}
+
+	// Concurrent requests share a single fetch per upstream, made without
+	// holding the lock
+	ch := t.fetches.DoChan(upstream.ID, func() (any, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedFetchTimeout)
+		defer cancel()
+
+		number, err := t.fetch(fetchCtx, upstream)
+		t.mu.Lock()
+		t.heads[upstream.ID] = trackedHead{number: number, fetched: err == nil, fetchedAt: time.Now()}
+		t.mu.Unlock()
+		return number, err
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return 0, false
+		}
+		return res.Val.(uint64), true
+	case <-ctx.Done():
+		return 0, false
+	}
+}
+
+// blockParamIndex returns the index of the block param of the methods
+// addressing a block by number, cacheable by default or once enabled at
+// runtime.
+func blockParamIndex(method string) (int, bool) {
+	switch method {
+	case "eth_getStorageAt", "eth_getProof":
+		return 2, true
+	case "eth_getCode", "eth_getBalance", "eth_getTransactionCount":
+		// Only cached once enabled at runtime
+		return 1, true
+	case "debug_traceBlockByNumber", "eth_getBlockReceipts", "eth_getUncleByBlockNumberAndIndex",
+		"eth_getTransactionByBlockNumberAndIndex", "trace_block":
+		return 0, true
+	case "eth_feeHistory":
+		// The newest block of the range
+		return 1, true
+	default:
+		return 0, false
+	}
+}
+
+// callBlock returns the block a cacheable call depends on, along with
+// whether it is known. Transaction lookups carry it in their result instead.
+func callBlock(method string, params json.RawMessage) (uint64, bool) {
+	index, ok := blockParamIndex(method)
+	if !ok {
+		return 0, false
+	}
+	var args []interface{}
+	if err := json.Unmarshal(params, &args); err != nil || len(args) <= index {
+		return 0, false
+	}
+	blockParam, ok := args[index].(string)
+	if !ok || !strings.HasPrefix(blockParam, "0x") || len(blockParam) > len("0x")+16 {
+		// Block tags and hashes do not tell the block number
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(blockParam, "0x"), 16, 64)
+	return n, err == nil
+}
+
+// isFinalCall returns false when the block of a call to a block-specific
+// method is unknown or too recent, on upstream, to be cached safely.
+func (h *Handler) isFinalCall(ctx context.Context, upstream config.Upstream, req JSONRPCRequest) bool {
+	if h.head == nil || isTxLookup(req.Method) || req.Method == "trace_transaction" {
+		// Transaction lookups are checked on their result
+		return true
+	}
+	if req.Method == "eth_getUncleByBlockHashAndIndex" || req.Method == "eth_getTransactionByBlockHashAndIndex" {
+		// A block addressed by hash is the same whether it is canonical
+		// or not
+		return true
+	}
+	block, ok := callBlock(req.Method, h.withAbsentBlock(req.Method, req.Params))
+	return ok && h.head.isFinal(ctx, upstream, block)
+}
+
+// isFinalResult returns false when the block of a transaction lookup result
+// served by upstream is unknown or too recent to be cached safely.
+func (h *Handler) isFinalResult(ctx context.Context, upstream config.Upstream, req JSONRPCRequest, result json.RawMessage) bool {
+	if h.head == nil {
+		return true
+	}
+	if req.Method == "trace_transaction" {
+		block, ok := traceBlock(result)
+		return ok && h.head.isFinal(ctx, upstream, block)
+	}
+	if !isTxLookup(req.Method) {
+		return true
+	}
+	block, _, ok := resultBlock(result)
+	if !ok {
+		return false
+	}
+	if h.indexTxBlocks {
+		// Transactions are only indexed once cached, so once final. The
+		// other lookup of the transaction does not need the head.
+		if indexed, found := h.knownTxBlock(ctx, req); found && indexed == block {
+			return true
+		}
+	}
+	return h.head.isFinal(ctx, upstream, block)
+}
+
+// traceBlock extracts the block of a trace_transaction result, carried by
+// each of its traces as a number.
+func traceBlock(result json.RawMessage) (uint64, bool) {
+	var traces []struct {
+		BlockNumber *uint64 `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(result, &traces); err != nil || len(traces) == 0 || traces[0].BlockNumber == nil {
+		return 0, false
+	}
+	return *traces[0].BlockNumber, true
+}
+
+// fetchHead returns the head block number of upstream.
+func (h *Handler) fetchHead(ctx context.Context, upstream config.Upstream) (uint64, error) {
+	result, err := h.callUpstream(ctx, upstream, []byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch head: %w", err)
+	}
+	var head string
+	if err := json.Unmarshal(result, &head); err != nil {
+		return 0, fmt.Errorf("invalid head: %w", err)
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(head, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid head %q: %w", head, err)
+	}
+	return n, nil
+}
+
+// callUpstream sends a call of the proxy itself to upstream and returns its
+// result.
+func (h *Handler) callUpstream(ctx context.Context, upstream config.Upstream, body []byte) (json.RawMessage, error) {
+	upstreamReq, err := h.newUpstreamRequest(ctx, upstream, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	upstreamResp, err := h.doUpstream(upstreamReq)
+	if err != nil {
+		return nil, err
+	}
+	defer upstreamResp.Body.Close()
+
+	respBody, err := readUpstreamBody(upstreamResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	var resp JSONRPCResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.Error != nil || len(resp.Result) == 0 {
+		return nil, errors.New("upstream returned no result")
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// getMethods are the methods that may be called over HTTP GET. They are all
+// read-only so that a crawled or prefetched link can never alter the chain.
+var getMethods = map[string]bool{
+	"eth_blockNumber":           true,
+	"eth_chainId":               true,
+	"eth_gasPrice":              true,
+	"eth_getBalance":            true,
+	"eth_getBlockByHash":        true,
+	"eth_getBlockByNumber":      true,
+	"eth_getCode":               true,
+	"eth_getProof":              true,
+	"eth_getStorageAt":          true,
+	"eth_getTransactionByHash":  true,
+	"eth_getTransactionReceipt": true,
+	"eth_syncing":               true,
+	"net_version":               true,
+	"web3_clientVersion":        true,
+}
+
+var errMethodNotAllowedOverGet = errors.New("method not allowed over GET")
+
+// getRequestBody builds the JSON-RPC body equivalent to a GET request of the
+// form /?method=eth_blockNumber&params=[]&id=1. params defaults to an empty
+// list and id to 1.
+func getRequestBody(r *http.Request) ([]byte, error) {
+	query := r.URL.Query()
+
+	method := query.Get("method")
+	if !getMethods[method] {
+		return nil, errMethodNotAllowedOverGet
+	}
+
+	params := json.RawMessage(`[]`)
+	if p := query.Get("params"); p != "" {
+		params = json.RawMessage(p)
+	}
+	id := json.RawMessage(`1`)
+	if i := query.Get("id"); i != "" {
+		id = json.RawMessage(i)
+	}
+
+	body, err := json.Marshal(JSONRPCRequest{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid query parameters: %w", err)
+	}
+	return body, nil
+}
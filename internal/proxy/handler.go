@@ -2,42 +2,293 @@ package proxy
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"compress/gzip"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand/v2"
+	"mime"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/clems4ever/ethereum-cache/internal/cleanup"
+	"github.com/clems4ever/ethereum-cache/internal/config"
 	"github.com/clems4ever/ethereum-cache/internal/database"
 	"github.com/clems4ever/ethereum-cache/internal/metrics"
+	"github.com/clems4ever/ethereum-cache/internal/recording"
+	"github.com/clems4ever/ethereum-cache/internal/redact"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 	"golang.org/x/time/rate"
 )
 
+const (
+	// CacheBypassHeader makes the handler skip the cache read and fetch a
+	// fresh response from the upstream.
+	CacheBypassHeader = "X-Cache-Bypass"
+	// CacheRefreshHeader, combined with CacheBypassHeader, overwrites the
+	// stored entry with the fresh upstream response.
+	CacheRefreshHeader = "X-Cache-Refresh"
+	// CacheStatusHeader tells the client whether the response was served
+	// from the cache (HIT), fetched and cached (MISS) or not cached at all
+	// (BYPASS).
+	CacheStatusHeader = "X-Cache"
+	// CacheKeyHeader exposes a prefix of the cache key for debugging.
+	CacheKeyHeader = "X-Cache-Key"
+
+	cacheKeyHeaderPrefixLen = 16
+
+	jsonContentType = "application/json; charset=utf-8"
+)
+
 type Handler struct {
-	logger         *zap.Logger
-	upstreamURL    string
-	db             *database.DB
-	httpClient     *http.Client
-	cleanupManager *cleanup.Manager
-	limiter        *rate.Limiter
+	logger                   *zap.Logger
+	upstreams                []config.Upstream
+	totalWeight              int
+	upstreamHeaders          http.Header
+	db                       Store
+	httpClient               *http.Client
+	cleanupManager           *cleanup.Manager
+	limiter                  *rate.Limiter
+	methodLimiters           map[string]*rate.Limiter
+	allowCacheBypassHeader   bool
+	allowRPCCacheControl     bool
+	rewriteUpstreamIDs       bool
+	upstreamIDs              atomic.Uint64
+	exposeCacheKeyHeader     bool
+	indexTxBlocks            bool
+	chainNamespace           string
+	trackBlocks              bool
+	strictContentType        bool
+	strictJSONRPC            bool
+	allowGetRequests         bool
+	cacheBlockTraces         bool
+	cacheParityTraces        bool
+	importMaxBytes           int64
+	methods                  methodFilter
+	aliases                  methodAliases
+	verifyCacheKey           bool
+	canonicalProofKeys       bool
+	minifyResponses          bool
+	cachedHeaders            cachedHeaders
+	storeParams              bool
+	maxStoredParamsBytes     int64
+	staleWhileRevalidate     bool
+	staleOnError             bool
+	requestTimeout           time.Duration
+	freshnessWindow          time.Duration
+	stalenessWindow          time.Duration
+	revalidations            singleflight.Group
+	maxCacheableBytes        map[string]int64
+	writeSampleRates         map[string]float64
+	resultPredicates         resultPredicates
+	absentBlocks             map[string]string
+	defaultMaxCacheableBytes int64
+	negativeCaching          bool
+	keys                     KeyGenerator
+	maxParamsBytes           int64
+	maxParamsDepth           int
+	fallback                 *fallbackCache
+	recent                   *fallbackCache
+	breaker                  *latencyBreaker
+	sizeFilter               *sizeFilter
+	overrides                cachingOverrides
+	head                     *headTracker
+	blockTags                *blockTagResolver
+	recorder                 *recording.Recorder
+}
+
+func NewHandler(logger *zap.Logger, db Store, cleanupManager *cleanup.Manager, cfg config.Config) (*Handler, error) {
+	return NewHandlerWithKeyGenerator(logger, db, cleanupManager, cfg, nil)
 }
 
-func NewHandler(logger *zap.Logger, upstreamURL string, db *database.DB, cleanupManager *cleanup.Manager, rateLimit float64) *Handler {
+// NewHandlerWithKeyGenerator is NewHandler deriving the cache keys with keys
+// instead of the default generator. A nil keys uses the default one.
+func NewHandlerWithKeyGenerator(logger *zap.Logger, db Store, cleanupManager *cleanup.Manager, cfg config.Config, keys KeyGenerator) (*Handler, error) {
+	upstreams, err := cfg.GetUpstreams()
+	if err != nil {
+		return nil, err
+	}
+	chainNamespace, err := cfg.GetChainNamespace()
+	if err != nil {
+		return nil, err
+	}
+	var totalWeight int
+	for _, u := range upstreams {
+		totalWeight += u.Weight
+	}
+	if keys == nil {
+		if keys, err = NewDefaultKeyGenerator(cfg.CacheKeyHash); err != nil {
+			return nil, err
+		}
+	}
+	maxCacheableBytes, defaultMaxCacheableBytes, err := cfg.GetMaxCacheableBytes()
+	if err != nil {
+		return nil, err
+	}
+	importMaxBytes, err := config.ParseBytes(cfg.CacheImportMaxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache_import_max_bytes: %w", err)
+	}
+	if importMaxBytes == 0 {
+		importMaxBytes = defaultImportMaxBytes
+	}
+	maxParamsBytes, err := config.ParseBytes(cfg.MaxParamsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_cacheable_params_bytes: %w", err)
+	}
+	maxStoredParamsBytes, err := config.ParseBytes(cfg.MaxStoredParamsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_stored_params_bytes: %w", err)
+	}
+	fallbackCacheBytes, err := config.ParseBytes(cfg.FallbackCacheBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fallback_cache_bytes: %w", err)
+	}
+	freshnessWindow := cfg.GetFreshnessWindow()
+	if cfg.StaleWhileRevalidate && freshnessWindow > cfg.FreshnessWindow {
+		// A window that short would refetch nearly every hit
+		logger.Warn("freshness_window is below min_cache_ttl, using min_cache_ttl",
+			zap.Duration("freshness_window", cfg.FreshnessWindow),
+			zap.Duration("min_cache_ttl", cfg.MinCacheTTL))
+	}
+
+	var transport http.RoundTripper
+	transport, err = newUpstreamTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReplayFile != "" {
+		transport, err = recording.NewReplayTransport(cfg.ReplayFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	recorder, err := recording.NewRecorder(logger, cfg.RecordFile)
+	if err != nil {
+		return nil, err
+	}
+
 	var limiter *rate.Limiter
-	if rateLimit > 0 {
-		limiter = rate.NewLimiter(rate.Limit(rateLimit), int(rateLimit)+1)
+	if cfg.RateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), int(cfg.RateLimit)+1)
 	}
-	return &Handler{
-		logger:         logger,
-		upstreamURL:    upstreamURL,
-		db:             db,
-		httpClient:     &http.Client{},
-		cleanupManager: cleanupManager,
-		limiter:        limiter,
+	// Keyed by lower-cased method name since viper lower-cases map keys
+	methodLimiters := make(map[string]*rate.Limiter, len(cfg.PerMethodRateLimit))
+	for method, limit := range cfg.PerMethodRateLimit {
+		if limit < 0 {
+			return nil, fmt.Errorf("invalid per_method_rate_limit for %s: %v", method, limit)
+		}
+		if limit > 0 {
+			methodLimiters[strings.ToLower(method)] = rate.NewLimiter(rate.Limit(limit), int(limit)+1)
+		}
+	}
+	aliases := methodAliases{canonical: make(map[string]string, len(cfg.MethodAliases)), rewrite: cfg.RewriteMethodAliases}
+	for alias, canonical := range cfg.MethodAliases {
+		if canonical == "" {
+			return nil, fmt.Errorf("invalid method_aliases for %s: empty method", alias)
+		}
+		aliases.canonical[strings.ToLower(alias)] = canonical
+	}
+	// Keyed by lower-cased method name since viper lower-cases map keys
+	writeSampleRates := make(map[string]float64, len(cfg.CacheWriteSampleRate))
+	for method, sampleRate := range cfg.CacheWriteSampleRate {
+		if sampleRate < 0 || sampleRate > 1 {
+			return nil, fmt.Errorf("invalid cache_write_sample_rate for %s: %v", method, sampleRate)
+		}
+		writeSampleRates[strings.ToLower(method)] = sampleRate
 	}
+	dedupeWindow := cfg.DedupeWindow
+	if dedupeWindow <= 0 {
+		dedupeWindow = defaultDedupeWindow
+	}
+	absentBlocks := make(map[string]string, len(cfg.AbsentBlockDefaults))
+	for method, block := range cfg.AbsentBlockDefaults {
+		// Tags would never be cached
+		if _, err := strconv.ParseUint(strings.TrimPrefix(block, "0x"), 16, 64); !strings.HasPrefix(block, "0x") || err != nil {
+			return nil, fmt.Errorf("invalid absent_block_defaults for %s: %q is not a block number", method, block)
+		}
+		absentBlocks[strings.ToLower(method)] = block
+	}
+	h := &Handler{
+		logger:                   logger,
+		upstreams:                upstreams,
+		totalWeight:              totalWeight,
+		upstreamHeaders:          cfg.GetUpstreamHeaders(),
+		db:                       db,
+		httpClient:               &http.Client{Transport: inflightTransport{next: transport}},
+		cleanupManager:           cleanupManager,
+		limiter:                  limiter,
+		methodLimiters:           methodLimiters,
+		allowCacheBypassHeader:   cfg.AllowCacheBypassHeader,
+		allowRPCCacheControl:     cfg.AllowRPCCacheControl,
+		rewriteUpstreamIDs:       cfg.RewriteUpstreamIDs,
+		exposeCacheKeyHeader:     cfg.ExposeCacheKeyHeader,
+		indexTxBlocks:            cfg.IndexTxBlocks,
+		chainNamespace:           chainNamespace,
+		trackBlocks:              cfg.ReorgWatchInterval > 0,
+		strictContentType:        cfg.StrictContentType,
+		strictJSONRPC:            cfg.StrictJSONRPC,
+		allowGetRequests:         cfg.AllowGetRequests,
+		cacheBlockTraces:         cfg.CacheBlockTraces,
+		cacheParityTraces:        cfg.CacheParityTraces,
+		importMaxBytes:           importMaxBytes,
+		methods:                  methodFilter{allowed: cfg.AllowedMethods, denied: cfg.DeniedMethods},
+		aliases:                  aliases,
+		verifyCacheKey:           cfg.VerifyCacheKey,
+		canonicalProofKeys:       cfg.CanonicalizeProofKeys,
+		minifyResponses:          cfg.MinifyResponses,
+		cachedHeaders:            newCachedHeaders(cfg.CachedResponseHeaders),
+		storeParams:              cfg.VerifyCacheKey || cfg.ConsistencyCheckInterval > 0,
+		staleWhileRevalidate:     cfg.StaleWhileRevalidate,
+		staleOnError:             cfg.ServeStaleOnError,
+		requestTimeout:           cfg.RequestTimeout,
+		freshnessWindow:          freshnessWindow,
+		stalenessWindow:          cfg.StalenessWindow,
+		maxCacheableBytes:        maxCacheableBytes,
+		writeSampleRates:         writeSampleRates,
+		resultPredicates:         newResultPredicates(cfg.CacheResultRequires),
+		absentBlocks:             absentBlocks,
+		defaultMaxCacheableBytes: defaultMaxCacheableBytes,
+		negativeCaching:          cfg.NegativeCaching,
+		keys:                     keys,
+		maxParamsBytes:           maxParamsBytes,
+		maxStoredParamsBytes:     maxStoredParamsBytes,
+		maxParamsDepth:           cfg.MaxParamsDepth,
+		fallback:                 newFallbackCache(cfg.FallbackCacheSize, cfg.FallbackCacheTTL, fallbackCacheBytes),
+		recent:                   newFallbackCache(cfg.DedupeCacheSize, dedupeWindow, 0),
+		breaker:                  newLatencyBreaker(cfg.DBLatencyThreshold, cfg.DBLatencyCooldown),
+		sizeFilter:               newSizeFilter(cfg.AdaptiveSizeFilter),
+		recorder:                 recorder,
+	}
+	h.head = newHeadTracker(cfg.CacheFinalizedOnly, cfg.ReorgConfirmationDepth, func(ctx context.Context, upstream config.Upstream) (uint64, error) {
+		head, err := h.fetchHead(ctx, upstream)
+		if err != nil {
+			logger.Warn("failed to fetch head block number", zap.String("upstream", upstream.ID), zap.Error(err))
+		}
+		return head, err
+	})
+	h.blockTags = newBlockTagResolver(cfg.ResolveBlockTags, func(ctx context.Context, upstream config.Upstream, tag string) (uint64, error) {
+		n, err := h.fetchTaggedBlock(ctx, upstream, tag)
+		if err != nil {
+			logger.Warn("failed to resolve block tag", zap.String("tag", tag), zap.String("upstream", upstream.ID), zap.Error(err))
+		}
+		return n, err
+	})
+	return h, nil
+}
+
+// Close releases the resources of the handler, writing out the pending
+// recorded exchanges.
+func (h *Handler) Close() error {
+	return h.recorder.Close()
 }
 
 type JSONRPCRequest struct {
@@ -45,6 +296,9 @@ type JSONRPCRequest struct {
 	Method  string          `json:"method"`
 	Params  json.RawMessage `json:"params"`
 	ID      json.RawMessage `json:"id"`
+	// CacheControl is a non-standard member hinting the cache behavior of
+	// the call, honored when allow_rpc_cache_control is enabled
+	CacheControl string `json:"cacheControl,omitempty"`
 }
 
 type JSONRPCResponse struct {
@@ -55,106 +309,655 @@ type JSONRPCResponse struct {
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		h.logger.Warn("method not allowed", zap.String("method", r.Method))
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
+	metrics.InflightRequests.Inc()
+	defer metrics.InflightRequests.Dec()
+
+	if h.requestTimeout > 0 {
+		// Bound the database and upstream calls even when the client sets
+		// no deadline
+		ctx, cancel := context.WithTimeout(r.Context(), h.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
 	}
+	logger := h.requestLogger(r.Context())
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		h.logger.Error("failed to read body", zap.Error(err))
-		http.Error(w, "failed to read body", http.StatusInternalServerError)
+	var body []byte
+	switch {
+	case r.Method == http.MethodGet && h.allowGetRequests:
+		var err error
+		body, err = getRequestBody(r)
+		if errors.Is(err, errMethodNotAllowedOverGet) {
+			logger.Warn("method not allowed over GET", zap.String("rpc_method", r.URL.Query().Get("method")))
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			logger.Warn("invalid GET request", zap.Error(err))
+			writeError(w, nil, parseErrorCode, "invalid query parameters")
+			return
+		}
+	case r.Method == http.MethodPost:
+		if h.strictContentType && !isJSONContentType(r.Header.Get("Content-Type")) {
+			logger.Warn("unsupported content type", zap.String("content_type", r.Header.Get("Content-Type")))
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error("failed to read body", zap.Error(err))
+			writeError(w, nil, internalErrorCode, "failed to read body")
+			return
+		}
+	default:
+		logger.Warn("method not allowed", zap.String("method", r.Method))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var req JSONRPCRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		h.logger.Warn("invalid json", zap.Error(err))
-		http.Error(w, "invalid json", http.StatusBadRequest)
+		logger.Warn("invalid json", zap.Error(err))
+		writeError(w, nil, parseErrorCode, "invalid json")
+		return
+	}
+
+	if h.strictJSONRPC && req.JSONRPC != "2.0" {
+		logger.Debug("invalid jsonrpc version", zap.String("jsonrpc", req.JSONRPC))
+		writeError(w, req.ID, invalidRequestCode, "invalid jsonrpc version, expected 2.0")
+		return
+	}
+
+	if !h.methods.allows(req.Method) {
+		logger.Debug("method not allowed", zap.String("rpc_method", req.Method))
+		writeError(w, req.ID, methodNotFoundCode, "the method "+req.Method+" does not exist/is not available")
 		return
 	}
 
-	// Check if cacheable
-	if isCacheable(req.Method, req.Params) {
-		key, err := generateCacheKey(req.Method, req.Params)
+	if canonical := h.aliases.resolve(req.Method); canonical != req.Method {
+		logger.Debug("method aliased", zap.String("rpc_method", req.Method), zap.String("canonical", canonical))
+		req.Method = canonical
+		if h.aliases.rewrite {
+			rewritten, err := rewriteMethod(body, canonical)
+			if err != nil {
+				logger.Error("failed to rewrite aliased method", zap.Error(err))
+				writeError(w, req.ID, internalErrorCode, "failed to rewrite aliased method")
+				return
+			}
+			body = rewritten
+		}
+	}
+
+	// outcome is the result the request is counted with, an error until it
+	// is answered
+	outcome := "error"
+	defer func() {
+		metrics.Requests.WithLabelValues(req.Method, outcome).Inc()
+	}()
+
+	// Picked first, the block tags are resolved on the upstream the request
+	// is forwarded to
+	upstream := h.pickUpstream()
+
+	// Calls on the safe and finalized blocks share the entries of the calls
+	// on their number
+	req, body = h.resolveBlockTag(r.Context(), upstream, req, body)
+
+	cacheable := h.isCacheable(req.Method, req.Params)
+	bypass := h.allowCacheBypassHeader && r.Header.Get(CacheBypassHeader) == "true"
+	refresh := bypass && r.Header.Get(CacheRefreshHeader) == "true"
+	if h.allowRPCCacheControl && req.CacheControl != "" {
+		switch req.CacheControl {
+		case cacheControlNoStore:
+			bypass, refresh = true, false
+		case cacheControlNoCache:
+			bypass, refresh = true, true
+		default:
+			logger.Debug("unknown cache control ignored", zap.String("cache_control", req.CacheControl))
+		}
+		stripped, err := stripCacheControl(body)
+		if err != nil {
+			logger.Error("failed to strip cache control", zap.Error(err))
+			writeError(w, req.ID, internalErrorCode, "failed to strip cache control")
+			return
+		}
+		body = stripped
+	}
+	// Notifications have no id to rewrite and get no response to restore
+	rewriteIDs := h.rewriteUpstreamIDs && !isNotification(req)
+	if rewriteIDs {
+		upstreamID := h.upstreamIDs.Add(1)
+		rewritten, err := rewriteID(body, upstreamID)
+		if err != nil {
+			logger.Error("failed to rewrite request id", zap.String("id", formatID(req.ID)), zap.Error(err))
+			writeError(w, req.ID, internalErrorCode, "failed to rewrite request id")
+			return
+		}
+		body = rewritten
+		logger.Debug("request id rewritten", zap.String("id", formatID(req.ID)), zap.Uint64("upstream_id", upstreamID))
+	}
+
+	if upstream.ID != "" {
+		w.Header().Set(UpstreamHeader, upstream.ID)
+	}
+	if cacheable && !h.isFinalCall(r.Context(), upstream, req) {
+		// The block may still be reorged
+		cacheable = false
+	}
+
+	cacheStatus := "BYPASS"
+	// expired holds an entry too old to be served, kept as a last resort
+	// when the upstream fails
+	var expired []byte
+
+	// Check if cacheable. A cacheable request skipping the cache because of
+	// the database latency is not stored either.
+	useCache := cacheable && h.breaker.allow()
+	if useCache && !bypass {
+		key, err := h.cacheKey(upstream, req.Method, req.Params)
 		if err == nil {
-			cached, err := h.db.GetCachedRPCResult(r.Context(), key)
+			if h.exposeCacheKeyHeader {
+				w.Header().Set(CacheKeyHeader, key[:min(len(key), cacheKeyHeaderPrefixLen)])
+			}
+			var cached, storedParams, recentHeaders []byte
+			var age time.Duration
+			fromFallback, fromRecent := false, false
+			if result, headers, ok := h.recent.get(key); ok {
+				// Retried right after being served
+				cached, recentHeaders = result, headers
+				fromRecent = true
+			} else {
+				start := time.Now()
+				cached, storedParams, age, err = h.db.GetCachedRPCResultWithParams(r.Context(), key)
+				h.breaker.observe(time.Since(start))
+				observeDBError(err)
+				if err != nil {
+					logger.Error("failed to get cached result", zap.Error(err))
+					// The database is unavailable, serve what could not be
+					// written to it instead
+					if result, _, ok := h.fallback.get(key); ok {
+						cached, storedParams, age, err = result, nil, 0, nil
+						fromFallback = true
+					}
+				}
+			}
+			// stored is the entry as stored, before being adapted to the
+			// request
+			stored := cached
+			if err == nil && cached != nil && !h.verifyKey(req, storedParams) {
+				cached = nil
+			}
+			if err == nil && cached != nil && h.canonicalizesProofKeys(req.Method) {
+				// The entry is stored in the canonical key order, serve it
+				// in the requested one
+				keys, ok := proofStorageKeys(req.Params)
+				if ok {
+					cached, ok = reorderStorageProof(cached, keys)
+				}
+				if !ok {
+					cached = nil
+				}
+			}
+			if err == nil && cached != nil && h.isExpired(age) {
+				// Too old to be served, even stale
+				expired = cached
+				cached = nil
+			}
 			if err == nil && cached != nil {
 				// Cache hit
 				metrics.CacheHits.WithLabelValues(req.Method).Inc()
-				resp := JSONRPCResponse{
-					JSONRPC: "2.0",
-					Result:  cached,
-					ID:      req.ID,
+				headers := recentHeaders
+				if len(h.cachedHeaders) > 0 && !fromFallback && !fromRecent {
+					var err error
+					if headers, err = h.db.GetCachedHeaders(r.Context(), key); err != nil {
+						// The result is served anyway, without the headers
+						logger.Warn("failed to get cached headers", zap.Error(err))
+					}
+				}
+				if h.isStale(age) {
+					w.Header().Set(CacheStatusHeader, "STALE")
+					h.revalidate(upstream, req, key, body)
+				} else {
+					w.Header().Set(CacheStatusHeader, "HIT")
+					// Only fresh entries read from the database are
+					// deduped, re-adding the deduped ones would keep them
+					// past the window
+					if !fromFallback && !fromRecent {
+						h.recent.add(key, stored, headers)
+					}
 				}
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(resp)
+				h.cachedHeaders.replay(w, headers)
+				writeCachedResult(w, req, cached)
+				outcome = "hit"
 				return
 			}
-			if err != nil {
-				h.logger.Error("failed to get cached result", zap.Error(err))
-			}
 			metrics.CacheMisses.WithLabelValues(req.Method).Inc()
+			cacheStatus = "MISS"
 		} else {
-			h.logger.Error("failed to generate cache key", zap.Error(err))
+			h.observeKeyError(req.Method, err)
+			// Storing the response would fail the same way
+			useCache = false
 		}
 	}
+	w.Header().Set(CacheStatusHeader, cacheStatus)
 
 	// Forward to upstream
-	if h.limiter != nil {
-		if err := h.limiter.Wait(r.Context()); err != nil {
-			h.logger.Warn("upstream rate limit exceeded", zap.Error(err))
-			http.Error(w, "upstream rate limit exceeded", http.StatusTooManyRequests)
+	if err := h.waitForLimiter(r.Context(), req.Method); err != nil {
+		logger.Warn("upstream rate limit exceeded", zap.Error(err))
+		http.Error(w, "upstream rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	upstreamReq, err := h.newUpstreamRequest(r.Context(), upstream, body)
+	if err != nil {
+		logger.Error("failed to create upstream request", zap.Error(err))
+		writeError(w, req.ID, internalErrorCode, "failed to create upstream request")
+		return
+	}
+
+	upstreamResp, err := h.doUpstream(upstreamReq)
+	if err != nil {
+		logger.Error("upstream error", zap.String("method", req.Method), zap.String("id", formatID(req.ID)), zap.Error(err))
+		metrics.UpstreamErrors.WithLabelValues(req.Method, "request").Inc()
+		if h.serveStaleOnError(w, req, expired) {
+			outcome = "hit"
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			writeError(w, req.ID, internalErrorCode, "request timed out")
 			return
 		}
+		writeError(w, req.ID, internalErrorCode, "upstream error")
+		return
 	}
+	defer upstreamResp.Body.Close()
 
-	upstreamReq, err := http.NewRequestWithContext(r.Context(), "POST", h.upstreamURL, bytes.NewReader(body))
+	respBody, err := readUpstreamBody(upstreamResp)
 	if err != nil {
-		h.logger.Error("failed to create upstream request", zap.Error(err))
-		http.Error(w, "failed to create upstream request", http.StatusInternalServerError)
+		logger.Error("failed to read upstream response", zap.Error(err))
+		metrics.UpstreamErrors.WithLabelValues(req.Method, "read").Inc()
+		if h.serveStaleOnError(w, req, expired) {
+			outcome = "hit"
+			return
+		}
+		writeError(w, req.ID, internalErrorCode, "failed to read upstream response")
+		return
+	}
+	// Nodes may answer notifications with an empty body
+	if !json.Valid(respBody) && !(isNotification(req) && len(respBody) == 0) {
+		// Typically an HTML error page from a gateway in front of the node,
+		// never forward it to the client
+		logger.Error("invalid upstream response",
+			zap.Int("status", upstreamResp.StatusCode),
+			zap.String("content_type", upstreamResp.Header.Get("Content-Type")))
+		metrics.UpstreamErrors.WithLabelValues(req.Method, "invalid_response").Inc()
+		if h.serveStaleOnError(w, req, expired) {
+			outcome = "hit"
+			return
+		}
+		writeError(w, req.ID, internalErrorCode, "invalid upstream response")
+		return
+	}
+	if rewriteIDs && len(respBody) > 0 {
+		restored, err := restoreID(respBody, req.ID)
+		if err != nil {
+			// Valid JSON but not an object
+			logger.Error("failed to restore request id", zap.String("id", formatID(req.ID)), zap.Error(err))
+			writeError(w, req.ID, internalErrorCode, "invalid upstream response")
+			return
+		}
+		respBody = restored
+	}
+	respBody = h.minify(respBody)
+	if upstreamResp.StatusCode >= http.StatusInternalServerError && h.serveStaleOnError(w, req, expired) {
+		outcome = "hit"
+		return
+	}
+	h.recorder.Record(req.Method, req.Params, respBody)
+
+	// If cacheable, store result. A bypassed request only overwrites the
+	// stored entry when a refresh was explicitly asked for. An expired entry
+	// is refreshed, a plain write would keep its age and it would never be
+	// served again.
+	if useCache && (!bypass || refresh) {
+		h.storeResult(r.Context(), upstream, req, respBody, h.cachedHeaders.capture(upstreamResp.Header), refresh || expired != nil)
+	}
+
+	h.cachedHeaders.forward(w, upstreamResp.Header)
+
+	writeResponse(w, req.Method, respBody)
+	outcome = strings.ToLower(cacheStatus)
+}
+
+// minify removes the insignificant whitespace of a response body when
+// enabled. Numbers and strings are kept byte for byte. Invalid bodies are
+// returned as is.
+func (h *Handler) minify(body []byte) []byte {
+	if !h.minifyResponses || len(body) == 0 {
+		return body
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, body); err != nil {
+		return body
+	}
+	return buf.Bytes()
+}
+
+// writeCachedResult responds to req with a cached result.
+func writeCachedResult(w http.ResponseWriter, req JSONRPCRequest, result []byte) {
+	if isNotification(req) {
+		// Notifications must not receive a response
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	// req.ID holds the raw id so that null, string and number ids are echoed
+	// exactly as received
+	resp := JSONRPCResponse{
+		JSONRPC: "2.0",
+		Result:  result,
+		ID:      req.ID,
+	}
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(resp)
+	writeResponse(w, req.Method, buf.Bytes())
+}
+
+// serveStaleOnError responds with an expired entry, if any and if enabled,
+// when the upstream failed. It returns false when nothing was written.
+func (h *Handler) serveStaleOnError(w http.ResponseWriter, req JSONRPCRequest, expired []byte) bool {
+	if !h.staleOnError || expired == nil {
+		return false
+	}
+	metrics.StaleOnError.WithLabelValues(req.Method).Inc()
+	h.logger.Warn("upstream failed, serving an expired entry", zap.String("method", req.Method))
+	w.Header().Set(CacheStatusHeader, "STALE")
+	writeCachedResult(w, req, expired)
+	return true
+}
+
+// writeResponse writes a JSON-RPC response body to a call of method,
+// accounting for the bytes served.
+func writeResponse(w http.ResponseWriter, method string, body []byte) {
+	w.Header().Set("Content-Type", jsonContentType)
+	n, _ := w.Write(body)
+	metrics.ServedBytes.Add(float64(n))
+	metrics.ResponseBytes.WithLabelValues(method).Observe(float64(n))
+}
+
+func (h *Handler) newUpstreamRequest(ctx context.Context, upstream config.Upstream, body []byte) (*http.Request, error) {
+	upstreamReq, err := http.NewRequestWithContext(ctx, "POST", upstream.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, redact.Error(err)
+	}
+	// The upstream headers may hold credentials, they must never be logged
+	for k, v := range h.upstreamHeaders {
+		upstreamReq.Header[k] = v
+	}
 	upstreamReq.Header.Set("Content-Type", "application/json")
+	if id := RequestID(ctx); id != "" {
+		upstreamReq.Header.Set(RequestIDHeader, id)
+	}
+	// Ask for gzip explicitly so that decompression does not depend on the
+	// transport, see readUpstreamBody.
+	upstreamReq.Header.Set("Accept-Encoding", "gzip")
+	return upstreamReq, nil
+}
 
+// sampleWrite returns false for the misses of a method with a write sample
+// rate which are not to be persisted.
+func (h *Handler) sampleWrite(method string) bool {
+	sampleRate, ok := h.writeSampleRates[strings.ToLower(method)]
+	return !ok || rand.Float64() < sampleRate
+}
+
+// doUpstream sends an upstream request. The URL, which often embeds an API
+// key, is redacted from the errors so that they can be logged.
+func (h *Handler) doUpstream(upstreamReq *http.Request) (*http.Response, error) {
 	upstreamResp, err := h.httpClient.Do(upstreamReq)
 	if err != nil {
-		h.logger.Error("upstream error", zap.Error(err))
-		http.Error(w, "upstream error", http.StatusBadGateway)
+		return nil, redact.Error(err)
+	}
+	return upstreamResp, nil
+}
+
+// waitForLimiter blocks until the upstream rate limits, of method and global,
+// allow a request. The requests it rejects, because ctx ends before the
+// limits allow them, are counted.
+func (h *Handler) waitForLimiter(ctx context.Context, method string) error {
+	if limiter, ok := h.methodLimiters[strings.ToLower(method)]; ok {
+		if err := limiter.Wait(ctx); err != nil {
+			metrics.RateLimited.WithLabelValues("method").Inc()
+			return err
+		}
+	}
+	if h.limiter == nil {
+		return nil
+	}
+	if err := h.limiter.Wait(ctx); err != nil {
+		metrics.RateLimited.WithLabelValues("global").Inc()
+		return err
+	}
+	return nil
+}
+
+// storeResult caches the result of a successful upstream response, along with
+// the captured upstream headers when enabled. A refresh
+// resets the age of an existing entry, a plain write preserves it.
+func (h *Handler) storeResult(ctx context.Context, upstream config.Upstream, req JSONRPCRequest, respBody []byte, headers []byte, refresh bool) {
+	logger := h.requestLogger(ctx)
+	// Refreshes overwrite entries that are already known to be worth it
+	if !refresh && !h.sampleWrite(req.Method) {
 		return
 	}
-	defer upstreamResp.Body.Close()
 
-	respBody, err := io.ReadAll(upstreamResp.Body)
+	var resp JSONRPCResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil || resp.Error != nil {
+		return
+	}
+
+	switch strings.TrimSpace(string(resp.Result)) {
+	case "", `""`:
+		// A response without error must carry a result, never cache an
+		// empty value
+		metrics.EmptyResults.WithLabelValues(req.Method).Inc()
+		logger.Warn("upstream response has no result", zap.String("method", req.Method))
+		return
+	case "null":
+		if !h.negativeCaching {
+			return
+		}
+	}
+
+	if limit := h.maxCacheableSize(req.Method); limit > 0 && int64(len(resp.Result)) > limit {
+		logger.Debug("response too large to be cached",
+			zap.String("method", req.Method),
+			zap.Int("size", len(resp.Result)),
+			zap.Int64("limit", limit))
+		return
+	}
+
+	if !h.sizeFilter.allow(req.Method, len(resp.Result)) {
+		logger.Debug("response anomalously large for its method, not caching it",
+			zap.String("method", req.Method),
+			zap.Int("size", len(resp.Result)))
+		return
+	}
+
+	// Null results are left to negative caching
+	if strings.TrimSpace(string(resp.Result)) != "null" && !h.resultPredicates.satisfied(req.Method, resp.Result) {
+		logger.Debug("result incomplete, not caching it", zap.String("method", req.Method))
+		return
+	}
+
+	if !h.isFinalResult(ctx, upstream, req, resp.Result) {
+		logger.Debug("transaction not final yet, not caching it", zap.String("method", req.Method))
+		return
+	}
+
+	key, err := h.cacheKey(upstream, req.Method, req.Params)
 	if err != nil {
-		h.logger.Error("failed to read upstream response", zap.Error(err))
-		http.Error(w, "failed to read upstream response", http.StatusInternalServerError)
+		h.observeKeyError(req.Method, err)
 		return
 	}
 
-	// If cacheable, store result
-	if isCacheable(req.Method, req.Params) {
-		var resp JSONRPCResponse
-		if err := json.Unmarshal(respBody, &resp); err == nil && resp.Error == nil {
-			key, err := generateCacheKey(req.Method, req.Params)
-			if err == nil {
-				// We ignore error here as we want to return the response anyway
-				if err := h.db.SetCachedRPCResult(r.Context(), key, req.Method, resp.Result); err == nil {
-					if h.cleanupManager != nil {
-						h.cleanupManager.NotifyWrite()
-					}
-				} else {
-					h.logger.Error("failed to set cached result", zap.Error(err))
-				}
-			} else {
-				h.logger.Error("failed to generate cache key for storage", zap.Error(err))
-			}
+	result := resp.Result
+	if h.canonicalizesProofKeys(req.Method) {
+		// The entry is shared by all the orders of the keys, store it in
+		// the canonical one
+		keys, ok := proofStorageKeys(h.keyParams(req.Method, req.Params))
+		if ok {
+			result, ok = reorderStorageProof(result, keys)
+		}
+		if !ok {
+			logger.Debug("unexpected eth_getProof result, not caching it")
+			return
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(respBody)
+	store := h.db.SetCachedRPCResult
+	if refresh {
+		store = h.db.RefreshCachedRPCResult
+	}
+	var params []byte
+	if h.storeParams {
+		// Cannot fail, the key was derived from the same params
+		params, _ = h.keys.NormalizeParams(h.keyParams(req.Method, req.Params))
+		params = storedParams(params, h.maxStoredParamsBytes)
+	}
+	// The response is returned anyway, a failed write only costs a future
+	// cache hit
+	start := time.Now()
+	err = store(ctx, key, req.Method, result, params, database.SourceClient)
+	h.breaker.observe(time.Since(start))
+	observeDBError(err)
+	if err != nil {
+		metrics.CacheWriteErrors.WithLabelValues(req.Method).Inc()
+		logger.Warn("failed to set cached result", zap.String("method", req.Method), zap.Error(err))
+		h.fallback.add(key, result, nil)
+		// The result just served may be the one a refresh meant to replace
+		h.recent.forget(key)
+		return
+	}
+	h.recent.add(key, result, headers)
+	if len(h.cachedHeaders) > 0 {
+		// Always written so that a refresh drops the headers that are not
+		// sent anymore
+		if err := h.db.SetCachedHeaders(ctx, key, headers); err != nil {
+			logger.Warn("failed to set cached headers", zap.String("method", req.Method), zap.Error(err))
+		}
+	}
+	if h.cleanupManager != nil {
+		h.cleanupManager.NotifyWrite()
+	}
+	if h.indexTxBlocks && isTxLookup(req.Method) {
+		h.indexTxBlock(ctx, req, resp.Result)
+	}
+	if h.trackBlocks {
+		h.trackBlock(ctx, key, resp.Result)
+	}
+}
+
+// maxCacheableSize returns the size above which results of method are not
+// cached, falling back to the default limit. Zero means unlimited.
+func (h *Handler) maxCacheableSize(method string) int64 {
+	if limit, ok := h.maxCacheableBytes[strings.ToLower(method)]; ok {
+		return limit
+	}
+	return h.defaultMaxCacheableBytes
+}
+
+// readUpstreamBody reads the upstream response body, decompressing it when
+// the upstream gzipped it, so that only decoded JSON is cached and returned.
+func readUpstreamBody(resp *http.Response) ([]byte, error) {
+	body := resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	return io.ReadAll(body)
+}
+
+// isJSONContentType accepts application/json with an optional utf-8 charset.
+func isJSONContentType(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" {
+		return false
+	}
+	charset, ok := params["charset"]
+	return !ok || strings.EqualFold(charset, "utf-8")
+}
+
+// isNotification returns true for requests without an id member. A null id
+// is not a notification and must be echoed as null.
+func isNotification(req JSONRPCRequest) bool {
+	return len(req.ID) == 0
+}
+
+// isCacheable extends isCacheable with the methods whose caching is opt-in.
+func (h *Handler) isCacheable(method string, params json.RawMessage) bool {
+	if !h.withinParamsLimits(method, params) {
+		return false
+	}
+	enabled, overridden := h.overrides.get(method)
+	if overridden && !enabled {
+		return false
+	}
+	params = h.withAbsentBlock(method, params)
+	if method == "debug_traceBlockByNumber" {
+		// params: [blockNumber, tracerConfig]. The tracer config is
+		// normalized by the key generator like any other param.
+		return (h.cacheBlockTraces || overridden) && isHexBlockNumber(params, 0)
+	}
+	switch method {
+	case "trace_transaction":
+		// params: [txHash]
+		return h.cacheParityTraces || overridden
+	case "trace_block":
+		// params: [blockNumber]
+		return (h.cacheParityTraces || overridden) && isHexBlockNumber(params, 0)
+	}
+	if enabled {
+		// An enabled method is cached at the blocks given by number
+		if index, ok := blockParamIndex(method); ok && isHexBlockNumber(params, index) {
+			return true
+		}
+	}
+	return isCacheable(method, params)
+}
+
+// withAbsentBlock returns params with the block the node defaults to for
+// method in place of its absent block param, when configured. Without it, an
+// absent block param stands for latest and is not cached.
+func (h *Handler) withAbsentBlock(method string, params json.RawMessage) json.RawMessage {
+	block, ok := h.absentBlocks[strings.ToLower(method)]
+	if !ok {
+		return params
+	}
+	index, ok := blockParamIndex(method)
+	if !ok {
+		return params
+	}
+	var args []json.RawMessage
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &args); err != nil {
+			return params
+		}
+	}
+	if len(args) != index {
+		// Present, or other params are missing as well
+		return params
+	}
+	blockParam, _ := json.Marshal(block)
+	withBlock, err := json.Marshal(append(args, blockParam))
+	if err != nil {
+		return params
+	}
+	return withBlock
 }
 
 func isCacheable(method string, params json.RawMessage) bool {
@@ -167,11 +970,76 @@ func isCacheable(method string, params json.RawMessage) bool {
 	case "eth_getProof":
 		// params: [address, storageKeys, blockNumber]
 		return isBlockNumberSpecific(params, 2)
+	case "eth_getBlockReceipts":
+		// params: [blockNumber]. The receipts of a block are large,
+		// consider a max_cacheable_bytes limit.
+		return isHexBlockNumber(params, 0)
+	case "eth_feeHistory":
+		// params: [blockCount, newestBlock, rewardPercentiles]. The range
+		// ends at newestBlock, which must not be a tag.
+		return isHexBlockNumber(params, 1)
+	case "eth_getUncleByBlockHashAndIndex":
+		// params: [blockHash, uncleIndex]. The uncles of a block never
+		// change.
+		return true
+	case "eth_getUncleByBlockNumberAndIndex":
+		// params: [blockNumber, uncleIndex]
+		return isHexBlockNumber(params, 0)
+	case "eth_getTransactionByBlockHashAndIndex":
+		// params: [blockHash, transactionIndex]. The transactions of a
+		// block never change.
+		return true
+	case "eth_getTransactionByBlockNumberAndIndex":
+		// params: [blockNumber, transactionIndex]
+		return isHexBlockNumber(params, 0)
 	default:
 		return false
 	}
 }
 
+// withinParamsLimits returns false, counting it, when params are too large or
+// too deeply nested to be worth normalizing and hashing into a cache key.
+func (h *Handler) withinParamsLimits(method string, params json.RawMessage) bool {
+	if h.maxParamsBytes > 0 && int64(len(params)) > h.maxParamsBytes {
+		metrics.ParamsLimitExceeded.WithLabelValues(method, "bytes").Inc()
+		return false
+	}
+	if h.maxParamsDepth > 0 && paramsDepth(params) > h.maxParamsDepth {
+		metrics.ParamsLimitExceeded.WithLabelValues(method, "depth").Inc()
+		return false
+	}
+	return true
+}
+
+// paramsDepth returns the maximum nesting of arrays and objects in params,
+// the params array itself being at depth 1. It scans the raw bytes instead of
+// decoding them.
+func paramsDepth(params json.RawMessage) int {
+	var depth, maxDepth int
+	inString, escaped := false, false
+	for _, c := range params {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '[' || c == '{':
+			depth++
+			maxDepth = max(maxDepth, depth)
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return maxDepth
+}
+
 func isBlockNumberSpecific(params json.RawMessage, index int) bool {
 	var args []interface{}
 	if err := json.Unmarshal(params, &args); err != nil {
@@ -184,25 +1052,177 @@ func isBlockNumberSpecific(params json.RawMessage, index int) bool {
 	if !ok {
 		return false // Should be string
 	}
-	return blockParam != "latest" && blockParam != "pending" && blockParam != "earliest"
+	// finalized and safe move with the chain, they are only cached once
+	// resolved to a number
+	switch blockParam {
+	case "latest", "pending", "earliest", "finalized", "safe":
+		return false
+	}
+	return true
+}
+
+// verifyKey guards against cache key collisions when enabled: the params the
+// cached entry was stored for must match the params of req. Entries stored
+// without params, before the verification was enabled, cannot be verified and
+// are trusted.
+func (h *Handler) verifyKey(req JSONRPCRequest, storedParams []byte) bool {
+	if !h.verifyCacheKey || storedParams == nil {
+		return true
+	}
+	params, err := h.keys.NormalizeParams(h.keyParams(req.Method, req.Params))
+	if err == nil && matchesStoredParams(params, storedParams) {
+		return true
+	}
+	metrics.CacheCollisions.Inc()
+	h.logger.Warn("cache key collision, treating as a miss",
+		zap.String("method", req.Method),
+		zap.ByteString("params", params),
+		zap.ByteString("stored_params", storedParams))
+	return false
 }
 
-func generateCacheKey(method string, params json.RawMessage) (string, error) {
+// isHexBlockNumber returns true when the param at index is a hex block
+// number, as opposed to a block tag.
+func isHexBlockNumber(params json.RawMessage, index int) bool {
 	var args []interface{}
-	if len(params) > 0 {
-		if err := json.Unmarshal(params, &args); err != nil {
-			return "", err
-		}
+	if err := json.Unmarshal(params, &args); err != nil {
+		return false
 	}
+	if len(args) <= index {
+		return false
+	}
+	blockParam, ok := args[index].(string)
+	if !ok || !strings.HasPrefix(blockParam, "0x") {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimPrefix(blockParam, "0x"), 16, 64)
+	return err == nil
+}
+
+// cacheKey generates the cache key of a call with the configured hasher, in
+// the cache partition of upstream.
+func (h *Handler) cacheKey(upstream config.Upstream, method string, params json.RawMessage) (string, error) {
+	return h.keys.CacheKey(h.cacheNamespace(upstream), method, h.keyParams(method, params))
+}
+
+// observeKeyError counts a call which could not be cached because no key
+// could be derived from its params, typically params which are not an array.
+func (h *Handler) observeKeyError(method string, err error) {
+	metrics.KeyErrors.WithLabelValues(method).Inc()
+	h.logger.Debug("failed to generate cache key", zap.String("method", method), zap.Error(err))
+}
+
+// keyParams returns the params the cache key of a call is derived from.
+func (h *Handler) keyParams(method string, params json.RawMessage) json.RawMessage {
+	// A call without its block param shares the entry of the call on the
+	// block it defaults to
+	params = h.withAbsentBlock(method, params)
+	if h.canonicalizesProofKeys(method) {
+		return canonicalProofParams(params)
+	}
+	switch method {
+	case "eth_getBlockReceipts", "trace_block":
+		return normalizeQuantityParam(params, 0)
+	case "eth_feeHistory", "eth_getUncleByBlockNumberAndIndex", "eth_getTransactionByBlockNumberAndIndex":
+		return normalizeQuantityParam(normalizeQuantityParam(params, 0), 1)
+	case "eth_getUncleByBlockHashAndIndex", "eth_getTransactionByBlockHashAndIndex":
+		return normalizeQuantityParam(params, 1)
+	case "debug_traceTransaction":
+		return normalizeTraceConfigParam(params, 1)
+	case "debug_traceBlockByNumber":
+		return normalizeTraceConfigParam(normalizeQuantityParam(params, 0), 1)
+	}
+	return params
+}
+
+// normalizeQuantityParam rewrites the hex quantity at index without leading
+// zeros and in lower case, so that the different encodings of a block number
+// map to the same cache key. params are returned as is when the param is not
+// a hex quantity.
+func normalizeQuantityParam(params json.RawMessage, index int) json.RawMessage {
+	var args []json.RawMessage
+	if err := json.Unmarshal(params, &args); err != nil || len(args) <= index {
+		return params
+	}
+	var quantity string
+	if err := json.Unmarshal(args[index], &quantity); err != nil || !strings.HasPrefix(quantity, "0x") {
+		return params
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(quantity, "0x"), 16, 64)
+	if err != nil {
+		return params
+	}
+	args[index], _ = json.Marshal(fmt.Sprintf("0x%x", n))
+	normalized, err := json.Marshal(args)
+	if err != nil {
+		return params
+	}
+	return normalized
+}
 
-	normalized := normalizeForCache(args)
-	argsBytes, err := json.Marshal(normalized)
+// normalizeTraceConfigParam removes from the tracer config at index the
+// members which do not change a successful trace: the timeout, which only
+// turns slow traces into errors that are never cached, and an empty or null
+// tracerConfig. A config left empty is the default one and is dropped when
+// last. The order of the members is normalized by normalizeParams. params
+// are returned as is when there is no tracer config object.
+func normalizeTraceConfigParam(params json.RawMessage, index int) json.RawMessage {
+	var args []json.RawMessage
+	if err := json.Unmarshal(params, &args); err != nil || len(args) <= index {
+		return params
+	}
+	var traceConfig map[string]json.RawMessage
+	if err := json.Unmarshal(args[index], &traceConfig); err != nil || traceConfig == nil {
+		return params
+	}
+	delete(traceConfig, "timeout")
+	switch strings.TrimSpace(string(traceConfig["tracerConfig"])) {
+	case "{}", "null":
+		delete(traceConfig, "tracerConfig")
+	}
+	if len(traceConfig) == 0 && index == len(args)-1 {
+		args = args[:index]
+	} else {
+		args[index], _ = json.Marshal(traceConfig)
+	}
+	normalized, err := json.Marshal(args)
+	if err != nil {
+		return params
+	}
+	return normalized
+}
+
+func (h *Handler) canonicalizesProofKeys(method string) bool {
+	return h.canonicalProofKeys && method == "eth_getProof"
+}
+
+// generateCacheKey hashes the method and its normalized params. A non-empty
+// namespace is prepended so that identical calls on different chains map to
+// distinct entries.
+func generateCacheKey(hash hasher, namespace string, method string, params json.RawMessage) (string, error) {
+	argsBytes, err := normalizeParams(params)
 	if err != nil {
 		return "", err
 	}
 
-	hash := sha256.Sum256(append([]byte(method), argsBytes...))
-	return hex.EncodeToString(hash[:]), nil
+	input := method
+	if namespace != "" {
+		input = namespace + ":" + method
+	}
+	return hex.EncodeToString(hash(append([]byte(input), argsBytes...))), nil
+}
+
+// normalizeParams returns the canonical encoding of params cache keys are
+// derived from, independent of whitespace and object key ordering. Empty,
+// null and absent params all encode as an empty array.
+func normalizeParams(params json.RawMessage) ([]byte, error) {
+	var args []interface{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(normalizeForCache(args))
 }
 
 func normalizeForCache(v any) any {
@@ -0,0 +1,2157 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestErrorResponses(t *testing.T) {
+	// Neither case reaches the database nor the upstream
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: "http://localhost:0"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		code    int
+	}{
+		{"malformed json", httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"jsonrpc":`)), parseErrorCode},
+		{"read failure", httptest.NewRequest(http.MethodPost, "/", failingReader{}), internalErrorCode},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, test.request)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, jsonContentType, rec.Header().Get("Content-Type"))
+
+			var resp struct {
+				JSONRPC string          `json:"jsonrpc"`
+				Error   JSONRPCError    `json:"error"`
+				ID      json.RawMessage `json:"id"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, "2.0", resp.JSONRPC)
+			assert.Equal(t, test.code, resp.Error.Code)
+			assert.NotEmpty(t, resp.Error.Message)
+			assert.Equal(t, "null", string(resp.ID))
+		})
+	}
+}
+
+func TestUpstreamErrorResponse(t *testing.T) {
+	// The upstream is unreachable and the call is not cacheable, so the
+	// database is never reached
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":"abc"}`)))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":"abc","error":{"code":-32603,"message":"upstream error"}}`, rec.Body.String())
+}
+
+func TestInvalidUpstreamResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><h1>503 Service Temporarily Unavailable</h1></body></html>`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	before := testutil.ToFloat64(metrics.UpstreamErrors.WithLabelValues("eth_blockNumber", "invalid_response"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`)))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"invalid upstream response"}}`, rec.Body.String())
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.UpstreamErrors.WithLabelValues("eth_blockNumber", "invalid_response")))
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// The upstream only answers once the proxy gives up
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reading the body lets the server notice the client going away
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL, RequestTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	// The client request carries no deadline
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`)))
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"request timed out"}}`, rec.Body.String())
+}
+
+func TestRateLimitedMetric(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// A burst of a single request, refilled every 1000s
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL, RateLimit: 0.001})
+	require.NoError(t, err)
+
+	before := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("global"))
+
+	sendRequest := func() int {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`)).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The first request exhausts the limiter, the second is rejected
+	require.Equal(t, http.StatusOK, sendRequest())
+	require.Equal(t, http.StatusTooManyRequests, sendRequest())
+
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.RateLimited.WithLabelValues("global")))
+}
+
+func TestPerMethodRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// A burst of a single debug_traceCall request, refilled every
+	// 1000s. Viper lower-cases the method names.
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{
+		UpstreamURL:        upstream.URL,
+		PerMethodRateLimit: map[string]float64{"debug_tracecall": 0.001},
+	})
+	require.NoError(t, err)
+
+	before := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("method"))
+
+	sendRequest := func(method string) int {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"`+method+`","params":["0x123"],"id":1}`)).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The first trace exhausts its limiter, the second is rejected
+	require.Equal(t, http.StatusOK, sendRequest("debug_traceCall"))
+	require.Equal(t, http.StatusTooManyRequests, sendRequest("debug_traceCall"))
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.RateLimited.WithLabelValues("method")))
+
+	// Other methods are not limited
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusOK, sendRequest("eth_chainId"))
+	}
+}
+
+func TestBlockTraceCacheability(t *testing.T) {
+	keys, err := NewDefaultKeyGenerator("sha256")
+	require.NoError(t, err)
+	h := &Handler{cacheBlockTraces: true, keys: keys}
+
+	assert.True(t, h.isCacheable("debug_traceBlockByNumber", json.RawMessage(`["0x10",{"tracer":"callTracer"}]`)))
+	for _, block := range []string{"latest", "finalized", "0x", "0xzz", "16"} {
+		assert.False(t, h.isCacheable("debug_traceBlockByNumber", json.RawMessage(`["`+block+`"]`)), "block: %s", block)
+	}
+
+	// The tracer config maps to the same key whatever its formatting
+	key1, err := h.cacheKey(config.Upstream{}, "debug_traceBlockByNumber",
+		json.RawMessage(`["0x10",{"tracer":"callTracer","tracerConfig":{"onlyTopCall":true,"withLog":false}}]`))
+	require.NoError(t, err)
+	key2, err := h.cacheKey(config.Upstream{}, "debug_traceBlockByNumber",
+		json.RawMessage(`[ "0x10", { "tracerConfig": { "withLog": false, "onlyTopCall": true }, "tracer": "callTracer" } ]`))
+	require.NoError(t, err)
+	assert.Equal(t, key1, key2)
+
+	// Block traces are only cached when enabled
+	h.cacheBlockTraces = false
+	assert.False(t, h.isCacheable("debug_traceBlockByNumber", json.RawMessage(`["0x10"]`)))
+}
+
+// failingStore misses every read and fails every write.
+type failingStore struct {
+	Store
+}
+
+func (failingStore) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	return nil, nil, 0, nil
+}
+
+func (failingStore) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	return errors.New("database unavailable")
+}
+
+func TestParamsLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{}}`))
+	}))
+	defer upstream.Close()
+
+	storageKeys := make([]string, 1000)
+	for i := range storageKeys {
+		storageKeys[i] = fmt.Sprintf(`"0x%064x"`, i)
+	}
+	oversized := `["0x0000000000000000000000000000000000000001",[` + strings.Join(storageKeys, ",") + `],"0x10"]`
+	nested := `["0x0000000000000000000000000000000000000001",[[[["0x1"]]]],"0x10"]`
+
+	tests := []struct {
+		name   string
+		cfg    config.Config
+		params string
+		limit  string
+	}{
+		{"oversized", config.Config{MaxParamsBytes: "1KB"}, oversized, "bytes"},
+		{"too deep", config.Config{MaxParamsDepth: 3}, nested, "depth"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.cfg.UpstreamURL = upstream.URL
+			// The nil store fails the test if the request is considered
+			// cacheable
+			h, err := NewHandler(zap.NewNop(), nil, nil, test.cfg)
+			require.NoError(t, err)
+
+			before := testutil.ToFloat64(metrics.ParamsLimitExceeded.WithLabelValues("eth_getProof", test.limit))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+				strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getProof","params":`+test.params+`,"id":1}`)))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "BYPASS", rec.Header().Get(CacheStatusHeader))
+			assert.Equal(t, before+1, testutil.ToFloat64(metrics.ParamsLimitExceeded.WithLabelValues("eth_getProof", test.limit)))
+		})
+	}
+
+	assert.Equal(t, 1, paramsDepth(json.RawMessage(`[]`)))
+	assert.Equal(t, 3, paramsDepth(json.RawMessage(`[{"a":[1]}, "[[[[", "\\\"]"]`)))
+	assert.Equal(t, 5, paramsDepth(json.RawMessage(nested)))
+}
+
+func TestCacheWriteErrorMetric(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), failingStore{}, nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	method := "eth_getTransactionByHash"
+	before := testutil.ToFloat64(metrics.CacheWriteErrors.WithLabelValues(method))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+
+	// The client still gets its response
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`, rec.Body.String())
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.CacheWriteErrors.WithLabelValues(method)))
+}
+
+// unavailableStore fails every read and write.
+type unavailableStore struct {
+	Store
+}
+
+func (unavailableStore) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	return nil, nil, 0, errors.New("database unavailable")
+}
+
+func (unavailableStore) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	return errors.New("database unavailable")
+}
+
+func TestFallbackCache(t *testing.T) {
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), unavailableStore{}, nil, config.Config{UpstreamURL: upstream.URL, FallbackCacheSize: 10})
+	require.NoError(t, err)
+
+	sendRequest := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	rec := sendRequest()
+	assert.Equal(t, "MISS", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.DBDegraded))
+
+	// The repeated request is served from memory
+	rec = sendRequest()
+	assert.Equal(t, "HIT", rec.Header().Get(CacheStatusHeader))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`, rec.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+}
+
+func TestFallbackCacheEviction(t *testing.T) {
+	c := newFallbackCache(2, time.Minute, 0)
+	c.add("a", []byte("1"), nil)
+	c.add("b", []byte("2"), nil)
+	_, _, ok := c.get("a")
+	require.True(t, ok)
+
+	// b is the least recently used entry
+	c.add("c", []byte("3"), nil)
+	_, _, ok = c.get("b")
+	assert.False(t, ok)
+	_, _, ok = c.get("a")
+	assert.True(t, ok)
+	_, _, ok = c.get("c")
+	assert.True(t, ok)
+
+	// Disabled cache
+	var disabled *fallbackCache
+	disabled.add("a", []byte("1"), nil)
+	_, _, ok = disabled.get("a")
+	assert.False(t, ok)
+}
+
+func TestFallbackCacheBytesBudget(t *testing.T) {
+	before := testutil.ToFloat64(metrics.InternalMemoryBytes)
+	c := newFallbackCache(100, time.Minute, 10)
+	c.add("a", []byte("1234"), nil)
+	c.add("b", []byte("1234"), nil)
+	assert.Equal(t, before+10, testutil.ToFloat64(metrics.InternalMemoryBytes))
+
+	// a is evicted to stay within the budget
+	c.add("c", []byte("12"), nil)
+	_, _, ok := c.get("a")
+	assert.False(t, ok)
+	_, _, ok = c.get("b")
+	assert.True(t, ok)
+	_, _, ok = c.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, before+8, testutil.ToFloat64(metrics.InternalMemoryBytes))
+
+	// Larger than the whole budget, never kept
+	c.add("d", []byte("1234567890"), nil)
+	_, _, ok = c.get("d")
+	assert.False(t, ok)
+
+	// Replacing an entry accounts for the new size only
+	c.add("c", []byte("1"), nil)
+	assert.Equal(t, before+7, testutil.ToFloat64(metrics.InternalMemoryBytes))
+}
+
+// agedStore holds a single result of the given age and fails every write.
+type agedStore struct {
+	Store
+	result []byte
+	age    time.Duration
+}
+
+func (s agedStore) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	return s.result, nil, s.age, nil
+}
+
+func (agedStore) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	return errors.New("unexpected write")
+}
+
+func (agedStore) RefreshCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	return errors.New("unexpected write")
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	// The upstream is unreachable
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	store := agedStore{result: []byte(`{"hash":"0x123"}`), age: time.Hour}
+	cfg := config.Config{
+		UpstreamURL:          upstream.URL,
+		StaleWhileRevalidate: true,
+		FreshnessWindow:      time.Minute,
+		StalenessWindow:      time.Minute,
+	}
+	sendRequest := func(cfg config.Config) *httptest.ResponseRecorder {
+		h, err := NewHandler(zap.NewNop(), store, nil, cfg)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	// The expired entry is not served by default
+	rec := sendRequest(cfg)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"upstream error"}}`, rec.Body.String())
+
+	cfg.ServeStaleOnError = true
+	before := testutil.ToFloat64(metrics.StaleOnError.WithLabelValues("eth_getTransactionByHash"))
+	rec = sendRequest(cfg)
+	assert.Equal(t, "STALE", rec.Header().Get(CacheStatusHeader))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`, rec.Body.String())
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.StaleOnError.WithLabelValues("eth_getTransactionByHash")))
+}
+
+// datedStore keeps results in memory along with their creation time, which
+// only a refresh resets on an existing entry, like the database does.
+type datedStore struct {
+	Store
+	results   map[string][]byte
+	createdAt map[string]time.Time
+}
+
+func (s *datedStore) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	return s.results[key], nil, time.Since(s.createdAt[key]), nil
+}
+
+func (s *datedStore) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	s.results[key] = response
+	if _, ok := s.createdAt[key]; !ok {
+		s.createdAt[key] = time.Now()
+	}
+	return nil
+}
+
+func (s *datedStore) RefreshCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	s.results[key] = response
+	s.createdAt[key] = time.Now()
+	return nil
+}
+
+func TestExpiredEntryRefreshed(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	store := &datedStore{results: make(map[string][]byte), createdAt: make(map[string]time.Time)}
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:          upstream.URL,
+		StaleWhileRevalidate: true,
+		FreshnessWindow:      time.Minute,
+		StalenessWindow:      time.Minute,
+	})
+	require.NoError(t, err)
+
+	sendRequest := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	assert.Equal(t, "MISS", sendRequest())
+	for key := range store.createdAt {
+		store.createdAt[key] = time.Now().Add(-time.Hour)
+	}
+
+	// The expired entry is fetched again once and then served
+	assert.Equal(t, "MISS", sendRequest())
+	assert.Equal(t, "HIT", sendRequest())
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestMinCacheTTL(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x456"}}`))
+	}))
+	defer upstream.Close()
+
+	store := agedStore{result: []byte(`{"hash":"0x123"}`), age: time.Minute}
+	cfg := config.Config{
+		UpstreamURL:          upstream.URL,
+		StaleWhileRevalidate: true,
+		FreshnessWindow:      time.Second,
+	}
+	sendRequest := func(cfg config.Config) string {
+		h, err := NewHandler(zap.NewNop(), store, nil, cfg)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	// The entry is past the freshness window and revalidated
+	assert.Equal(t, "STALE", sendRequest(cfg))
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// The floor overrides the freshness window
+	cfg.MinCacheTTL = time.Hour
+	assert.Equal(t, "HIT", sendRequest(cfg))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+// memoryStore keeps results in memory.
+type memoryStore struct {
+	Store
+	results map[string][]byte
+	headers map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{results: make(map[string][]byte), headers: make(map[string][]byte)}
+}
+
+func (s *memoryStore) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	return s.results[key], nil, 0, nil
+}
+
+func (s *memoryStore) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	s.results[key] = response
+	return nil
+}
+
+func (s *memoryStore) RefreshCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	s.results[key] = response
+	return nil
+}
+
+func (s *memoryStore) SetCachedHeaders(ctx context.Context, key string, headers []byte) error {
+	s.headers[key] = headers
+	return nil
+}
+
+func (s *memoryStore) GetCachedHeaders(ctx context.Context, key string) ([]byte, error) {
+	return s.headers[key], nil
+}
+
+func TestCanonicalProofKeys(t *testing.T) {
+	// The upstream returns the storage proofs in the requested order
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		var req struct {
+			Params []json.RawMessage `json:"params"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		var keys []string
+		require.NoError(t, json.Unmarshal(req.Params[1], &keys))
+
+		proofs := make([]string, len(keys))
+		for i, key := range keys {
+			proofs[i] = `{"key":"` + key + `","value":"` + key + `","proof":[]}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"balance":"0x0","storageProof":[` + strings.Join(proofs, ",") + `]}}`))
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{UpstreamURL: upstream.URL, CanonicalizeProofKeys: true})
+	require.NoError(t, err)
+
+	sendRequest := func(keys string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getProof","params":["0x0000000000000000000000000000000000000001",`+keys+`,"0x10"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	rec := sendRequest(`["0x2","0x1"]`)
+	assert.Equal(t, "MISS", rec.Header().Get(CacheStatusHeader))
+	assert.Len(t, store.results, 1)
+
+	// The same keys in another order share the entry, served in the
+	// requested order
+	rec = sendRequest(`["0x1","0x2"]`)
+	assert.Equal(t, "HIT", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"balance":"0x0","storageProof":[`+
+		`{"key":"0x1","value":"0x1","proof":[]},{"key":"0x2","value":"0x2","proof":[]}]}}`, rec.Body.String())
+
+	// Other keys are another entry
+	rec = sendRequest(`["0x1","0x3"]`)
+	assert.Equal(t, "MISS", rec.Header().Get(CacheStatusHeader))
+	assert.Len(t, store.results, 2)
+}
+
+// slowStore misses every read after the configured delay and counts them.
+type slowStore struct {
+	Store
+	delay atomic.Int64
+	reads atomic.Int32
+}
+
+func (s *slowStore) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	s.reads.Add(1)
+	time.Sleep(time.Duration(s.delay.Load()))
+	return nil, nil, 0, nil
+}
+
+func (s *slowStore) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	time.Sleep(time.Duration(s.delay.Load()))
+	return nil
+}
+
+func TestDBLatencyBypass(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	store := &slowStore{}
+	store.delay.Store(int64(50 * time.Millisecond))
+	cooldown := 200 * time.Millisecond
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:        upstream.URL,
+		DBLatencyThreshold: 10 * time.Millisecond,
+		DBLatencyCooldown:  cooldown,
+	})
+	require.NoError(t, err)
+
+	sendRequest := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	// The slow read engages the bypass
+	rec := sendRequest()
+	assert.Equal(t, "MISS", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.DBBypassed))
+
+	// The store is not reached anymore
+	rec = sendRequest()
+	assert.Equal(t, "BYPASS", rec.Header().Get(CacheStatusHeader))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`, rec.Body.String())
+	assert.Equal(t, int32(1), store.reads.Load())
+
+	// Once the database recovers, the cache is used again after the
+	// cooldown
+	store.delay.Store(0)
+	time.Sleep(cooldown)
+	rec = sendRequest()
+	assert.Equal(t, "MISS", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, int32(2), store.reads.Load())
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.DBBypassed))
+}
+
+func TestMethodFilter(t *testing.T) {
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		method  string
+		allows  bool
+	}{
+		{"denied", nil, []string{"debug_*", "admin_peers"}, "debug_traceCall", false},
+		{"denied exact", nil, []string{"debug_*", "admin_peers"}, "admin_peers", false},
+		{"not denied", nil, []string{"debug_*", "admin_peers"}, "eth_blockNumber", true},
+		{"allowed", []string{"eth_*"}, nil, "eth_blockNumber", true},
+		{"not allowed", []string{"eth_*"}, nil, "net_version", false},
+		{"allowlist precedence", []string{"eth_*"}, []string{"eth_blockNumber"}, "eth_blockNumber", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{
+				UpstreamURL:    upstream.URL,
+				AllowedMethods: test.allowed,
+				DeniedMethods:  test.denied,
+			})
+			require.NoError(t, err)
+
+			before := atomic.LoadInt32(&requestCount)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+				strings.NewReader(`{"jsonrpc":"2.0","method":"`+test.method+`","params":[],"id":5}`)))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			if test.allows {
+				assert.Equal(t, before+1, atomic.LoadInt32(&requestCount))
+				return
+			}
+			assert.Equal(t, before, atomic.LoadInt32(&requestCount), "the upstream must not be contacted")
+
+			var resp struct {
+				Error JSONRPCError    `json:"error"`
+				ID    json.RawMessage `json:"id"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.Equal(t, methodNotFoundCode, resp.Error.Code)
+			assert.Equal(t, "5", string(resp.ID))
+		})
+	}
+}
+
+// collidingStore holds a single entry, stored for other params than the
+// requested ones.
+type collidingStore struct {
+	Store
+	params  []byte
+	written []byte
+}
+
+func (s *collidingStore) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	return []byte(`{"hash":"0xother"}`), s.params, 0, nil
+}
+
+func (s *collidingStore) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	s.written = params
+	return nil
+}
+
+func TestStrictJSONRPC(t *testing.T) {
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		strict  bool
+		version string
+		allows  bool
+	}{
+		{"lenient", false, `"1.0"`, true},
+		{"strict 2.0", true, `"2.0"`, true},
+		{"strict 1.0", true, `"1.0"`, false},
+		{"strict missing", true, `null`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL, StrictJSONRPC: test.strict})
+			require.NoError(t, err)
+
+			before := atomic.LoadInt32(&requestCount)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+				strings.NewReader(`{"jsonrpc":`+test.version+`,"method":"eth_blockNumber","params":[],"id":5}`)))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			if test.allows {
+				assert.Equal(t, before+1, atomic.LoadInt32(&requestCount))
+				return
+			}
+			assert.Equal(t, before, atomic.LoadInt32(&requestCount), "the upstream must not be contacted")
+			assert.JSONEq(t, `{"jsonrpc":"2.0","id":5,"error":{"code":-32600,"message":"invalid jsonrpc version, expected 2.0"}}`, rec.Body.String())
+		})
+	}
+}
+
+func TestCacheKeyVerification(t *testing.T) {
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	sendRequest := func(store Store) *httptest.ResponseRecorder {
+		h, err := NewHandler(zap.NewNop(), store, nil, config.Config{UpstreamURL: upstream.URL, VerifyCacheKey: true})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		return rec
+	}
+
+	// Matching params are served from the cache
+	store := &collidingStore{params: []byte(`["0x123"]`)}
+	rec := sendRequest(store)
+	assert.Equal(t, "HIT", rec.Header().Get(CacheStatusHeader))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requestCount))
+
+	// Mismatching params are a miss, fetched from the upstream
+	before := testutil.ToFloat64(metrics.CacheCollisions)
+	store = &collidingStore{params: []byte(`["0xother"]`)}
+	rec = sendRequest(store)
+	assert.Equal(t, "MISS", rec.Header().Get(CacheStatusHeader))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`, rec.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.CacheCollisions))
+
+	// The entry is rewritten with the request params
+	assert.Equal(t, `["0x123"]`, string(store.written))
+}
+
+func TestMaxStoredParamsBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	hash := "0x" + strings.Repeat("ab", 1000)
+	sendRequest := func(store Store, hash string) *httptest.ResponseRecorder {
+		h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+			UpstreamURL:          upstream.URL,
+			VerifyCacheKey:       true,
+			MaxStoredParamsBytes: "64",
+		})
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["`+hash+`"],"id":1}`)))
+		return rec
+	}
+
+	// Long params are stored as their digest
+	store := &collidingStore{params: []byte(`["0xother"]`)}
+	assert.Equal(t, "MISS", sendRequest(store, hash).Header().Get(CacheStatusHeader))
+	assert.True(t, strings.HasPrefix(string(store.written), "sha256:"))
+	assert.LessOrEqual(t, len(store.written), 71)
+
+	// The digest still verifies the hits
+	store = &collidingStore{params: store.written}
+	assert.Equal(t, "HIT", sendRequest(store, hash).Header().Get(CacheStatusHeader))
+	assert.Equal(t, "MISS", sendRequest(store, hash+"cd").Header().Get(CacheStatusHeader))
+
+	// Short params are stored as is
+	store = &collidingStore{params: []byte(`["0xother"]`)}
+	sendRequest(store, "0x123")
+	assert.Equal(t, `["0x123"]`, string(store.written))
+}
+
+func TestResponseBytesMetric(t *testing.T) {
+	// The upstream answers with a result of the size given as param
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params []int `json:"params"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":"%s"}`, strings.Repeat("a", req.Params[0]))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	histogram := func() *dto.Histogram {
+		var pb dto.Metric
+		require.NoError(t, metrics.ResponseBytes.WithLabelValues("eth_getBlockByHash").(prometheus.Histogram).Write(&pb))
+		return pb.GetHistogram()
+	}
+	beforeCount := histogram().GetSampleCount()
+	beforeSum := histogram().GetSampleSum()
+
+	var served int
+	for _, size := range []int{10, 1000, 100000} {
+		// The first call is served by the upstream, the second from the cache
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+				strings.NewReader(fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_getBlockByHash","params":[%d],"id":1}`, size))))
+			require.Equal(t, http.StatusOK, rec.Code)
+			served += rec.Body.Len()
+		}
+	}
+
+	assert.Equal(t, beforeCount+6, histogram().GetSampleCount())
+	assert.Equal(t, beforeSum+float64(served), histogram().GetSampleSum())
+}
+
+func TestCacheFinalizedOnly(t *testing.T) {
+	var headCalls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JSONRPCRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Method {
+		case "eth_blockNumber":
+			headCalls.Add(1)
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x100"}`))
+		case "eth_getTransactionReceipt":
+			var params []string
+			_ = json.Unmarshal(req.Params, &params)
+			// The transaction hash doubles as its block number
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":{"blockNumber":"%s"}}`, params[0])
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+		}
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:            upstream.URL,
+		CacheFinalizedOnly:     true,
+		ReorgConfirmationDepth: 16,
+	})
+	require.NoError(t, err)
+
+	sendRequest := func(body string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// A block within the confirmation depth from the head is not cached
+	sendRequest(`{"jsonrpc":"2.0","method":"eth_getStorageAt","params":["0xabc","0x0","0xf1"],"id":1}`)
+	assert.Empty(t, store.results)
+
+	// Neither is a block hash
+	sendRequest(`{"jsonrpc":"2.0","method":"eth_getStorageAt","params":["0xabc","0x0","0x00000000000000000000000000000000000000000000000000000000000000aa"],"id":1}`)
+	assert.Empty(t, store.results)
+
+	// An older block is
+	sendRequest(`{"jsonrpc":"2.0","method":"eth_getStorageAt","params":["0xabc","0x0","0xf0"],"id":1}`)
+	assert.Len(t, store.results, 1)
+
+	// Transaction lookups are checked on the block of their result
+	sendRequest(`{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","params":["0xff"],"id":1}`)
+	assert.Len(t, store.results, 1)
+	sendRequest(`{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","params":["0x10"],"id":1}`)
+	assert.Len(t, store.results, 2)
+
+	// The head is fetched once and reused
+	assert.Equal(t, int32(1), headCalls.Load())
+}
+
+// txIndexStore keeps results and the tx index in memory
+type txIndexStore struct {
+	*memoryStore
+	txBlocks map[string]uint64
+}
+
+func (s *txIndexStore) SetBlockNumberForTx(ctx context.Context, txHash string, blockNumber uint64) error {
+	s.txBlocks[txHash] = blockNumber
+	return nil
+}
+
+func (s *txIndexStore) GetBlockNumberForTx(ctx context.Context, txHash string) (uint64, bool, error) {
+	blockNumber, ok := s.txBlocks[txHash]
+	return blockNumber, ok, nil
+}
+
+func TestCacheFinalizedOnlyIndexedTx(t *testing.T) {
+	var headCalls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JSONRPCRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method == "eth_blockNumber" {
+			// The head cannot be fetched
+			headCalls.Add(1)
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"unavailable"}}`))
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"blockNumber":"0x10"}}`))
+	}))
+	defer upstream.Close()
+
+	store := &txIndexStore{memoryStore: newMemoryStore(), txBlocks: make(map[string]uint64)}
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:        upstream.URL,
+		CacheFinalizedOnly: true,
+		IndexTxBlocks:      true,
+	})
+	require.NoError(t, err)
+
+	sendRequest := func(method string, hash string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"`+method+`","params":["`+hash+`"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// Without the head, an unknown transaction is not cached
+	sendRequest("eth_getTransactionReceipt", "0xaaa")
+	assert.Empty(t, store.results)
+	assert.Equal(t, int32(1), headCalls.Load())
+
+	// A transaction indexed in the same block is final
+	store.txBlocks["0xbbb"] = 0x10
+	sendRequest("eth_getTransactionReceipt", "0xbbb")
+	assert.Len(t, store.results, 1)
+
+	// Not when indexed in another block, e.g. after a reorg
+	store.txBlocks["0xccc"] = 0x11
+	sendRequest("eth_getTransactionReceipt", "0xccc")
+	assert.Len(t, store.results, 1)
+}
+
+func TestHeadTrackerFetch(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	tracker := newHeadTracker(true, 16, func(ctx context.Context, upstream config.Upstream) (uint64, error) {
+		calls.Add(1)
+		<-release
+		return 0x100, nil
+	})
+
+	// Concurrent requests share a single fetch
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.True(t, tracker.isFinal(context.Background(), config.Upstream{}, 0xf0))
+		}()
+	}
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	// The head is not locked while fetched
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, tracker.isFinal(ctx, config.Upstream{}, 0xf0))
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+
+	// A failed fetch is not retried before headTTL
+	calls.Store(0)
+	failing := newHeadTracker(true, 16, func(ctx context.Context, upstream config.Upstream) (uint64, error) {
+		calls.Add(1)
+		return 0, errors.New("unavailable")
+	})
+	assert.False(t, failing.isFinal(context.Background(), config.Upstream{}, 0xf0))
+	assert.False(t, failing.isFinal(context.Background(), config.Upstream{}, 0xf0))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Each upstream is checked against its own head
+	heads := map[string]uint64{"ahead": 0x100, "lagging": 0x80}
+	perUpstream := newHeadTracker(true, 16, func(ctx context.Context, upstream config.Upstream) (uint64, error) {
+		return heads[upstream.ID], nil
+	})
+	assert.True(t, perUpstream.isFinal(context.Background(), config.Upstream{ID: "ahead"}, 0xf0))
+	assert.False(t, perUpstream.isFinal(context.Background(), config.Upstream{ID: "lagging"}, 0xf0))
+}
+
+func TestRecordReplay(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JSONRPCRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		// Every call gets a distinct result
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":"%s-%d"}`, req.Method, calls.Add(1))
+	}))
+
+	requests := []string{
+		`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`,
+		`{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":1}`,
+		`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`,
+		`{"jsonrpc":"2.0","method":"eth_call","params":[{"to":"0xabc"},"latest"],"id":1}`,
+	}
+	sendRequests := func(h *Handler) []string {
+		var bodies []string
+		for _, body := range requests {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+			require.Equal(t, http.StatusOK, rec.Code)
+			bodies = append(bodies, rec.Body.String())
+		}
+		return bodies
+	}
+
+	// Record the traffic with the live upstream
+	recordFile := filepath.Join(t.TempDir(), "record.ndjson")
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL, RecordFile: recordFile})
+	require.NoError(t, err)
+	recorded := sendRequests(h)
+	require.NoError(t, h.Close())
+	upstream.Close()
+
+	// Replay it without the upstream
+	h, err = NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL, ReplayFile: recordFile})
+	require.NoError(t, err)
+	assert.Equal(t, recorded, sendRequests(h))
+
+	// Calls which were not recorded get an error
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_gasPrice","params":[],"id":1}`)))
+	assert.Contains(t, rec.Body.String(), "no recorded response")
+}
+
+func TestBlockReceiptsCaching(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[{"transactionHash":"0x123","blockNumber":"0x10","blockHash":"0xabc"}]}`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	sendRequest := func(block string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getBlockReceipts","params":["`+block+`"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	// The encodings of a block number share the same entry
+	assert.Equal(t, "MISS", sendRequest("0x10"))
+	assert.Equal(t, "HIT", sendRequest("0x10"))
+	assert.Equal(t, "HIT", sendRequest("0x010"))
+	assert.Equal(t, "HIT", sendRequest("0x0000010"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Block tags are not cached
+	assert.Equal(t, "BYPASS", sendRequest("latest"))
+	assert.Equal(t, "BYPASS", sendRequest("latest"))
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestFeeHistoryCaching(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JSONRPCRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method == "eth_blockNumber" {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x100"}`))
+			return
+		}
+		calls.Add(1)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"oldestBlock":"0xb","baseFeePerGas":["0x1","0x2"],"gasUsedRatio":[0.5]}}`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, config.Config{UpstreamURL: upstream.URL, CacheFinalizedOnly: true})
+	require.NoError(t, err)
+
+	sendRequest := func(params string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_feeHistory","params":`+params+`,"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	// The encodings of the block count and newest block share the same entry
+	assert.Equal(t, "MISS", sendRequest(`["0x1","0x10",[25,75]]`))
+	assert.Equal(t, "HIT", sendRequest(`["0x1","0x10",[25,75]]`))
+	assert.Equal(t, "HIT", sendRequest(`["0x01","0x010",[25,75]]`))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// The reward percentiles are part of the key
+	assert.Equal(t, "MISS", sendRequest(`["0x1","0x10",[50]]`))
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Block tags are not cached
+	assert.Equal(t, "BYPASS", sendRequest(`["0x1","latest",[25,75]]`))
+	assert.Equal(t, "BYPASS", sendRequest(`["0x1","latest",[25,75]]`))
+	assert.Equal(t, int32(4), calls.Load())
+
+	// Neither are ranges ending within the confirmation depth of the head
+	assert.Equal(t, "BYPASS", sendRequest(`["0x1","0xf0",[25,75]]`))
+	assert.Equal(t, "BYPASS", sendRequest(`["0x1","0xf0",[25,75]]`))
+	assert.Equal(t, int32(6), calls.Load())
+}
+
+func TestRPCCacheControl(t *testing.T) {
+	var calls atomic.Int32
+	var forwarded atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		forwarded.Store(string(body))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x%d"}}`, calls.Add(1))
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{UpstreamURL: upstream.URL, AllowRPCCacheControl: true})
+	require.NoError(t, err)
+
+	sendRequest := func(cacheControl string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1`+cacheControl+`}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+
+	// no-store neither reads nor writes the cache, and is not forwarded
+	sendRequest(`,"cacheControl":"no-store"`)
+	assert.Empty(t, store.results)
+	assert.NotContains(t, forwarded.Load(), "cacheControl")
+
+	sendRequest("")
+	require.Len(t, store.results, 1)
+	assert.Contains(t, sendRequest(`,"cacheControl":"no-store"`), "0x3")
+	assert.Equal(t, int32(3), calls.Load())
+
+	// The stored entry was left untouched
+	assert.Contains(t, sendRequest(""), "0x2")
+	assert.Equal(t, int32(3), calls.Load())
+
+	// no-cache skips the read and overwrites the entry
+	assert.Contains(t, sendRequest(`,"cacheControl":"no-cache"`), "0x4")
+	assert.Contains(t, sendRequest(""), "0x4")
+	assert.Equal(t, int32(4), calls.Load())
+}
+
+func TestInflightMetrics(t *testing.T) {
+	reached := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		close(reached)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	requests := testutil.ToFloat64(metrics.InflightRequests)
+	upstreamRequests := testutil.ToFloat64(metrics.InflightUpstreamRequests)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`)))
+	}()
+
+	// The request is held by the upstream
+	<-reached
+	assert.Equal(t, requests+1, testutil.ToFloat64(metrics.InflightRequests))
+	assert.Equal(t, upstreamRequests+1, testutil.ToFloat64(metrics.InflightUpstreamRequests))
+
+	close(release)
+	<-done
+	assert.Equal(t, requests, testutil.ToFloat64(metrics.InflightRequests))
+	assert.Equal(t, upstreamRequests, testutil.ToFloat64(metrics.InflightUpstreamRequests))
+}
+
+func TestFormatID(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{`1`, `1`},
+		{`-12`, `-12`},
+		{`1.5e3`, `1.5e3`},
+		{`"abc"`, `"abc"`},
+		// The string id "1" is not the number id 1
+		{`"1"`, `"1"`},
+		// Escapes are canonical
+		{`"\u0061b"`, `"ab"`},
+		{`null`, `null`},
+		// Invalid ids are rendered anyway
+		{`{ "a": 1 }`, `{"a":1}`},
+		{``, notificationID},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, formatID(json.RawMessage(tt.id)), "id: %s", tt.id)
+	}
+}
+
+func TestRewriteUpstreamIDs(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Params []json.RawMessage `json:"params"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		seen[string(req.ID)] = true
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":%s}`, req.ID, req.Params[0])
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: upstream.URL, RewriteUpstreamIDs: true})
+	require.NoError(t, err)
+
+	// Two clients using the same id concurrently
+	var wg sync.WaitGroup
+	responses := make([]JSONRPCResponse, 2)
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+				strings.NewReader(fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_call","params":["client-%d"],"id":"same"}`, i))))
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &responses[i]))
+		}()
+	}
+	wg.Wait()
+
+	for i, resp := range responses {
+		assert.JSONEq(t, `"same"`, string(resp.ID))
+		assert.JSONEq(t, fmt.Sprintf(`"client-%d"`, i), string(resp.Result))
+	}
+	// The upstream saw distinct ids, none of them the client's
+	assert.Len(t, seen, 2)
+	assert.NotContains(t, seen, `"same"`)
+}
+
+func TestAdaptiveSizeFilter(t *testing.T) {
+	var huge atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		result := `"0x1"`
+		if huge.Load() {
+			result = `"0x` + strings.Repeat("f", 10000) + `"`
+		}
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":%s}`, result)
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{UpstreamURL: upstream.URL, AdaptiveSizeFilter: true})
+	require.NoError(t, err)
+
+	sendRequest := func(hash string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["`+hash+`"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	for i := 0; i < 200; i++ {
+		sendRequest(fmt.Sprintf("0x%x", i))
+	}
+	require.Len(t, store.results, 200)
+
+	// The huge response is served but not cached
+	huge.Store(true)
+	sendRequest("0xhuge")
+	assert.Len(t, store.results, 200)
+}
+
+func TestCachingByIndex(t *testing.T) {
+	tests := []struct {
+		method string
+		block  string
+		// encoding is another encoding of block and index sharing the
+		// same entry
+		encoding string
+	}{
+		{"eth_getUncleByBlockHashAndIndex", `"0xabc"`, `"0xabc","0x01"`},
+		{"eth_getUncleByBlockNumberAndIndex", `"0x10"`, `"0x010","0x01"`},
+		{"eth_getTransactionByBlockHashAndIndex", `"0xabc"`, `"0xabc","0x01"`},
+		{"eth_getTransactionByBlockNumberAndIndex", `"0x10"`, `"0x010","0x01"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0xdef","number":"0xf"}}`))
+			}))
+			defer upstream.Close()
+
+			h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, config.Config{UpstreamURL: upstream.URL})
+			require.NoError(t, err)
+
+			sendRequest := func(params string) string {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+					strings.NewReader(`{"jsonrpc":"2.0","method":"`+tt.method+`","params":[`+params+`],"id":1}`)))
+				require.Equal(t, http.StatusOK, rec.Code)
+				return rec.Header().Get(CacheStatusHeader)
+			}
+
+			assert.Equal(t, "MISS", sendRequest(tt.block+`,"0x1"`))
+			assert.Equal(t, "HIT", sendRequest(tt.block+`,"0x1"`))
+			assert.Equal(t, "HIT", sendRequest(tt.encoding))
+			assert.Equal(t, int32(1), calls.Load())
+
+			// The index is part of the key
+			assert.Equal(t, "MISS", sendRequest(tt.block+`,"0x2"`))
+			assert.Equal(t, int32(2), calls.Load())
+		})
+	}
+
+	// Block tags are not cached
+	assert.False(t, isCacheable("eth_getUncleByBlockNumberAndIndex", json.RawMessage(`["latest","0x0"]`)))
+	assert.False(t, isCacheable("eth_getTransactionByBlockNumberAndIndex", json.RawMessage(`["latest","0x0"]`)))
+}
+
+func TestParityTraceCaching(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JSONRPCRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method == "eth_blockNumber" {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x100"}`))
+			return
+		}
+		calls.Add(1)
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[{"action":{},"blockNumber":16,"type":"call"}]}`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, config.Config{
+		UpstreamURL:        upstream.URL,
+		CacheParityTraces:  true,
+		CacheFinalizedOnly: true,
+	})
+	require.NoError(t, err)
+
+	sendRequest := func(method, params string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"`+method+`","params":[`+params+`],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	assert.Equal(t, "MISS", sendRequest("trace_transaction", `"0xabc"`))
+	assert.Equal(t, "HIT", sendRequest("trace_transaction", `"0xabc"`))
+	assert.Equal(t, int32(1), calls.Load())
+
+	assert.Equal(t, "MISS", sendRequest("trace_block", `"0x10"`))
+	assert.Equal(t, "HIT", sendRequest("trace_block", `"0x010"`))
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Block tags are forwarded
+	assert.Equal(t, "BYPASS", sendRequest("trace_block", `"latest"`))
+
+	// Opt-in
+	h.cacheParityTraces = false
+	assert.False(t, h.isCacheable("trace_transaction", json.RawMessage(`["0xabc"]`)))
+}
+
+// A trace_transaction result is final once the block of its traces is.
+func TestTraceBlock(t *testing.T) {
+	block, ok := traceBlock(json.RawMessage(`[{"blockNumber":16},{"blockNumber":16}]`))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(16), block)
+
+	for _, result := range []string{`[]`, `null`, `[{"type":"call"}]`, `{"blockNumber":16}`} {
+		_, ok := traceBlock(json.RawMessage(result))
+		assert.False(t, ok, "result: %s", result)
+	}
+}
+
+func TestResolveBlockTags(t *testing.T) {
+	var calls, resolutions atomic.Int32
+	var forwarded atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JSONRPCRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method == "eth_getBlockByNumber" {
+			resolutions.Add(1)
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"number":"0x10","hash":"0xabc"}}`))
+			return
+		}
+		calls.Add(1)
+		forwarded.Store(string(req.Params))
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, config.Config{UpstreamURL: upstream.URL, ResolveBlockTags: true})
+	require.NoError(t, err)
+
+	sendRequest := func(block string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getStorageAt","params":["0x1234","0x0","`+block+`"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, rec.Body.String())
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	// The tag is forwarded as the number it designates
+	assert.Equal(t, "MISS", sendRequest("finalized"))
+	assert.JSONEq(t, `["0x1234","0x0","0x10"]`, forwarded.Load().(string))
+	assert.Equal(t, "HIT", sendRequest("0x10"))
+	assert.Equal(t, "HIT", sendRequest("finalized"))
+	assert.Equal(t, int32(1), calls.Load())
+	// The resolution is reused
+	assert.Equal(t, int32(1), resolutions.Load())
+
+	// latest is never resolved nor cached
+	assert.Equal(t, "BYPASS", sendRequest("latest"))
+	assert.Equal(t, int32(1), resolutions.Load())
+
+	// Without resolution, the moving tags are not cached
+	assert.False(t, isCacheable("eth_getStorageAt", json.RawMessage(`["0x1234","0x0","finalized"]`)))
+	assert.False(t, isCacheable("eth_getStorageAt", json.RawMessage(`["0x1234","0x0","safe"]`)))
+}
+
+func TestBlockTagResolverFetch(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	resolver := newBlockTagResolver(true, func(ctx context.Context, upstream config.Upstream, tag string) (uint64, error) {
+		calls.Add(1)
+		<-release
+		return 0x10, nil
+	})
+
+	// Concurrent requests share a single fetch
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, ok := resolver.resolve(context.Background(), config.Upstream{}, "finalized")
+			assert.True(t, ok)
+			assert.Equal(t, uint64(0x10), n)
+		}()
+	}
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	// The resolutions are not locked while fetched
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, ok := resolver.resolve(ctx, config.Upstream{}, "finalized")
+	assert.False(t, ok)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+
+	// A failed fetch is not retried before blockTagTTL
+	calls.Store(0)
+	failing := newBlockTagResolver(true, func(ctx context.Context, upstream config.Upstream, tag string) (uint64, error) {
+		calls.Add(1)
+		return 0, errors.New("unavailable")
+	})
+	_, ok = failing.resolve(context.Background(), config.Upstream{}, "safe")
+	assert.False(t, ok)
+	_, ok = failing.resolve(context.Background(), config.Upstream{}, "safe")
+	assert.False(t, ok)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestResolveBlockTagsPerUpstream(t *testing.T) {
+	// Each upstream has finalized a different block
+	newUpstream := func(number string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":{"number":"%s"}}`, number)
+		}))
+	}
+	ahead, lagging := newUpstream("0x20"), newUpstream("0x10")
+	defer ahead.Close()
+	defer lagging.Close()
+
+	h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, config.Config{
+		Upstreams: []config.Upstream{
+			{ID: "ahead", URL: ahead.URL},
+			{ID: "lagging", URL: lagging.URL},
+		},
+		ResolveBlockTags: true,
+	})
+	require.NoError(t, err)
+
+	req := JSONRPCRequest{Method: "eth_getStorageAt", Params: json.RawMessage(`["0x1234","0x0","finalized"]`)}
+	body := []byte(`{"jsonrpc":"2.0","method":"eth_getStorageAt","params":["0x1234","0x0","finalized"],"id":1}`)
+	for _, tt := range []struct {
+		upstream config.Upstream
+		params   string
+	}{
+		{h.upstreams[0], `["0x1234","0x0","0x20"]`},
+		{h.upstreams[1], `["0x1234","0x0","0x10"]`},
+	} {
+		resolved, _ := h.resolveBlockTag(context.Background(), tt.upstream, req, body)
+		assert.JSONEq(t, tt.params, string(resolved.Params), tt.upstream.ID)
+	}
+}
+
+func TestMinifyResponses(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 1,\n  \"result\": {\n    \"hash\": \"0x123\",\n    \"input\": \"a b\\u0020\\\"c\\\"\",\n    \"value\": 1.000000000000000000001e+30\n  }\n}\n"))
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{UpstreamURL: upstream.URL, MinifyResponses: true})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// Only the whitespace between tokens is removed, the numbers and escapes
+	// are left untouched
+	result := `{"hash":"0x123","input":"a b\u0020\"c\"","value":1.000000000000000000001e+30}`
+	assert.Equal(t, `{"jsonrpc":"2.0","id":1,"result":`+result+`}`, rec.Body.String())
+	require.Len(t, store.results, 1)
+	for _, cached := range store.results {
+		assert.Equal(t, result, string(cached))
+	}
+}
+
+func TestCacheWriteSampleRate(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL: upstream.URL,
+		// Keyed in lower case, like viper does
+		CacheWriteSampleRate: map[string]float64{"eth_gettransactionbyhash": 0},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "MISS", rec.Header().Get(CacheStatusHeader))
+	}
+	assert.Empty(t, store.results)
+	assert.Equal(t, int32(10), calls.Load())
+
+	_, err = NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:          upstream.URL,
+		CacheWriteSampleRate: map[string]float64{"eth_gettransactionbyhash": 1.5},
+	})
+	assert.Error(t, err)
+}
+
+func TestUpstreamURLRedactedFromLogs(t *testing.T) {
+	// The upstream is unreachable
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	core, logs := observer.New(zap.ErrorLevel)
+	h, err := NewHandler(zap.New(core), nil, nil, config.Config{UpstreamURL: upstream.URL + "/v3/SECRETKEY"})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	entries := logs.FilterMessage("upstream error").All()
+	require.Len(t, entries, 1)
+	logged := fmt.Sprint(entries[0].ContextMap())
+	assert.Contains(t, logged, upstream.URL+"/REDACTED")
+	assert.NotContains(t, logged, "SECRETKEY")
+	assert.NotContains(t, rec.Body.String(), "SECRETKEY")
+}
+
+func TestMethodAliases(t *testing.T) {
+	var forwarded []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JSONRPCRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		forwarded = append(forwarded, req.Method)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[{"transactionHash":"0x123","blockNumber":"0x10","blockHash":"0xabc"}]}`))
+	}))
+	defer upstream.Close()
+
+	sendRequest := func(h *Handler, method string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"`+method+`","params":["0x10"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	cfg := config.Config{
+		UpstreamURL: upstream.URL,
+		// Keyed in lower case, like viper does
+		MethodAliases: map[string]string{"parity_getblockreceipts": "eth_getBlockReceipts"},
+	}
+	h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, cfg)
+	require.NoError(t, err)
+
+	// The alias and the standard method share the entry, the alias is
+	// forwarded as is
+	assert.Equal(t, "MISS", sendRequest(h, "parity_getBlockReceipts"))
+	assert.Equal(t, "HIT", sendRequest(h, "eth_getBlockReceipts"))
+	assert.Equal(t, "HIT", sendRequest(h, "parity_getBlockReceipts"))
+	assert.Equal(t, []string{"parity_getBlockReceipts"}, forwarded)
+
+	// Unless the alias is rewritten
+	cfg.RewriteMethodAliases = true
+	h, err = NewHandler(zap.NewNop(), newMemoryStore(), nil, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "MISS", sendRequest(h, "parity_getBlockReceipts"))
+	assert.Equal(t, []string{"parity_getBlockReceipts", "eth_getBlockReceipts"}, forwarded)
+}
+
+func TestCachedResponseHeaders(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Block-Height", "0x10")
+		w.Header().Set("X-Request-Id", "abc")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:           upstream.URL,
+		CachedResponseHeaders: []string{"x-block-height"},
+	})
+	require.NoError(t, err)
+
+	for _, status := range []string{"MISS", "HIT"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, status, rec.Header().Get(CacheStatusHeader))
+		// Only the allow-listed header is captured
+		assert.Equal(t, "0x10", rec.Header().Get("X-Block-Height"))
+		assert.Empty(t, rec.Header().Get("X-Request-Id"))
+	}
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+// lowerCaseKeys derives the keys with the default generator after lower
+// casing the params, sharing the entries of checksummed and plain addresses.
+type lowerCaseKeys struct {
+	KeyGenerator
+}
+
+func (g lowerCaseKeys) CacheKey(namespace string, method string, params json.RawMessage) (string, error) {
+	return g.KeyGenerator.CacheKey(namespace, method, json.RawMessage(strings.ToLower(string(params))))
+}
+
+func TestCustomKeyGenerator(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	defaultKeys, err := NewDefaultKeyGenerator("")
+	require.NoError(t, err)
+	store := newMemoryStore()
+	h, err := NewHandlerWithKeyGenerator(zap.NewNop(), store, nil, config.Config{UpstreamURL: upstream.URL}, lowerCaseKeys{defaultKeys})
+	require.NoError(t, err)
+
+	sendRequest := func(address string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getStorageAt","params":["`+address+`","0x0","0x10"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	assert.Equal(t, "MISS", sendRequest("0xAbCd"))
+	assert.Equal(t, "HIT", sendRequest("0xabcd"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	key, err := defaultKeys.CacheKey("", "eth_getStorageAt", json.RawMessage(`["0xabcd","0x0","0x10"]`))
+	require.NoError(t, err)
+	assert.Contains(t, store.results, key)
+}
+
+func TestCacheResultRequires(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JSONRPCRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(string(req.Params), "pending") {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"transactionHash":"0xaa","blockNumber":null}}`))
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"transactionHash":"0xbb","blockNumber":"0x10"}}`))
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL: upstream.URL,
+		// Keyed in lower case, like viper does
+		CacheResultRequires: map[string][]string{"eth_gettransactionreceipt": {"blockNumber"}},
+	})
+	require.NoError(t, err)
+
+	sendRequest := func(hash string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","params":["`+hash+`"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// A receipt without block number is not cached
+	sendRequest("pending")
+	assert.Empty(t, store.results)
+
+	// A complete one is
+	sendRequest("0xbb")
+	assert.Len(t, store.results, 1)
+}
+
+func TestHasPath(t *testing.T) {
+	result := json.RawMessage(`[{"blockNumber":"0x1","logs":[{"removed":false}],"to":null}]`)
+	assert.True(t, hasPath(result, []string{"0", "blockNumber"}))
+	assert.True(t, hasPath(result, []string{"0", "logs", "0", "removed"}))
+	assert.False(t, hasPath(result, []string{"0", "to"}))
+	assert.False(t, hasPath(result, []string{"1", "blockNumber"}))
+	assert.False(t, hasPath(result, []string{"blockNumber"}))
+}
+
+func TestCacheKeyErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	before := testutil.ToFloat64(metrics.KeyErrors.WithLabelValues("eth_getTransactionByHash"))
+
+	// Params by name cannot be normalized into a key
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":{"hash":"0x123"},"id":1}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "BYPASS", rec.Header().Get(CacheStatusHeader))
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`, rec.Body.String())
+
+	// Counted once, the response is not stored
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.KeyErrors.WithLabelValues("eth_getTransactionByHash")))
+	assert.Empty(t, store.results)
+}
+
+func TestAbsentBlockDefaults(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x01"}`))
+	}))
+	defer upstream.Close()
+
+	sendRequest := func(h *Handler, params string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getStorageAt","params":`+params+`,"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	// By default, an absent block param stands for latest
+	store := newMemoryStore()
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+	sendRequest(h, `["0xabc","0x0"]`)
+	assert.Empty(t, store.results)
+
+	store = newMemoryStore()
+	h, err = NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL: upstream.URL,
+		// Keyed in lower case, like viper does
+		AbsentBlockDefaults: map[string]string{"eth_getstorageat": "0x0"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "MISS", sendRequest(h, `["0xabc","0x0"]`))
+	assert.Len(t, store.results, 1)
+	// The call on that block shares the entry
+	assert.Equal(t, "HIT", sendRequest(h, `["0xabc","0x0","0x0"]`))
+
+	// Tags would never be cached
+	for _, block := range []string{"earliest", "latest", "0xzz", "12"} {
+		_, err := NewHandler(zap.NewNop(), nil, nil, config.Config{
+			UpstreamURL:         upstream.URL,
+			AbsentBlockDefaults: map[string]string{"eth_getstorageat": block},
+		})
+		assert.Error(t, err, block)
+	}
+}
+
+// countingStore keeps results in memory and counts the reads, of results
+// and of headers.
+type countingStore struct {
+	*memoryStore
+	reads       atomic.Int32
+	headerReads atomic.Int32
+}
+
+func (s *countingStore) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	s.reads.Add(1)
+	return s.memoryStore.GetCachedRPCResultWithParams(ctx, key)
+}
+
+func (s *countingStore) GetCachedHeaders(ctx context.Context, key string) ([]byte, error) {
+	s.headerReads.Add(1)
+	return s.memoryStore.GetCachedHeaders(ctx, key)
+}
+
+func TestDedupeCache(t *testing.T) {
+	var requestCount atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Node-Version", "1.2.3")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	store := &countingStore{memoryStore: newMemoryStore()}
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:           upstream.URL,
+		DedupeCacheSize:       10,
+		DedupeWindow:          time.Minute,
+		CachedResponseHeaders: []string{"X-Node-Version"},
+	})
+	require.NoError(t, err)
+
+	sendRequest := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	rec := sendRequest()
+	assert.Equal(t, "MISS", rec.Header().Get(CacheStatusHeader))
+
+	// The retries are answered without reading the database, headers
+	// included
+	for range 3 {
+		rec = sendRequest()
+		assert.Equal(t, "HIT", rec.Header().Get(CacheStatusHeader))
+		assert.Equal(t, "1.2.3", rec.Header().Get("X-Node-Version"))
+		assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`, rec.Body.String())
+	}
+	assert.Equal(t, int32(1), store.reads.Load())
+	assert.Equal(t, int32(0), store.headerReads.Load())
+	assert.Equal(t, int32(1), requestCount.Load())
+}
+
+func TestDedupeCacheSkipsStaleEntries(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	store := &agedStore{result: []byte(`{"hash":"0x123"}`), age: time.Hour}
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:          upstream.URL,
+		StaleWhileRevalidate: true,
+		FreshnessWindow:      time.Minute,
+		DedupeCacheSize:      10,
+		DedupeWindow:         time.Minute,
+	})
+	require.NoError(t, err)
+
+	// A stale entry is served stale again rather than from the dedupe cache
+	for range 2 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "STALE", rec.Header().Get(CacheStatusHeader))
+	}
+}
+
+// refreshFailingStore fails to refresh the entries
+type refreshFailingStore struct {
+	*countingStore
+}
+
+func (s *refreshFailingStore) RefreshCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	return errors.New("database unavailable")
+}
+
+func TestDedupeCacheForgetsFailedRefresh(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	store := &refreshFailingStore{&countingStore{memoryStore: newMemoryStore()}}
+	h, err := NewHandler(zap.NewNop(), store, nil, config.Config{
+		UpstreamURL:            upstream.URL,
+		AllowCacheBypassHeader: true,
+		DedupeCacheSize:        10,
+		DedupeWindow:           time.Minute,
+	})
+	require.NoError(t, err)
+
+	sendRequest := func(refresh bool) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`))
+		if refresh {
+			req.Header.Set(CacheBypassHeader, "true")
+			req.Header.Set(CacheRefreshHeader, "true")
+		}
+		h.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec
+	}
+
+	assert.Equal(t, "MISS", sendRequest(false).Header().Get(CacheStatusHeader))
+	assert.Equal(t, "HIT", sendRequest(false).Header().Get(CacheStatusHeader))
+	assert.Equal(t, int32(1), store.reads.Load())
+
+	// The refresh was not written, the entry is read again from the database
+	sendRequest(true)
+	assert.Equal(t, "HIT", sendRequest(false).Header().Get(CacheStatusHeader))
+	assert.Equal(t, int32(2), store.reads.Load())
+}
+
+func TestEntryUpstream(t *testing.T) {
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{Upstreams: []config.Upstream{
+		{ID: "a", URL: "http://a.invalid"},
+		{ID: "b", URL: "http://b.invalid"},
+	}})
+	require.NoError(t, err)
+
+	method, params := "eth_getTransactionReceipt", json.RawMessage(`["0x123"]`)
+	key, err := h.cacheKey(h.upstreams[1], method, params)
+	require.NoError(t, err)
+	stored, err := h.keys.NormalizeParams(h.keyParams(method, params))
+	require.NoError(t, err)
+
+	u, ok := h.EntryUpstream(database.CacheEntry{Key: key, Method: method, Params: stored})
+	require.True(t, ok)
+	assert.Equal(t, "b", u.ID)
+
+	// Without the params, the partition cannot be told
+	_, ok = h.EntryUpstream(database.CacheEntry{Key: key, Method: method})
+	assert.False(t, ok)
+	_, ok = h.EntryUpstream(database.CacheEntry{Key: "other", Method: method, Params: stored})
+	assert.False(t, ok)
+}
+
+func TestEnableMethodCaching(t *testing.T) {
+	var requestCount atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x6080"}`))
+	}))
+	defer upstream.Close()
+
+	h, err := NewHandler(zap.NewNop(), newMemoryStore(), nil, config.Config{UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+	admin := chi.NewRouter()
+	admin.Post("/cache/config/method/{method}", h.ServeMethodCaching)
+
+	enable := func(method string) int {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cache/config/method/"+method, strings.NewReader(`{"enabled":true}`)))
+		return rec.Code
+	}
+	sendRequest := func(block string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getCode","params":["0xabc","`+block+`"],"id":1}`)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(CacheStatusHeader)
+	}
+
+	// Not cached by default
+	assert.Equal(t, "BYPASS", sendRequest("0x10"))
+
+	// Once enabled, cached at the blocks given by number only
+	require.Equal(t, http.StatusNoContent, enable("eth_getCode"))
+	assert.Equal(t, "MISS", sendRequest("0x10"))
+	assert.Equal(t, "HIT", sendRequest("0x10"))
+	assert.Equal(t, "BYPASS", sendRequest("latest"))
+	assert.Equal(t, int32(3), requestCount.Load())
+
+	// A method which can never be cached cannot be enabled
+	assert.Equal(t, http.StatusBadRequest, enable("eth_blockNumber"))
+}
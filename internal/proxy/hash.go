@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// hasher computes the digest a cache key is derived from.
+type hasher func(data []byte) []byte
+
+// xxhashSeed seeds the second half of the 128-bit xxhash digest.
+const xxhashSeed = 0x9e3779b97f4a7c15
+
+// newHasher returns the hasher for the configured algorithm. The
+// non-cryptographic xxhash digest is widened to 128 bits, by combining two
+// differently seeded 64-bit hashes, to keep accidental collisions unlikely
+// for large caches.
+func newHasher(algorithm string) (hasher, error) {
+	switch algorithm {
+	case "", "sha256":
+		return func(data []byte) []byte {
+			sum := sha256.Sum256(data)
+			return sum[:]
+		}, nil
+	case "blake3":
+		return func(data []byte) []byte {
+			sum := blake3.Sum256(data)
+			return sum[:]
+		}, nil
+	case "xxhash":
+		return func(data []byte) []byte {
+			seeded := xxhash.NewWithSeed(xxhashSeed)
+			seeded.Write(data)
+			sum := make([]byte, 16)
+			binary.BigEndian.PutUint64(sum[:8], xxhash.Sum64(data))
+			binary.BigEndian.PutUint64(sum[8:], seeded.Sum64())
+			return sum
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported cache key hash algorithm %q", algorithm)
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKeyHashers(t *testing.T) {
+	params := []json.RawMessage{
+		json.RawMessage(`["0x123"]`),
+		json.RawMessage(`["0x124"]`),
+		json.RawMessage(`[{"fromBlock":"0x1","toBlock":"0x2"}]`),
+	}
+
+	keysByAlgorithm := map[string][]string{}
+	for _, algorithm := range []string{"sha256", "blake3", "xxhash"} {
+		hash, err := newHasher(algorithm)
+		require.NoError(t, err, "algorithm: %s", algorithm)
+
+		seen := map[string]bool{}
+		for _, p := range params {
+			key, err := generateCacheKey(hash, "", "eth_call", p)
+			require.NoError(t, err)
+
+			// Keys are stable for a given algorithm
+			again, err := generateCacheKey(hash, "", "eth_call", p)
+			require.NoError(t, err)
+			assert.Equal(t, key, again, "algorithm: %s", algorithm)
+
+			// Keys are distinct per input
+			assert.False(t, seen[key], "algorithm: %s, params: %s", algorithm, p)
+			seen[key] = true
+			keysByAlgorithm[algorithm] = append(keysByAlgorithm[algorithm], key)
+		}
+	}
+
+	// The default algorithm is sha256
+	hash, err := newHasher("")
+	require.NoError(t, err)
+	key, err := generateCacheKey(hash, "", "eth_call", params[0])
+	require.NoError(t, err)
+	assert.Equal(t, keysByAlgorithm["sha256"][0], key)
+
+	// xxhash keys are widened to 128 bits
+	assert.Len(t, keysByAlgorithm["xxhash"][0], 32)
+
+	_, err = newHasher("md5")
+	assert.Error(t, err)
+}
+
+func BenchmarkCacheKeyHashers(b *testing.B) {
+	// A large eth_call payload
+	params := json.RawMessage(fmt.Sprintf(`[{"to":"0x123","data":"0x%s"},"0x1"]`, strings.Repeat("ab", 16*1024)))
+
+	for _, algorithm := range []string{"sha256", "blake3", "xxhash"} {
+		hash, err := newHasher(algorithm)
+		require.NoError(b, err)
+
+		b.Run(algorithm, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := generateCacheKey(hash, "", "eth_call", params); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyParamsCacheKey(t *testing.T) {
+	generator, err := NewDefaultKeyGenerator("")
+	require.NoError(t, err)
+	h := &Handler{keys: generator}
+
+	// Empty, null and absent params are the same call
+	keys := map[string]bool{}
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":1}`,
+		`{"jsonrpc":"2.0","method":"eth_chainId","params":[ ],"id":1}`,
+		`{"jsonrpc":"2.0","method":"eth_chainId","params":null,"id":1}`,
+		`{"jsonrpc":"2.0","method":"eth_chainId","id":1}`,
+	} {
+		var req JSONRPCRequest
+		require.NoError(t, json.Unmarshal([]byte(body), &req))
+		key, err := h.cacheKey(config.Upstream{}, req.Method, req.Params)
+		require.NoError(t, err, "body: %s", body)
+		keys[key] = true
+
+		// The stored params match as well
+		params, err := normalizeParams(req.Params)
+		require.NoError(t, err)
+		assert.Equal(t, "[]", string(params), "body: %s", body)
+	}
+	assert.Len(t, keys, 1)
+}
+
+func TestTraceConfigCacheKey(t *testing.T) {
+	generator, err := NewDefaultKeyGenerator("")
+	require.NoError(t, err)
+	h := &Handler{keys: generator}
+
+	key := func(params string) string {
+		key, err := h.cacheKey(config.Upstream{}, "debug_traceTransaction", json.RawMessage(params))
+		require.NoError(t, err)
+		return key
+	}
+
+	callTracer := key(`["0x123",{"tracer":"callTracer","tracerConfig":{"onlyTopCall":true,"withLog":false}}]`)
+
+	// Equivalent configs share the entry
+	assert.Equal(t, callTracer, key(`["0x123",{"tracerConfig":{"withLog":false,"onlyTopCall":true},"tracer":"callTracer"}]`))
+	assert.Equal(t, callTracer, key(`["0x123",{"tracer":"callTracer","timeout":"10s","tracerConfig":{"onlyTopCall":true,"withLog":false}}]`))
+	assert.Equal(t, key(`["0x123",{"tracer":"prestateTracer"}]`), key(`["0x123",{"tracer":"prestateTracer","tracerConfig":{}}]`))
+	assert.Equal(t, key(`["0x123"]`), key(`["0x123",{"timeout":"5s","tracerConfig":null}]`))
+
+	// Differing configs do not
+	assert.NotEqual(t, callTracer, key(`["0x123",{"tracer":"callTracer","tracerConfig":{"onlyTopCall":false,"withLog":false}}]`))
+	assert.NotEqual(t, callTracer, key(`["0x123",{"tracer":"prestateTracer","tracerConfig":{"onlyTopCall":true,"withLog":false}}]`))
+	assert.NotEqual(t, callTracer, key(`["0x123"]`))
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// cachedHeaders is the allow-list of upstream response headers stored along
+// with the cached responses and replayed on hits. Only the first value of a
+// header is kept. An empty list disables it.
+type cachedHeaders []string
+
+func newCachedHeaders(names []string) cachedHeaders {
+	var headers cachedHeaders
+	for _, name := range names {
+		headers = append(headers, http.CanonicalHeaderKey(name))
+	}
+	return headers
+}
+
+// capture encodes the allow-listed headers of an upstream response, nil if
+// none of them is set.
+func (c cachedHeaders) capture(header http.Header) []byte {
+	captured := make(map[string]string)
+	for _, name := range c {
+		if value := header.Get(name); value != "" {
+			captured[name] = value
+		}
+	}
+	if len(captured) == 0 {
+		return nil
+	}
+	encoded, _ := json.Marshal(captured)
+	return encoded
+}
+
+// replay sets the stored headers on w. Headers removed from the allow-list
+// since the entry was stored are not replayed.
+func (c cachedHeaders) replay(w http.ResponseWriter, stored []byte) {
+	if len(stored) == 0 {
+		return
+	}
+	var captured map[string]string
+	if err := json.Unmarshal(stored, &captured); err != nil {
+		return
+	}
+	for _, name := range c {
+		if value, ok := captured[name]; ok {
+			w.Header().Set(name, value)
+		}
+	}
+}
+
+// forward copies the allow-listed headers of an upstream response to w, so
+// that a miss carries the same headers as the hits it is then served from.
+func (c cachedHeaders) forward(w http.ResponseWriter, header http.Header) {
+	for _, name := range c {
+		if value := header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+}
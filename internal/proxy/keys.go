@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/clems4ever/ethereum-cache/internal/database"
+)
+
+// KeyGenerator derives the cache keys. The handler first applies the
+// method-specific normalizations, such as the encoding of block numbers,
+// then hands the params over to the generator.
+type KeyGenerator interface {
+	// CacheKey returns the key of a call of method with params. A non-empty
+	// namespace must map identical calls to distinct keys.
+	CacheKey(namespace string, method string, params json.RawMessage) (string, error)
+	// NormalizeParams returns the encoding of params the key is derived
+	// from. It is stored along with the entries to detect key collisions,
+	// equal keys must have equal normalized params.
+	NormalizeParams(params json.RawMessage) ([]byte, error)
+}
+
+// defaultKeyGenerator hashes the method and its params, normalized to be
+// independent of whitespace and object key ordering.
+type defaultKeyGenerator struct {
+	hash hasher
+}
+
+// NewDefaultKeyGenerator returns the key generator used unless another one is
+// injected, hashing with the given cache_key_hash algorithm. Custom
+// generators may wrap it to only adjust some keys.
+func NewDefaultKeyGenerator(algorithm string) (KeyGenerator, error) {
+	hash, err := newHasher(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return defaultKeyGenerator{hash: hash}, nil
+}
+
+func (g defaultKeyGenerator) CacheKey(namespace string, method string, params json.RawMessage) (string, error) {
+	return generateCacheKey(g.hash, namespace, method, params)
+}
+
+func (defaultKeyGenerator) NormalizeParams(params json.RawMessage) ([]byte, error) {
+	return normalizeParams(params)
+}
+
+// storedParams returns what is stored of the normalized params of an entry:
+// the params themselves, or their digest when they are longer than maxBytes,
+// so that verify_cache_key does not make the rows grow with the params.
+func storedParams(params []byte, maxBytes int64) []byte {
+	if maxBytes <= 0 || int64(len(params)) <= maxBytes {
+		return params
+	}
+	digest := sha256.Sum256(params)
+	return []byte(database.ParamsDigestPrefix + hex.EncodeToString(digest[:]))
+}
+
+// matchesStoredParams returns whether params are the ones stored, either as
+// is or as a digest. The digests are recognized whatever the current limit,
+// normalized params being JSON.
+func matchesStoredParams(params []byte, stored []byte) bool {
+	if digest, ok := bytes.CutPrefix(stored, []byte(database.ParamsDigestPrefix)); ok {
+		sum := sha256.Sum256(params)
+		return hex.EncodeToString(sum[:]) == string(digest)
+	}
+	return bytes.Equal(params, stored)
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import "strings"
+
+// methodFilter restricts the methods that are served. When allowed is set it
+// takes precedence and denied is ignored. Patterns ending with "*" match any
+// method with the preceding prefix, e.g. "debug_*".
+type methodFilter struct {
+	allowed []string
+	denied  []string
+}
+
+func (f methodFilter) allows(method string) bool {
+	if len(f.allowed) > 0 {
+		return matchesAny(f.allowed, method)
+	}
+	return !matchesAny(f.denied, method)
+}
+
+func matchesAny(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(method, prefix) {
+				return true
+			}
+		} else if pattern == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// cachingOverrides enables or disables caching per method at runtime, on top
+// of the static cacheability rules. Overrides are kept in memory only and are
+// lost on restart.
+type cachingOverrides struct {
+	mu      sync.RWMutex
+	methods map[string]bool
+}
+
+func (o *cachingOverrides) get(method string) (enabled bool, ok bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	enabled, ok = o.methods[method]
+	return enabled, ok
+}
+
+func (o *cachingOverrides) set(method string, enabled bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.methods == nil {
+		o.methods = make(map[string]bool)
+	}
+	o.methods[method] = enabled
+}
+
+// canEnable returns true when enabling the caching of method has an effect:
+// the method is either cacheable whatever its params or addresses a block by
+// number.
+func canEnable(method string) bool {
+	if _, ok := blockParamIndex(method); ok {
+		return true
+	}
+	return method == "trace_transaction" || isCacheable(method, nil)
+}
+
+func (o *cachingOverrides) unset(method string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.methods, method)
+}
+
+type methodCachingRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// ServeMethodCaching overrides the caching of the method path parameter: a
+// POST with {"enabled": false} stops caching it, {"enabled": true} caches it
+// even when disabled by the configuration, and a DELETE restores the
+// configured behavior. Entries already cached are not removed. Enabling a
+// method which cannot be cached is rejected.
+func (h *Handler) ServeMethodCaching(w http.ResponseWriter, r *http.Request) {
+	method := chi.URLParam(r, "method")
+
+	if r.Method == http.MethodDelete {
+		h.overrides.unset(method)
+		h.logger.Info("method caching override removed", zap.String("rpc_method", method))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var req methodCachingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		http.Error(w, "expected a body of the form {\"enabled\": bool}", http.StatusBadRequest)
+		return
+	}
+	if *req.Enabled && !canEnable(method) {
+		http.Error(w, fmt.Sprintf("caching of %s cannot be enabled", method), http.StatusBadRequest)
+		return
+	}
+	h.overrides.set(method, *req.Enabled)
+	h.logger.Info("method caching overridden", zap.String("rpc_method", method), zap.Bool("enabled", *req.Enabled))
+	w.WriteHeader(http.StatusNoContent)
+}
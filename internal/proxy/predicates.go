@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// resultPredicates lists, per lower-cased method, the paths that must be set
+// in a result for it to be cached, so that pending or incomplete results are
+// not. A path is a dot-separated list of object members and array indexes,
+// e.g. blockNumber or 0.blockNumber.
+type resultPredicates map[string][][]string
+
+func newResultPredicates(required map[string][]string) resultPredicates {
+	predicates := make(resultPredicates, len(required))
+	// Keyed by lower-cased method name since viper lower-cases map keys
+	for method, paths := range required {
+		for _, path := range paths {
+			predicates[strings.ToLower(method)] = append(predicates[strings.ToLower(method)], strings.Split(path, "."))
+		}
+	}
+	return predicates
+}
+
+// satisfied returns false when one of the paths required for method is
+// missing or null in result.
+func (p resultPredicates) satisfied(method string, result json.RawMessage) bool {
+	for _, path := range p[strings.ToLower(method)] {
+		if !hasPath(result, path) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasPath(value json.RawMessage, path []string) bool {
+	for _, segment := range path {
+		if index, err := strconv.Atoi(segment); err == nil {
+			var items []json.RawMessage
+			if json.Unmarshal(value, &items) != nil || index < 0 || index >= len(items) {
+				return false
+			}
+			value = items[index]
+			continue
+		}
+		var members map[string]json.RawMessage
+		if json.Unmarshal(value, &members) != nil {
+			return false
+		}
+		var ok bool
+		if value, ok = members[segment]; !ok {
+			return false
+		}
+	}
+	return string(value) != "null"
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// Storage keys of eth_getProof calls can be canonicalized in cache keys so
+// that calls requesting the same keys in a different order share an entry.
+//
+// This is correct because, per EIP-1186, the account part of the result
+// (balance, nonce, codeHash, storageHash and accountProof) does not depend on
+// the storage keys at all, and each storageProof item only depends on its own
+// key, which it carries in its key field. The requested order is only
+// reflected by the order of the storageProof items. Entries are therefore
+// stored with their storageProof in the canonical, sorted, key order and
+// reordered to the requested order when served. A cached result whose items
+// cannot all be matched to the requested keys is treated as a miss.
+
+// canonicalProofParams returns the params of an eth_getProof call with its
+// storage keys sorted, or params as is when they are not of the expected
+// [address, storageKeys, blockNumber] form.
+func canonicalProofParams(params json.RawMessage) json.RawMessage {
+	var args []json.RawMessage
+	if err := json.Unmarshal(params, &args); err != nil || len(args) < 2 {
+		return params
+	}
+	var keys []string
+	if err := json.Unmarshal(args[1], &keys); err != nil {
+		return params
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return strings.Compare(normalizeStorageKey(a), normalizeStorageKey(b))
+	})
+
+	sorted, err := json.Marshal(keys)
+	if err != nil {
+		return params
+	}
+	args[1] = sorted
+	canonical, err := json.Marshal(args)
+	if err != nil {
+		return params
+	}
+	return canonical
+}
+
+// proofStorageKeys returns the storage keys requested by eth_getProof params.
+func proofStorageKeys(params json.RawMessage) ([]string, bool) {
+	var args []json.RawMessage
+	if err := json.Unmarshal(params, &args); err != nil || len(args) < 2 {
+		return nil, false
+	}
+	var keys []string
+	if err := json.Unmarshal(args[1], &keys); err != nil {
+		return nil, false
+	}
+	return keys, true
+}
+
+// reorderStorageProof returns result with its storageProof items in the order
+// of keys. It returns false if an item is missing for a key.
+func reorderStorageProof(result json.RawMessage, keys []string) (json.RawMessage, bool) {
+	var proof map[string]json.RawMessage
+	if err := json.Unmarshal(result, &proof); err != nil {
+		return nil, false
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(proof["storageProof"], &items); err != nil {
+		return nil, false
+	}
+
+	byKey := make(map[string]json.RawMessage, len(items))
+	for _, item := range items {
+		var storage struct {
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(item, &storage); err != nil {
+			return nil, false
+		}
+		byKey[normalizeStorageKey(storage.Key)] = item
+	}
+
+	ordered := make([]json.RawMessage, len(keys))
+	for i, key := range keys {
+		item, ok := byKey[normalizeStorageKey(key)]
+		if !ok {
+			return nil, false
+		}
+		ordered[i] = item
+	}
+
+	var err error
+	if proof["storageProof"], err = json.Marshal(ordered); err != nil {
+		return nil, false
+	}
+	reordered, err := json.Marshal(proof)
+	if err != nil {
+		return nil, false
+	}
+	return reordered, true
+}
+
+// normalizeStorageKey maps the different encodings of a storage key, with or
+// without leading zeros, to the same string.
+func normalizeStorageKey(key string) string {
+	key = strings.TrimLeft(strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(key, "0x"), "0X")), "0")
+	return "0x" + key
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader carries the id correlating a request across services. It
+// is echoed on the responses and forwarded to the upstream.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the id of the request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the id of the request of ctx, empty if none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the logger of the request of ctx, tagged with its id.
+func (h *Handler) requestLogger(ctx context.Context) *zap.Logger {
+	if id := RequestID(ctx); id != "" {
+		return h.logger.With(zap.String("request_id", id))
+	}
+	return h.logger
+}
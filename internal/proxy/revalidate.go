@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"go.uber.org/zap"
+)
+
+const revalidateTimeout = 30 * time.Second
+
+// isStale returns true when a cached entry is past its freshness window and
+// must be revalidated in the background.
+func (h *Handler) isStale(age time.Duration) bool {
+	return h.staleWhileRevalidate && age > h.freshnessWindow
+}
+
+// isExpired returns true when a cached entry is past both its freshness and
+// staleness windows and can no longer be served. A zero staleness window
+// means stale entries are served for ever.
+func (h *Handler) isExpired(age time.Duration) bool {
+	return h.isStale(age) && h.stalenessWindow > 0 && age > h.freshnessWindow+h.stalenessWindow
+}
+
+// revalidate refetches a stale entry from the upstream in the background.
+// Concurrent revalidations of the same key are collapsed into a single
+// upstream call.
+func (h *Handler) revalidate(upstream config.Upstream, req JSONRPCRequest, key string, body []byte) {
+	go h.revalidations.Do(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+		defer cancel()
+
+		if err := h.waitForLimiter(ctx, req.Method); err != nil {
+			h.logger.Warn("upstream rate limit exceeded during revalidation", zap.Error(err))
+			return nil, err
+		}
+
+		upstreamReq, err := h.newUpstreamRequest(ctx, upstream, body)
+		if err != nil {
+			h.logger.Error("failed to create upstream revalidation request", zap.Error(err))
+			return nil, err
+		}
+
+		upstreamResp, err := h.doUpstream(upstreamReq)
+		if err != nil {
+			h.logger.Error("upstream error during revalidation", zap.Error(err))
+			return nil, err
+		}
+		defer upstreamResp.Body.Close()
+
+		respBody, err := readUpstreamBody(upstreamResp)
+		if err != nil {
+			h.logger.Error("failed to read upstream revalidation response", zap.Error(err))
+			return nil, err
+		}
+
+		h.storeResult(ctx, upstream, req, h.minify(respBody), h.cachedHeaders.capture(upstreamResp.Header), true)
+		return nil, nil
+	})
+}
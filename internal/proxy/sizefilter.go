@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+)
+
+const (
+	// sizeWindow is the number of recent result sizes kept per method
+	sizeWindow = 256
+	// sizeMinSamples is the number of sizes of a method needed before its
+	// results are filtered
+	sizeMinSamples = 100
+	// sizePercentile is the percentile of the recent sizes above which a
+	// result is not cached
+	sizePercentile = 0.99
+)
+
+// sizeFilter skips caching the results that are anomalously large compared
+// to the recent results of the same method, so that a few outliers do not
+// take a disproportionate share of the cache. A nil filter allows every
+// result.
+type sizeFilter struct {
+	mu      sync.Mutex
+	methods map[string]*sizeRing
+}
+
+// sizeRing holds the last sizeWindow result sizes of a method.
+type sizeRing struct {
+	sizes []int
+	next  int
+}
+
+func newSizeFilter(enabled bool) *sizeFilter {
+	if !enabled {
+		return nil
+	}
+	return &sizeFilter{methods: make(map[string]*sizeRing)}
+}
+
+// allow records the size of a result of method and returns false when it is
+// above the percentile of the previous results.
+func (f *sizeFilter) allow(method string, size int) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ring, ok := f.methods[method]
+	if !ok {
+		ring = &sizeRing{sizes: make([]int, 0, sizeWindow)}
+		f.methods[method] = ring
+		// Only cacheable methods are tracked, the rings are bounded
+		metrics.InternalMemoryBytes.Add(float64(sizeWindow * 8))
+	}
+
+	allowed := true
+	if len(ring.sizes) >= sizeMinSamples {
+		sorted := slices.Clone(ring.sizes)
+		slices.Sort(sorted)
+		allowed = size <= sorted[int(float64(len(sorted)-1)*sizePercentile)]
+	}
+
+	// Outliers are recorded too so that a lasting change of the sizes
+	// becomes the norm
+	if len(ring.sizes) < sizeWindow {
+		ring.sizes = append(ring.sizes, size)
+	} else {
+		ring.sizes[ring.next] = size
+		ring.next = (ring.next + 1) % sizeWindow
+	}
+	return allowed
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+type cacheStatsResponse struct {
+	// EntriesBySource counts the entries per source: client for live misses,
+	// import for entries loaded from a dump.
+	EntriesBySource map[string]int64 `json:"entries_by_source"`
+}
+
+// ServeCacheStats returns statistics about the cached entries.
+func (h *Handler) ServeCacheStats(w http.ResponseWriter, r *http.Request) {
+	counts, err := h.db.GetCacheItemCountBySource(r.Context())
+	if err != nil {
+		h.logger.Error("failed to get cache stats", zap.Error(err))
+		http.Error(w, "failed to get cache stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(cacheStatsResponse{EntriesBySource: counts})
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/database"
+)
+
+// Store is the storage the handler caches responses in. It is implemented by
+// *database.DB.
+type Store interface {
+	GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error)
+	GetCacheEntry(ctx context.Context, key string) (*database.CacheEntry, error)
+	SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error
+	RefreshCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error
+	SetCachedHeaders(ctx context.Context, key string, headers []byte) error
+	GetCachedHeaders(ctx context.Context, key string) ([]byte, error)
+	ExportCacheEntries(ctx context.Context, fn func(database.CacheEntry) error) error
+	ImportCacheEntries(ctx context.Context, entries []database.CacheEntry, source string) (int64, error)
+	GetCacheItemCountBySource(ctx context.Context) (map[string]int64, error)
+	SetBlockNumberForTx(ctx context.Context, txHash string, blockNumber uint64) error
+	GetBlockNumberForTx(ctx context.Context, txHash string) (uint64, bool, error)
+	TrackBlockEntry(ctx context.Context, key string, blockNumber uint64, blockHash string) error
+}
+
+var _ Store = (*database.DB)(nil)
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+)
+
+const (
+	// The default transport only keeps 2 idle connections per host, which
+	// forces new connections to the single upstream under concurrency.
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newUpstreamTransport returns the transport of the upstream client, sized to
+// reuse connections to the upstream, and going through upstream_proxy_url
+// when set.
+func newUpstreamTransport(cfg config.Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.UpstreamProxyURL != "" {
+		proxyURL, err := parseProxyURL(cfg.UpstreamProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream_proxy_url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if cfg.UpstreamMaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.UpstreamMaxIdleConnsPerHost
+	}
+	// Idle connections of all hosts are capped as well, keep room for the
+	// per-host ones
+	if transport.MaxIdleConns < transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = cfg.UpstreamMaxConnsPerHost
+
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+	if cfg.UpstreamIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = cfg.UpstreamIdleConnTimeout
+	}
+	return transport, nil
+}
+
+// NewUpstreamClient returns a client of the upstreams for the background
+// workers, with the transport of the proxied calls, and so their
+// upstream_proxy_url, and calls bounded by timeout.
+func NewUpstreamClient(cfg config.Config, timeout time.Duration) (*http.Client, error) {
+	transport, err := newUpstreamTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// parseProxyURL parses the URL of an egress proxy, of one of the schemes
+// supported by http.Transport. The URL may hold credentials, it must not
+// appear in the errors.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.New("malformed url")
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected http, https or socks5", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.New("missing host")
+	}
+	return proxyURL, nil
+}
+
+// inflightTransport counts the upstream calls in flight, from the request
+// until the response body is closed.
+type inflightTransport struct {
+	next http.RoundTripper
+}
+
+func (t inflightTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	metrics.InflightUpstreamRequests.Inc()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		metrics.InflightUpstreamRequests.Dec()
+		return nil, err
+	}
+	resp.Body = &inflightBody{ReadCloser: resp.Body}
+	return resp, nil
+}
+
+type inflightBody struct {
+	io.ReadCloser
+	once sync.Once
+}
+
+func (b *inflightBody) Close() error {
+	b.once.Do(metrics.InflightUpstreamRequests.Dec)
+	return b.ReadCloser.Close()
+}
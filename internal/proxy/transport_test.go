@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/reorg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestUpstreamTransport(t *testing.T) {
+	transport, err := newUpstreamTransport(config.Config{})
+	require.NoError(t, err)
+	assert.Equal(t, defaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 0, transport.MaxConnsPerHost)
+	assert.Equal(t, defaultIdleConnTimeout, transport.IdleConnTimeout)
+
+	transport, err = newUpstreamTransport(config.Config{
+		UpstreamMaxIdleConnsPerHost: 500,
+		UpstreamMaxConnsPerHost:     600,
+		UpstreamIdleConnTimeout:     time.Minute,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 500, transport.MaxIdleConnsPerHost)
+	assert.GreaterOrEqual(t, transport.MaxIdleConns, 500)
+	assert.Equal(t, 600, transport.MaxConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+}
+
+func TestUpstreamConnectionReuse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// Count the connections opened to the upstream
+	var dials int32
+	transport, err := newUpstreamTransport(config.Config{})
+	require.NoError(t, err)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return dial(ctx, network, addr)
+	}
+	client := &http.Client{Transport: transport}
+
+	for i := 0; i < 10; i++ {
+		resp, err := client.Post(upstream.URL, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	// The proxy answers in place of the upstream, which cannot be resolved
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer proxy.Close()
+
+	h, err := NewHandler(zap.NewNop(), nil, nil, config.Config{
+		UpstreamURL:      "http://node.invalid/rpc",
+		UpstreamProxyURL: proxy.URL,
+	})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, rec.Body.String())
+	assert.Equal(t, "http://node.invalid/rpc", proxied.Load())
+
+	for _, proxyURL := range []string{"ftp://proxy:21", "socks5://", "http://%zz"} {
+		_, err := NewHandler(zap.NewNop(), nil, nil, config.Config{UpstreamURL: "http://node.invalid", UpstreamProxyURL: proxyURL})
+		assert.Error(t, err, proxyURL)
+	}
+}
+
+// trackingStore records the blocks the reorg watcher looks up
+type trackingStore struct {
+	looked atomic.Bool
+}
+
+func (s *trackingStore) GetTrackedBlockNumbers(ctx context.Context, fromBlock uint64) ([]uint64, error) {
+	s.looked.Store(true)
+	return nil, nil
+}
+
+func (s *trackingStore) DeleteNonCanonicalEntries(ctx context.Context, blockNumber uint64, canonicalHash string) (int64, error) {
+	return 0, nil
+}
+
+func (s *trackingStore) ForgetTrackedBlocksBefore(ctx context.Context, blockNumber uint64) error {
+	return nil
+}
+
+func TestUpstreamClientProxy(t *testing.T) {
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x100"}`))
+	}))
+	defer proxy.Close()
+
+	client, err := NewUpstreamClient(config.Config{UpstreamProxyURL: proxy.URL}, time.Second)
+	require.NoError(t, err)
+
+	// The reorg watcher only reaches the upstream through the proxy
+	store := &trackingStore{}
+	watcher := reorg.New(zap.NewNop(), store, []string{"http://node.invalid/rpc"}, nil, client, 10*time.Millisecond, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watcher.Start(ctx)
+
+	require.Eventually(t, store.looked.Load, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "http://node.invalid/rpc", proxied.Load())
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// isTxLookup returns true for the methods whose first param is a transaction
+// hash and whose result carries the block number of the transaction.
+func isTxLookup(method string) bool {
+	return method == "eth_getTransactionByHash" || method == "eth_getTransactionReceipt"
+}
+
+func txHashParam(params json.RawMessage) (string, bool) {
+	var args []interface{}
+	if err := json.Unmarshal(params, &args); err != nil || len(args) == 0 {
+		return "", false
+	}
+	hash, ok := args[0].(string)
+	return hash, ok
+}
+
+// resultBlock extracts the blockNumber and blockHash fields of a result
+// object. The hash is empty when the result does not carry one. Block
+// receipts carry the block of their first receipt.
+func resultBlock(result json.RawMessage) (uint64, string, bool) {
+	var receipts []json.RawMessage
+	if json.Unmarshal(result, &receipts) == nil {
+		if len(receipts) == 0 {
+			return 0, "", false
+		}
+		result = receipts[0]
+	}
+	var ref struct {
+		BlockNumber *string `json:"blockNumber"`
+		BlockHash   string  `json:"blockHash"`
+	}
+	if err := json.Unmarshal(result, &ref); err != nil || ref.BlockNumber == nil {
+		// Pending transactions have no block number yet
+		return 0, "", false
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(*ref.BlockNumber, "0x"), 16, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return n, ref.BlockHash, true
+}
+
+// indexTxBlock records the block number of a transaction returned by a tx
+// lookup so that its block context can later be resolved without an
+// upstream call.
+func (h *Handler) indexTxBlock(ctx context.Context, req JSONRPCRequest, result json.RawMessage) {
+	hash, ok := txHashParam(req.Params)
+	if !ok {
+		return
+	}
+	blockNumber, _, ok := resultBlock(result)
+	if !ok {
+		return
+	}
+	if err := h.db.SetBlockNumberForTx(ctx, hash, blockNumber); err != nil {
+		h.logger.Error("failed to index tx block number", zap.Error(err))
+	}
+}
+
+// knownTxBlock resolves the block number of a transaction from the index.
+func (h *Handler) knownTxBlock(ctx context.Context, req JSONRPCRequest) (uint64, bool) {
+	hash, ok := txHashParam(req.Params)
+	if !ok {
+		return 0, false
+	}
+	blockNumber, found, err := h.db.GetBlockNumberForTx(ctx, hash)
+	if err != nil {
+		h.logger.Error("failed to resolve tx block number", zap.Error(err))
+		return 0, false
+	}
+	return blockNumber, found
+}
+
+// trackBlock records the block a cached result was derived from so that the
+// reorg watcher can invalidate it.
+func (h *Handler) trackBlock(ctx context.Context, key string, result json.RawMessage) {
+	blockNumber, blockHash, ok := resultBlock(result)
+	if !ok || blockHash == "" {
+		return
+	}
+	if err := h.db.TrackBlockEntry(ctx, key, blockNumber, blockHash); err != nil {
+		h.logger.Error("failed to track block entry", zap.Error(err))
+	}
+}
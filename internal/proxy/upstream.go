@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"math/rand/v2"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/database"
+)
+
+// UpstreamHeader tells the client which upstream served the request when
+// several upstreams are configured.
+const UpstreamHeader = "X-Upstream"
+
+// pickUpstream picks the upstream of a request at random, in proportion of
+// the upstream weights.
+func (h *Handler) pickUpstream() config.Upstream {
+	if len(h.upstreams) == 1 {
+		return h.upstreams[0]
+	}
+	n := rand.IntN(h.totalWeight)
+	for _, u := range h.upstreams {
+		if n < u.Weight {
+			return u
+		}
+		n -= u.Weight
+	}
+	return h.upstreams[len(h.upstreams)-1]
+}
+
+// upstreamByID returns the upstream with the given id, falling back to the
+// first upstream when id is empty.
+func (h *Handler) upstreamByID(id string) (config.Upstream, bool) {
+	if id == "" {
+		return h.upstreams[0], true
+	}
+	for _, u := range h.upstreams {
+		if u.ID == id {
+			return u, true
+		}
+	}
+	return config.Upstream{}, false
+}
+
+// cacheNamespace returns the namespace of the cache partition of upstream u.
+// The upstream id is appended after a separator that neither the chain
+// namespace nor the ids contain, so that partitions cannot collide.
+func (h *Handler) cacheNamespace(u config.Upstream) string {
+	if u.ID == "" {
+		return h.chainNamespace
+	}
+	return h.chainNamespace + config.NamespaceSeparator + u.ID
+}
+
+// EntryUpstream returns the upstream whose cache partition holds entry, found
+// by deriving the key of its stored params in every partition. It returns
+// false when the params are not stored in full or match no partition.
+func (h *Handler) EntryUpstream(entry database.CacheEntry) (config.Upstream, bool) {
+	if entry.Params == nil || bytes.HasPrefix(entry.Params, []byte(database.ParamsDigestPrefix)) {
+		return config.Upstream{}, false
+	}
+	for _, u := range h.upstreams {
+		key, err := h.cacheKey(u, entry.Method, entry.Params)
+		if err == nil && key == entry.Key {
+			return u, true
+		}
+	}
+	return config.Upstream{}, false
+}
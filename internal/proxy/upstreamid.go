@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// notificationID is the rendering of the absent id of a notification. No
+// valid id renders the same way: strings are quoted.
+const notificationID = "<notification>"
+
+// rewriteID replaces the id member of a request body with id so that the
+// upstream never sees the ids of the clients, which may collide.
+func rewriteID(body []byte, id uint64) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	members["id"] = json.RawMessage(strconv.FormatUint(id, 10))
+	return json.Marshal(members)
+}
+
+// restoreID puts the raw id of the client back into a response body of the
+// upstream.
+func restoreID(body []byte, id json.RawMessage) ([]byte, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, err
+	}
+	members["id"] = id
+	return json.Marshal(members)
+}
+
+// formatID renders a raw JSON-RPC id to a stable string for the logs: numbers
+// as received, strings quoted with canonical escapes so that they never
+// match a number, and null as null. Ids of another type are invalid and
+// rendered compacted.
+func formatID(id json.RawMessage) string {
+	if len(id) == 0 {
+		return notificationID
+	}
+	var s string
+	if id[0] == '"' && json.Unmarshal(id, &s) == nil {
+		quoted, _ := json.Marshal(s)
+		return string(quoted)
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, id); err != nil {
+		return string(id)
+	}
+	return buf.String()
+}
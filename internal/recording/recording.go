@@ -0,0 +1,179 @@
+package recording
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// recordQueueSize is the number of exchanges buffered before new ones are
+// dropped.
+const recordQueueSize = 1024
+
+// Exchange is a JSON-RPC call along with the response of the upstream, one
+// per line of a recording.
+type Exchange struct {
+	Method   string          `json:"method"`
+	Params   json.RawMessage `json:"params"`
+	Response json.RawMessage `json:"response"`
+}
+
+// Recorder appends the exchanges with the upstream to a NDJSON file. The
+// file is written in the background so that recording never blocks the
+// requests, exchanges are dropped when the writer cannot keep up. A nil
+// recorder records nothing.
+type Recorder struct {
+	logger    *zap.Logger
+	file      *os.File
+	exchanges chan Exchange
+	done      chan struct{}
+}
+
+func NewRecorder(logger *zap.Logger, path string) (*Recorder, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open record file: %w", err)
+	}
+	r := &Recorder{
+		logger:    logger,
+		file:      file,
+		exchanges: make(chan Exchange, recordQueueSize),
+		done:      make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Record queues an exchange to be written.
+func (r *Recorder) Record(method string, params json.RawMessage, response []byte) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.exchanges <- Exchange{Method: method, Params: params, Response: response}:
+	default:
+		r.logger.Warn("record queue full, dropping exchange", zap.String("method", method))
+	}
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	w := bufio.NewWriter(r.file)
+	encoder := json.NewEncoder(w)
+	for exchange := range r.exchanges {
+		if err := encoder.Encode(exchange); err != nil {
+			r.logger.Error("failed to record exchange", zap.Error(err))
+		}
+		// Flush once the queue is drained rather than on every exchange
+		if len(r.exchanges) == 0 {
+			if err := w.Flush(); err != nil {
+				r.logger.Error("failed to flush record file", zap.Error(err))
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		r.logger.Error("failed to flush record file", zap.Error(err))
+	}
+}
+
+// Close writes the queued exchanges and closes the file. Record must not be
+// called afterwards.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	close(r.exchanges)
+	<-r.done
+	return r.file.Close()
+}
+
+// ReplayTransport answers upstream requests from a recording instead of a
+// live node. Calls recorded several times are answered with their responses
+// in the recorded order, the last one being repeated once exhausted.
+type ReplayTransport struct {
+	mu        sync.Mutex
+	responses map[string][]json.RawMessage
+}
+
+func NewReplayTransport(path string) (*ReplayTransport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay file: %w", err)
+	}
+	defer file.Close()
+
+	responses := make(map[string][]json.RawMessage)
+	decoder := json.NewDecoder(file)
+	for {
+		var exchange Exchange
+		err := decoder.Decode(&exchange)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid replay file: %w", err)
+		}
+		key := replayKey(exchange.Method, exchange.Params)
+		responses[key] = append(responses[key], exchange.Response)
+	}
+	return &ReplayTransport{responses: responses}, nil
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request: %w", err)
+	}
+	var call struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(body, &call); err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	response := []byte(`{"jsonrpc":"2.0","id":null,"error":{"code":-32603,"message":"no recorded response"}}`)
+	key := replayKey(call.Method, call.Params)
+	t.mu.Lock()
+	if recorded := t.responses[key]; len(recorded) > 0 {
+		response = recorded[0]
+		if len(recorded) > 1 {
+			t.responses[key] = recorded[1:]
+		}
+	}
+	t.mu.Unlock()
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(response)),
+		ContentLength: int64(len(response)),
+		Request:       req,
+	}, nil
+}
+
+// replayKey matches calls regardless of the formatting of their params.
+func replayKey(method string, params json.RawMessage) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, params); err != nil {
+		return method + " " + strings.TrimSpace(string(params))
+	}
+	return method + " " + compact.String()
+}
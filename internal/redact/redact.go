@@ -0,0 +1,50 @@
+// Package redact hides the secrets upstream URLs commonly embed, such as the
+// API key in https://mainnet.infura.io/v3/KEY, before they reach logs, metrics
+// or error messages.
+package redact
+
+import (
+	"errors"
+	"net/url"
+)
+
+// placeholder replaces the redacted parts of a URL.
+const placeholder = "REDACTED"
+
+// URL returns rawURL keeping only its scheme and host. The credentials, path
+// and query, which may all carry a key, are replaced with a placeholder.
+// Unparsable URLs are replaced entirely.
+func URL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return placeholder
+	}
+	redacted := url.URL{Scheme: u.Scheme, Host: u.Host}
+	if u.User != nil {
+		redacted.User = url.User(placeholder)
+	}
+	switch u.Path {
+	case "", "/":
+		redacted.Path = u.Path
+	default:
+		redacted.Path = "/" + placeholder
+	}
+	if u.RawQuery != "" {
+		redacted.RawQuery = placeholder
+	}
+	return redacted.String()
+}
+
+// Error returns the *url.Error, as returned by http.Client and url.Parse,
+// that err is or wraps with its URL redacted. The errors wrapping it are
+// dropped since their messages embed the URL too. Other errors are returned
+// as is.
+func Error(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	redacted := *urlErr
+	redacted.URL = URL(urlErr.URL)
+	return &redacted
+}
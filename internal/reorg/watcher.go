@@ -0,0 +1,205 @@
+package reorg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/redact"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultConfirmationDepth = 64
+	// defaultCallTimeout bounds the upstream calls of the default client
+	defaultCallTimeout = 30 * time.Second
+)
+
+// Store is the storage whose reorged entries are evicted. It is implemented
+// by *database.DB.
+type Store interface {
+	GetTrackedBlockNumbers(ctx context.Context, fromBlock uint64) ([]uint64, error)
+	DeleteNonCanonicalEntries(ctx context.Context, blockNumber uint64, canonicalHash string) (int64, error)
+	ForgetTrackedBlocksBefore(ctx context.Context, blockNumber uint64) error
+}
+
+var _ Store = (*database.DB)(nil)
+
+// Watcher periodically compares the block hash of recently cached entries
+// with the canonical chain and evicts the entries of reorged blocks.
+type Watcher struct {
+	logger       *zap.Logger
+	db           Store
+	upstreamURLs []string
+	headers      http.Header
+	httpClient   *http.Client
+	interval     time.Duration
+	depth        uint64
+}
+
+// New creates a Watcher calling the upstreams with httpClient, or with a
+// client bounding the calls to 30 seconds when nil. The entries do not record
+// the upstream they were fetched from, so a block is only considered reorged
+// when all the upstreams agree on its canonical hash.
+func New(logger *zap.Logger, db Store, upstreamURLs []string, headers http.Header, httpClient *http.Client, interval time.Duration, depth uint64) *Watcher {
+	if depth == 0 {
+		depth = defaultConfirmationDepth
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultCallTimeout}
+	}
+	return &Watcher{
+		logger:       logger,
+		db:           db,
+		upstreamURLs: upstreamURLs,
+		headers:      headers,
+		httpClient:   httpClient,
+		interval:     interval,
+		depth:        depth,
+	}
+}
+
+func (w *Watcher) Start(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check(ctx)
+		}
+	}
+}
+
+func (w *Watcher) check(ctx context.Context) {
+	var head string
+	if err := w.call(ctx, w.upstreamURLs[0], "eth_blockNumber", []any{}, &head); err != nil {
+		w.logger.Error("failed to get head block number", zap.Error(err))
+		return
+	}
+	headNumber, err := strconv.ParseUint(strings.TrimPrefix(head, "0x"), 16, 64)
+	if err != nil {
+		w.logger.Error("invalid head block number", zap.String("head", head), zap.Error(err))
+		return
+	}
+
+	var fromBlock uint64
+	if headNumber > w.depth {
+		fromBlock = headNumber - w.depth
+	}
+
+	// Blocks deeper than the confirmation depth are considered final
+	if err := w.db.ForgetTrackedBlocksBefore(ctx, fromBlock); err != nil {
+		w.logger.Error("failed to forget final blocks", zap.Error(err))
+	}
+
+	numbers, err := w.db.GetTrackedBlockNumbers(ctx, fromBlock)
+	if err != nil {
+		w.logger.Error("failed to get tracked blocks", zap.Error(err))
+		return
+	}
+
+	for _, number := range numbers {
+		hash, ok := w.canonicalHash(ctx, number)
+		if !ok {
+			continue
+		}
+
+		deleted, err := w.db.DeleteNonCanonicalEntries(ctx, number, hash)
+		if err != nil {
+			w.logger.Error("failed to delete non-canonical entries", zap.Uint64("block_number", number), zap.Error(err))
+			continue
+		}
+		if deleted > 0 {
+			w.logger.Info("evicted reorged cache entries",
+				zap.Uint64("block_number", number),
+				zap.String("canonical_hash", hash),
+				zap.Int64("deleted", deleted))
+		}
+	}
+}
+
+// canonicalHash returns the hash of block number on the canonical chain, or
+// false unless every upstream knows the block under the same hash.
+func (w *Watcher) canonicalHash(ctx context.Context, number uint64) (string, bool) {
+	var hash string
+	for _, upstreamURL := range w.upstreamURLs {
+		var block struct {
+			Hash string `json:"hash"`
+		}
+		if err := w.call(ctx, upstreamURL, "eth_getBlockByNumber", []any{fmt.Sprintf("0x%x", number), false}, &block); err != nil {
+			w.logger.Error("failed to get canonical block", zap.Uint64("block_number", number), zap.Error(err))
+			return "", false
+		}
+		if block.Hash == "" {
+			// The block is not known by the upstream (anymore), wait for the
+			// canonical chain to settle
+			return "", false
+		}
+		if hash != "" && block.Hash != hash {
+			w.logger.Debug("upstreams disagree on the canonical block",
+				zap.Uint64("block_number", number),
+				zap.Strings("hashes", []string{hash, block.Hash}))
+			return "", false
+		}
+		hash = block.Hash
+	}
+	return hash, hash != ""
+}
+
+func (w *Watcher) call(ctx context.Context, upstreamURL string, method string, params []any, result any) error {
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+		"id":      1,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL, bytes.NewReader(body))
+	if err != nil {
+		return redact.Error(err)
+	}
+	for k, v := range w.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		// The URL may embed an API key
+		return redact.Error(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var rpcResp struct {
+		Result json.RawMessage `json:"result"`
+		Error  any             `json:"error"`
+	}
+	if err := json.Unmarshal(respBody, &rpcResp); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("upstream error: %v", rpcResp.Error)
+	}
+	if len(rpcResp.Result) == 0 || string(rpcResp.Result) == "null" {
+		return nil
+	}
+	return json.Unmarshal(rpcResp.Result, result)
+}
@@ -0,0 +1,47 @@
+package selftest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/database"
+)
+
+// Store is the storage the self-test round-trips an entry through. It is
+// implemented by *database.DB.
+type Store interface {
+	SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error
+	GetCacheEntry(ctx context.Context, key string) (*database.CacheEntry, error)
+	DeleteCacheEntry(ctx context.Context, key string) (bool, error)
+}
+
+var _ Store = (*database.DB)(nil)
+
+// sentinelKey cannot collide with a cache key, which is a hex digest.
+const sentinelKey = "ethereum-cache:selftest"
+
+// Run writes a sentinel entry, reads it back and deletes it, catching a
+// database the cache cannot work with, such as a read-only one, before any
+// request is served.
+func Run(ctx context.Context, db Store) error {
+	// A leftover of a previous run must not pass for this one
+	sentinel := fmt.Appendf(nil, `"%d"`, time.Now().UnixNano())
+	if err := db.SetCachedRPCResult(ctx, sentinelKey, "selftest", sentinel, nil, ""); err != nil {
+		return fmt.Errorf("failed to write the self-test entry: %w", err)
+	}
+	// Read from the primary, a replica may lag behind
+	entry, err := db.GetCacheEntry(ctx, sentinelKey)
+	if err != nil {
+		return fmt.Errorf("failed to read the self-test entry back: %w", err)
+	}
+	if entry == nil || !bytes.Equal(entry.Response, sentinel) {
+		return errors.New("the self-test entry read back differs from the written one")
+	}
+	if _, err := db.DeleteCacheEntry(ctx, sentinelKey); err != nil {
+		return fmt.Errorf("failed to delete the self-test entry: %w", err)
+	}
+	return nil
+}
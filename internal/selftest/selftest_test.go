@@ -0,0 +1,56 @@
+package selftest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/selftest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore keeps entries in memory, failing writes with writeErr.
+type memoryStore struct {
+	entries  map[string][]byte
+	writeErr error
+}
+
+func (s *memoryStore) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	s.entries[key] = response
+	return nil
+}
+
+func (s *memoryStore) GetCacheEntry(ctx context.Context, key string) (*database.CacheEntry, error) {
+	response, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	return &database.CacheEntry{Key: key, Response: response}, nil
+}
+
+func (s *memoryStore) DeleteCacheEntry(ctx context.Context, key string) (bool, error) {
+	_, ok := s.entries[key]
+	delete(s.entries, key)
+	return ok, nil
+}
+
+func TestRun(t *testing.T) {
+	store := &memoryStore{entries: make(map[string][]byte)}
+	require.NoError(t, selftest.Run(context.Background(), store))
+	// The sentinel is not left behind
+	assert.Empty(t, store.entries)
+}
+
+func TestRunReadOnlyDatabase(t *testing.T) {
+	readOnly := errors.New("cannot execute INSERT in a read-only transaction")
+	store := &memoryStore{entries: make(map[string][]byte), writeErr: readOnly}
+
+	err := selftest.Run(context.Background(), store)
+	require.ErrorIs(t, err, readOnly)
+	assert.EqualError(t, err, "failed to write the self-test entry: cannot execute INSERT in a read-only transaction")
+}
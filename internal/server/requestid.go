@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/clems4ever/ethereum-cache/internal/proxy"
+)
+
+// maxRequestIDLen bounds the length of the request ids accepted from the
+// clients, which end up in the logs.
+const maxRequestIDLen = 128
+
+// requestIDMiddleware tags every request with the id sent by the client in
+// the X-Request-ID header, or a random one when absent or invalid, and echoes
+// it on the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(proxy.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(proxy.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(proxy.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID accepts the non-empty ids of printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -2,31 +2,79 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/clems4ever/ethereum-cache/internal/cleanup"
-	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/idle"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
 	"github.com/clems4ever/ethereum-cache/internal/proxy"
 	"github.com/go-chi/chi/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
+// defaultShutdownTimeout is how long in-flight requests are given to complete
+// on shutdown when shutdown_timeout is not set.
+const defaultShutdownTimeout = 5 * time.Second
+
+// Store is the storage of the cache, implemented by *database.DB and
+// *shard.Store.
+type Store interface {
+	proxy.Store
+	cleanup.Store
+}
+
 type Server struct {
-	logger         *zap.Logger
-	httpServer     *http.Server
+	logger *zap.Logger
+	// httpServers holds one server per listen address, all sharing the
+	// same router
+	httpServers    []*http.Server
+	handler        *proxy.Handler
 	cleanupManager *cleanup.Manager
+	idle           *idle.Tracker
+	// shutdownTimeout bounds the wait for in-flight requests on shutdown
+	shutdownTimeout time.Duration
+	// warmupDumpFile is a cache dump imported before serving
+	warmupDumpFile string
 }
 
-func New(logger *zap.Logger, addr string, upstreamURL string, db *database.DB, authToken string, maxSize int64, slackRatio float64, rateLimit float64) *Server {
+func New(logger *zap.Logger, db Store, cfg config.Config) (*Server, error) {
+	maxSize, err := cfg.GetMaxCacheSizeBytes()
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_cache_size_bytes: %w", err)
+	}
+
+	pruneBatch, err := config.ParseBytes(cfg.PruneBatchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prune_batch_bytes: %w", err)
+	}
+
+	idleTracker := idle.NewTracker(cfg.IdleTimeout)
+
 	var cleanupManager *cleanup.Manager
-	if maxSize > 0 {
-		cleanupManager = cleanup.NewManager(logger, db, maxSize, slackRatio)
+	if maxSize > 0 || cfg.MaxItemCount > 0 || cfg.VacuumInterval > 0 {
+		cleanupManager = cleanup.NewManager(logger, db, maxSize, cfg.MaxItemCount, cfg.CleanupSlackRatio, cfg.VacuumInterval, pruneBatch, idleTracker)
+	}
+
+	if cfg.AdminAddr != "" && cfg.AdminToken == "" {
+		return nil, errors.New("admin_token is required with admin_addr")
 	}
 
-	handler := proxy.NewHandler(logger, upstreamURL, db, cleanupManager, rateLimit)
+	handler, err := proxy.NewHandler(logger, db, cleanupManager, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create handler: %w", err)
+	}
 
 	r := chi.NewRouter()
+	r.Use(requestIDMiddleware)
 
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -34,46 +82,204 @@ func New(logger *zap.Logger, addr string, upstreamURL string, db *database.DB, a
 	})
 
 	r.Group(func(r chi.Router) {
-		if authToken != "" {
-			r.Use(func(next http.Handler) http.Handler {
-				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					authHeader := r.Header.Get("Authorization")
-					if authHeader != "Bearer "+authToken {
-						http.Error(w, "Unauthorized", http.StatusUnauthorized)
-						return
-					}
-					next.ServeHTTP(w, r)
-				})
-			})
+		if cfg.AuthToken != "" || cfg.BasicAuthUser != "" {
+			r.Use(authMiddleware(cfg.AuthToken, cfg.BasicAuthUser, cfg.BasicAuthPassword))
 		}
 
 		r.Handle("/metrics", promhttp.Handler())
-		r.Mount("/", handler)
+		if cfg.AdminAddr == "" {
+			mountAdminRoutes(r, handler, cfg.AuthToken != "" || cfg.BasicAuthUser != "")
+		}
+		// Only the JSON-RPC requests count as activity, not the metrics
+		// scrapes
+		r.Mount("/", idleTracker.Middleware(handler))
 	})
 
+	addrs := cfg.ListenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{":" + cfg.Port}
+	}
+	var protocols *http.Protocols
+	if cfg.EnableH2C {
+		// HTTP/2 over cleartext, next to HTTP/1.1 for the existing clients
+		protocols = new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	httpServers := make([]*http.Server, 0, len(addrs))
+	for _, addr := range addrs {
+		httpServers = append(httpServers, &http.Server{
+			Addr:      addr,
+			Handler:   r,
+			Protocols: protocols,
+		})
+	}
+
+	if cfg.AdminAddr != "" {
+		admin := chi.NewRouter()
+		admin.Use(requestIDMiddleware)
+		admin.Use(authMiddleware(cfg.AdminToken, "", ""))
+		mountAdminRoutes(admin, handler, true)
+		httpServers = append(httpServers, &http.Server{
+			Addr:    cfg.AdminAddr,
+			Handler: admin,
+		})
+	}
+
+	shutdownTimeout := cfg.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+
 	return &Server{
-		logger: logger,
-		httpServer: &http.Server{
-			Addr:    addr,
-			Handler: r,
-		},
-		cleanupManager: cleanupManager,
+		logger:          logger,
+		httpServers:     httpServers,
+		handler:         handler,
+		cleanupManager:  cleanupManager,
+		idle:            idleTracker,
+		shutdownTimeout: shutdownTimeout,
+		warmupDumpFile:  cfg.WarmupDumpFile,
+	}, nil
+}
+
+// mountAdminRoutes mounts the cache administration endpoints. The ones
+// altering the cache are only mounted on authenticated routers.
+func mountAdminRoutes(r chi.Router, handler *proxy.Handler, authenticated bool) {
+	r.Get("/cache/entry", handler.ServeCacheEntry)
+	r.Get("/cache/stats", handler.ServeCacheStats)
+	if authenticated {
+		// Dumps expose and overwrite the whole cache and overrides change
+		// what is cached, never serve them unauthenticated
+		r.Get("/cache/export", handler.ServeCacheExport)
+		r.Post("/cache/import", handler.ServeCacheImport)
+		r.Post("/cache/config/method/{method}", handler.ServeMethodCaching)
+		r.Delete("/cache/config/method/{method}", handler.ServeMethodCaching)
+	}
+}
+
+// authMiddleware accepts either the bearer token or the basic credentials,
+// whichever are configured. Secrets are compared in constant time.
+func authMiddleware(token string, basicUser string, basicPassword string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token != "" && secureCompare(r.Header.Get("Authorization"), "Bearer "+token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if basicUser != "" {
+				user, password, ok := r.BasicAuth()
+				// Both comparisons are evaluated to not leak which one failed
+				userOK := secureCompare(user, basicUser)
+				passwordOK := secureCompare(password, basicPassword)
+				if ok && userOK && passwordOK {
+					next.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Basic realm="ethereum-cache"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
 	}
 }
 
+func secureCompare(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// IdleTracker returns the tracker of the client requests, nil when
+// idle_timeout is not set.
+func (s *Server) IdleTracker() *idle.Tracker {
+	return s.idle
+}
+
+// Handler returns the proxy handler serving the JSON-RPC calls.
+func (s *Server) Handler() *proxy.Handler {
+	return s.handler
+}
+
+// ShutdownTimeout returns how long Shutdown should wait for the in-flight
+// requests before forcing the listeners closed.
+func (s *Server) ShutdownTimeout() time.Duration {
+	return s.shutdownTimeout
+}
+
+// Start listens on every address and serves until Shutdown is called, once
+// the warmup dump, if any, is imported. It returns the first error of any of
+// the listeners.
 func (s *Server) Start() error {
+	if s.warmupDumpFile != "" {
+		s.handler.WarmUp(context.Background(), s.warmupDumpFile)
+	}
+
+	listeners := make([]net.Listener, 0, len(s.httpServers))
+	for _, httpServer := range s.httpServers {
+		l, err := listen(httpServer.Addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
 	if s.cleanupManager != nil {
 		s.cleanupManager.Start()
 	}
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return err
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func(httpServer *http.Server) {
+			s.logger.Debug("listening", zap.String("addr", httpServer.Addr))
+			errs <- httpServer.Serve(l)
+		}(s.httpServers[i])
+	}
+	for range listeners {
+		if err := <-errs; err != nil && err != http.ErrServerClosed {
+			return err
+		}
 	}
 	return nil
 }
 
+// listen listens on a TCP address, or on a Unix socket for addresses of the
+// form unix:/path/to.sock.
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// A socket left over by a previous process prevents binding
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		return l, nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return l, nil
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
 	if s.cleanupManager != nil {
 		s.cleanupManager.Stop()
 	}
-	return s.httpServer.Shutdown(ctx)
+	var err error
+	for _, httpServer := range s.httpServers {
+		err = errors.Join(err, httpServer.Shutdown(ctx))
+	}
+	// Requests are done, nothing is recorded anymore
+	err = errors.Join(err, s.handler.Close())
+
+	// Counters which were not scraped yet would be lost, log the totals of
+	// the process lifetime
+	s.logger.Info("shutdown summary",
+		zap.Int64("cache_hits", int64(metrics.Total(metrics.CacheHits))),
+		zap.Int64("cache_misses", int64(metrics.Total(metrics.CacheMisses))),
+		zap.Int64("served_bytes", int64(metrics.Total(metrics.ServedBytes))))
+	return err
 }
@@ -0,0 +1,292 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/clems4ever/ethereum-cache/internal/cleanup"
+	"github.com/clems4ever/ethereum-cache/internal/consistency"
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/exporter"
+	"github.com/clems4ever/ethereum-cache/internal/proxy"
+	"github.com/clems4ever/ethereum-cache/internal/reorg"
+)
+
+// Backend is a single shard, usually a *database.DB.
+type Backend interface {
+	proxy.Store
+	cleanup.Store
+	reorg.Store
+	consistency.Store
+	exporter.Store
+}
+
+var _ Backend = (*database.DB)(nil)
+
+// Store distributes the cache entries across backends by hashing their key,
+// so that a cache can outgrow a single database. Operations on the whole
+// cache are fanned out to every backend and their results aggregated.
+type Store struct {
+	backends []Backend
+}
+
+var (
+	_ Backend            = (*Store)(nil)
+	_ exporter.PoolStore = (*Store)(nil)
+)
+
+func New(backends []Backend) (*Store, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("at least one shard is required")
+	}
+	return &Store{backends: backends}, nil
+}
+
+// backend returns the shard owning key. The placement only depends on the key
+// and the number of shards.
+func (s *Store) backend(key string) Backend {
+	return s.backends[xxhash.Sum64String(key)%uint64(len(s.backends))]
+}
+
+func (s *Store) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	return s.backend(key).GetCachedRPCResultWithParams(ctx, key)
+}
+
+func (s *Store) GetCacheEntry(ctx context.Context, key string) (*database.CacheEntry, error) {
+	return s.backend(key).GetCacheEntry(ctx, key)
+}
+
+func (s *Store) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	return s.backend(key).SetCachedRPCResult(ctx, key, method, response, params, source)
+}
+
+func (s *Store) RefreshCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	return s.backend(key).RefreshCachedRPCResult(ctx, key, method, response, params, source)
+}
+
+func (s *Store) SetCachedHeaders(ctx context.Context, key string, headers []byte) error {
+	return s.backend(key).SetCachedHeaders(ctx, key, headers)
+}
+
+func (s *Store) GetCachedHeaders(ctx context.Context, key string) ([]byte, error) {
+	return s.backend(key).GetCachedHeaders(ctx, key)
+}
+
+func (s *Store) DeleteCacheEntry(ctx context.Context, key string) (bool, error) {
+	return s.backend(key).DeleteCacheEntry(ctx, key)
+}
+
+// ExportCacheEntries exports the entries of every shard, one after the other.
+func (s *Store) ExportCacheEntries(ctx context.Context, fn func(database.CacheEntry) error) error {
+	for _, b := range s.backends {
+		if err := b.ExportCacheEntries(ctx, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) ImportCacheEntries(ctx context.Context, entries []database.CacheEntry, source string) (int64, error) {
+	batches := make(map[Backend][]database.CacheEntry)
+	for _, entry := range entries {
+		b := s.backend(entry.Key)
+		batches[b] = append(batches[b], entry)
+	}
+
+	var imported int64
+	for b, batch := range batches {
+		n, err := b.ImportCacheEntries(ctx, batch, source)
+		imported += n
+		if err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+func (s *Store) GetCacheItemCountBySource(ctx context.Context) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, b := range s.backends {
+		shardCounts, err := b.GetCacheItemCountBySource(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for source, count := range shardCounts {
+			counts[source] += count
+		}
+	}
+	return counts, nil
+}
+
+func (s *Store) SetBlockNumberForTx(ctx context.Context, txHash string, blockNumber uint64) error {
+	return s.backend(txHash).SetBlockNumberForTx(ctx, txHash, blockNumber)
+}
+
+func (s *Store) GetBlockNumberForTx(ctx context.Context, txHash string) (uint64, bool, error) {
+	return s.backend(txHash).GetBlockNumberForTx(ctx, txHash)
+}
+
+// TrackBlockEntry tracks the entry in the shard holding it, so that its
+// eviction stays local to the shard.
+func (s *Store) TrackBlockEntry(ctx context.Context, key string, blockNumber uint64, blockHash string) error {
+	return s.backend(key).TrackBlockEntry(ctx, key, blockNumber, blockHash)
+}
+
+func (s *Store) GetTrackedBlockNumbers(ctx context.Context, fromBlock uint64) ([]uint64, error) {
+	var numbers []uint64
+	for _, b := range s.backends {
+		shardNumbers, err := b.GetTrackedBlockNumbers(ctx, fromBlock)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, shardNumbers...)
+	}
+	slices.Sort(numbers)
+	return slices.Compact(numbers), nil
+}
+
+func (s *Store) DeleteNonCanonicalEntries(ctx context.Context, blockNumber uint64, canonicalHash string) (int64, error) {
+	return s.sum(func(b Backend) (int64, error) {
+		return b.DeleteNonCanonicalEntries(ctx, blockNumber, canonicalHash)
+	})
+}
+
+func (s *Store) ForgetTrackedBlocksBefore(ctx context.Context, blockNumber uint64) error {
+	return s.each(func(b Backend) error {
+		return b.ForgetTrackedBlocksBefore(ctx, blockNumber)
+	})
+}
+
+// SampleCacheEntries samples every shard, returning at most limit entries.
+func (s *Store) SampleCacheEntries(ctx context.Context, methods []string, percent float64, limit int) ([]database.CacheEntry, error) {
+	var entries []database.CacheEntry
+	for _, b := range s.backends {
+		if len(entries) >= limit {
+			break
+		}
+		shardEntries, err := b.SampleCacheEntries(ctx, methods, percent, limit-len(entries))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, shardEntries...)
+	}
+	return entries, nil
+}
+
+func (s *Store) GetCacheSize(ctx context.Context) (int64, error) {
+	return s.sum(func(b Backend) (int64, error) {
+		return b.GetCacheSize(ctx)
+	})
+}
+
+func (s *Store) GetCacheItemCount(ctx context.Context) (int64, error) {
+	return s.sum(func(b Backend) (int64, error) {
+		return b.GetCacheItemCount(ctx)
+	})
+}
+
+func (s *Store) CountExpiringBefore(ctx context.Context, cutoff time.Time, ttl time.Duration) (int64, error) {
+	return s.sum(func(b Backend) (int64, error) {
+		return b.CountExpiringBefore(ctx, cutoff, ttl)
+	})
+}
+
+// PoolStats sums the connection counts of the shards having a connection
+// pool.
+func (s *Store) PoolStats() database.PoolStats {
+	var stats database.PoolStats
+	for _, b := range s.backends {
+		if pool, ok := b.(exporter.PoolStore); ok {
+			shardStats := pool.PoolStats()
+			stats.Total += shardStats.Total
+			stats.Acquired += shardStats.Acquired
+			stats.Idle += shardStats.Idle
+		}
+	}
+	return stats
+}
+
+// PruneCache frees bytesToFree across the shards, proportionally to their
+// size. The least recently accessed entries are pruned within each shard
+// rather than across the whole cache.
+func (s *Store) PruneCache(ctx context.Context, bytesToFree int64) (int64, int64, error) {
+	return s.pruneProportionally(bytesToFree, func(b Backend) (int64, error) {
+		return b.GetCacheSize(ctx)
+	}, func(b Backend, n int64) (int64, int64, error) {
+		return b.PruneCache(ctx, n)
+	})
+}
+
+// PruneCacheByCount deletes itemsToDelete entries across the shards,
+// proportionally to their item count.
+func (s *Store) PruneCacheByCount(ctx context.Context, itemsToDelete int64) (int64, int64, error) {
+	return s.pruneProportionally(itemsToDelete, func(b Backend) (int64, error) {
+		return b.GetCacheItemCount(ctx)
+	}, func(b Backend, n int64) (int64, int64, error) {
+		return b.PruneCacheByCount(ctx, n)
+	})
+}
+
+func (s *Store) Vacuum(ctx context.Context) error {
+	return s.each(func(b Backend) error {
+		return b.Vacuum(ctx)
+	})
+}
+
+// pruneProportionally splits amount across the shards according to their
+// share of the measured total, rounding up so that the whole amount is freed.
+// Both values returned by prune are summed across the shards.
+func (s *Store) pruneProportionally(amount int64, measure func(Backend) (int64, error), prune func(Backend, int64) (int64, int64, error)) (int64, int64, error) {
+	shares := make([]int64, len(s.backends))
+	var total int64
+	for i, b := range s.backends {
+		n, err := measure(b)
+		if err != nil {
+			return 0, 0, err
+		}
+		shares[i] = n
+		total += n
+	}
+	if total == 0 {
+		return 0, 0, nil
+	}
+
+	var pruned, other int64
+	for i, b := range s.backends {
+		share := int64(math.Ceil(float64(amount) * float64(shares[i]) / float64(total)))
+		if share == 0 {
+			continue
+		}
+		n, m, err := prune(b, share)
+		pruned += n
+		other += m
+		if err != nil {
+			return pruned, other, err
+		}
+	}
+	return pruned, other, nil
+}
+
+func (s *Store) sum(fn func(Backend) (int64, error)) (int64, error) {
+	var total int64
+	for _, b := range s.backends {
+		n, err := fn(b)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (s *Store) each(fn func(Backend) error) error {
+	var errs error
+	for _, b := range s.backends {
+		errs = errors.Join(errs, fn(b))
+	}
+	return errs
+}
@@ -0,0 +1,83 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryBackend stores results in memory, accounting one byte per byte of
+// response.
+type memoryBackend struct {
+	Backend
+	entries map[string][]byte
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{entries: make(map[string][]byte)}
+}
+
+func (m *memoryBackend) GetCachedRPCResultWithParams(ctx context.Context, key string) ([]byte, []byte, time.Duration, error) {
+	return m.entries[key], nil, 0, nil
+}
+
+func (m *memoryBackend) SetCachedRPCResult(ctx context.Context, key string, method string, response []byte, params []byte, source string) error {
+	m.entries[key] = response
+	return nil
+}
+
+func (m *memoryBackend) GetCacheSize(ctx context.Context) (int64, error) {
+	var size int64
+	for _, response := range m.entries {
+		size += int64(len(response))
+	}
+	return size, nil
+}
+
+func (m *memoryBackend) GetCacheItemCount(ctx context.Context) (int64, error) {
+	return int64(len(m.entries)), nil
+}
+
+func TestShardedStore(t *testing.T) {
+	ctx := context.Background()
+	backends := []*memoryBackend{newMemoryBackend(), newMemoryBackend()}
+	store, err := New([]Backend{backends[0], backends[1]})
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.SetCachedRPCResult(ctx, fmt.Sprintf("key-%d", i), "eth_test", []byte(fmt.Sprintf(`"%d"`, i)), nil, ""))
+	}
+
+	// Every key lives in exactly one shard, the same one for every store
+	// over the same number of shards
+	other, err := New([]Backend{newMemoryBackend(), newMemoryBackend()})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, inFirst := backends[0].entries[key]
+		_, inSecond := backends[1].entries[key]
+		assert.NotEqual(t, inFirst, inSecond, key)
+		assert.Equal(t, store.backend(key) == backends[0], other.backend(key) == other.backends[0], key)
+
+		response, _, _, err := store.GetCachedRPCResultWithParams(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(`"%d"`, i), string(response))
+	}
+	assert.NotEmpty(t, backends[0].entries)
+	assert.NotEmpty(t, backends[1].entries)
+
+	// Aggregates are the sum of the shards
+	size, err := store.GetCacheSize(ctx)
+	require.NoError(t, err)
+	firstSize, _ := backends[0].GetCacheSize(ctx)
+	secondSize, _ := backends[1].GetCacheSize(ctx)
+	assert.Equal(t, firstSize+secondSize, size)
+
+	count, err := store.GetCacheItemCount(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), count)
+}
@@ -8,10 +8,12 @@ import (
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/clems4ever/ethereum-cache/internal/config"
 	"github.com/clems4ever/ethereum-cache/internal/database"
 	"github.com/clems4ever/ethereum-cache/internal/server"
 	"github.com/clems4ever/ethereum-cache/testdb"
@@ -63,7 +65,8 @@ func TestCaching(t *testing.T) {
 
 	// 3. Start Proxy Server
 	proxyPort := "8088"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, "", 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -140,7 +143,8 @@ func TestErrorHandling(t *testing.T) {
 
 	// 3. Start Proxy Server
 	proxyPort := "8086"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, "", 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -195,7 +199,8 @@ func TestNoCachingForLatestBlock(t *testing.T) {
 
 	// 3. Start Proxy Server
 	proxyPort := "8087"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, "", 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -232,3 +237,673 @@ func TestNoCachingForLatestBlock(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int32(4), atomic.LoadInt32(&requestCount)) // Should be 4 (no cache)
 }
+
+func TestCacheBypassHeader(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream returning a different result on every call
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":"0x%d"}`, count)))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with the bypass header allowed
+	proxyPort := "8092"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, AllowCacheBypassHeader: true})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// Helper to send a cacheable request with optional headers
+	sendRequest := func(headers map[string]string) string {
+		req, err := http.NewRequest("POST", "http://localhost:"+proxyPort, strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rpcResp struct {
+			Result string `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rpcResp))
+		return rpcResp.Result
+	}
+
+	// 4.1 Warm the cache
+	require.Equal(t, "0x1", sendRequest(nil))
+	require.Equal(t, "0x1", sendRequest(nil))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+
+	// 4.2 Bypass forces an upstream call but leaves the stored entry untouched
+	require.Equal(t, "0x2", sendRequest(map[string]string{"X-Cache-Bypass": "true"}))
+	require.Equal(t, int32(2), atomic.LoadInt32(&requestCount))
+	require.Equal(t, "0x1", sendRequest(nil))
+	require.Equal(t, int32(2), atomic.LoadInt32(&requestCount))
+
+	// 4.3 Bypass with refresh overwrites the stored entry
+	require.Equal(t, "0x3", sendRequest(map[string]string{"X-Cache-Bypass": "true", "X-Cache-Refresh": "true"}))
+	require.Equal(t, int32(3), atomic.LoadInt32(&requestCount))
+	require.Equal(t, "0x3", sendRequest(nil))
+	require.Equal(t, int32(3), atomic.LoadInt32(&requestCount))
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server exposing the cache key
+	proxyPort := "8093"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, ExposeCacheKeyHeader: true})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// Helper to send a request and return the response headers
+	sendRequest := func(body string) http.Header {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Header
+	}
+
+	cacheable := `{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`
+
+	// 4.1 First request is a miss
+	headers := sendRequest(cacheable)
+	require.Equal(t, "MISS", headers.Get("X-Cache"))
+	key := headers.Get("X-Cache-Key")
+	require.Len(t, key, 16)
+
+	// 4.2 Second request is a hit with the same key
+	headers = sendRequest(cacheable)
+	require.Equal(t, "HIT", headers.Get("X-Cache"))
+	require.Equal(t, key, headers.Get("X-Cache-Key"))
+
+	// 4.3 Non-cacheable methods are bypassed
+	headers = sendRequest(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`)
+	require.Equal(t, "BYPASS", headers.Get("X-Cache"))
+	require.Empty(t, headers.Get("X-Cache-Key"))
+}
+
+func TestTxBlockIndex(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream returning a receipt mined in block 0x10
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"transactionHash":"0x0000000000000000000000000000000000000000000000000000000000000123","blockNumber":"0x10","status":"0x1"}}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with the tx index enabled
+	proxyPort := "8094"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, IndexTxBlocks: true})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	txHash := "0x0000000000000000000000000000000000000000000000000000000000000123"
+
+	// 4. Fetch the receipt through the proxy
+	resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+		strings.NewReader(fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","params":["%s"],"id":1}`, txHash)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 5. The block number of the transaction is now indexed
+	blockNumber, found, err := db.GetBlockNumberForTx(context.Background(), txHash)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(16), blockNumber)
+}
+
+func TestChainNamespace(t *testing.T) {
+	// 1. Setup Test Database shared by both proxies
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start one Proxy Server per chain
+	ports := []string{"8095", "8096"}
+	namespaces := []string{"mainnet", "sepolia"}
+	for i, proxyPort := range ports {
+		srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, ChainNamespace: namespaces[i]})
+		require.NoError(t, err)
+
+		go func() {
+			if err := srv.Start(); err != nil {
+				t.Logf("server error: %v", err)
+			}
+		}()
+		defer srv.Shutdown(context.Background())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	sendRequest := func(proxyPort string) {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// 4. The same call on each chain is a distinct entry
+	sendRequest(ports[0])
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+	sendRequest(ports[1])
+	require.Equal(t, int32(2), atomic.LoadInt32(&requestCount))
+
+	// 5. Each chain is served from its own entry
+	sendRequest(ports[0])
+	sendRequest(ports[1])
+	require.Equal(t, int32(2), atomic.LoadInt32(&requestCount))
+}
+
+func TestCacheHitIDEcho(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server
+	proxyPort := "8099"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	sendRequest := func(idMember string) *http.Response {
+		body := fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"]%s}`, idMember)
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		return resp
+	}
+
+	// 4. Warm the cache
+	resp := sendRequest(`,"id":1`)
+	resp.Body.Close()
+	require.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+
+	// 5. Cache hits echo the id exactly as received
+	for _, id := range []string{`42`, `"abc"`, `null`} {
+		resp := sendRequest(`,"id":` + id)
+		var rpcResp map[string]json.RawMessage
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rpcResp))
+		resp.Body.Close()
+		require.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+		require.Contains(t, rpcResp, "id")
+		require.Equal(t, id, string(rpcResp["id"]))
+	}
+
+	// 6. Notifications get no response
+	resp = sendRequest("")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Empty(t, body)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup a slow Mock Upstream returning a different result on every call
+	upstreamDelay := 300 * time.Millisecond
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&requestCount, 1)
+		time.Sleep(upstreamDelay)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":"0x%d"}`, count)))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with stale-while-revalidate
+	proxyPort := "8105"
+	freshness := 500 * time.Millisecond
+	srv, err := server.New(zap.NewNop(), db, config.Config{
+		Port:                 proxyPort,
+		UpstreamURL:          upstream.URL,
+		StaleWhileRevalidate: true,
+		FreshnessWindow:      freshness,
+	})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	sendRequest := func() (string, string) {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rpcResp struct {
+			Result string `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rpcResp))
+		return rpcResp.Result, resp.Header.Get("X-Cache")
+	}
+
+	// 4. Warm the cache, the entry is fresh
+	result, status := sendRequest()
+	require.Equal(t, "0x1", result)
+	require.Equal(t, "MISS", status)
+	result, status = sendRequest()
+	require.Equal(t, "0x1", result)
+	require.Equal(t, "HIT", status)
+
+	// 5. Once past its freshness window, the stale value is served instantly
+	time.Sleep(freshness)
+	start := time.Now()
+	result, status = sendRequest()
+	require.Less(t, time.Since(start), upstreamDelay)
+	require.Equal(t, "0x1", result)
+	require.Equal(t, "STALE", status)
+
+	// 6. Concurrent stale hits share the background refresh
+	result, status = sendRequest()
+	require.Equal(t, "0x1", result)
+	require.Equal(t, "STALE", status)
+
+	// 7. The entry is refreshed in the background
+	time.Sleep(2 * upstreamDelay)
+	result, status = sendRequest()
+	require.Equal(t, "0x2", result)
+	require.Equal(t, "HIT", status)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requestCount))
+}
+
+func TestMaxCacheableBytes(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream returning a small trace for 0x1 and a large one
+	// for 0x2
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		body, _ := io.ReadAll(r.Body)
+		result := "0x1"
+		if strings.Contains(string(body), `"0x2"`) {
+			result = fmt.Sprintf("0x%02048d", 0)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":"%s"}`, result)))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with a 1KB limit for traces
+	proxyPort := "8106"
+	srv, err := server.New(zap.NewNop(), db, config.Config{
+		Port:              proxyPort,
+		UpstreamURL:       upstream.URL,
+		MaxCacheableBytes: map[string]string{"debug_tracetransaction": "1KB"},
+	})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	sendRequest := func(txHash string) {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(fmt.Sprintf(`{"jsonrpc":"2.0","method":"debug_traceTransaction","params":["%s"],"id":1}`, txHash)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// 4. The small trace is cached
+	sendRequest("0x1")
+	sendRequest("0x1")
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+
+	// 5. The large trace is returned but never cached
+	sendRequest("0x2")
+	sendRequest("0x2")
+	require.Equal(t, int32(3), atomic.LoadInt32(&requestCount))
+
+	count, err := db.GetCacheItemCount(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+}
+
+func TestResultValidation(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream omitting the result for 0x1 and returning a null
+	// result for 0x2
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(string(body), `"0x1"`) {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1}`))
+		} else {
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+		}
+	}))
+	defer upstream.Close()
+
+	// 3. Start one Proxy Server without and one with negative caching
+	ports := []string{"8107", "8108"}
+	for i, proxyPort := range ports {
+		srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, NegativeCaching: i == 1, ChainNamespace: proxyPort})
+		require.NoError(t, err)
+
+		go func() {
+			if err := srv.Start(); err != nil {
+				t.Logf("server error: %v", err)
+			}
+		}()
+		defer srv.Shutdown(context.Background())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	sendRequest := func(proxyPort string, txHash string) {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","params":["%s"],"id":1}`, txHash)))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	countEntries := func() int64 {
+		count, err := db.GetCacheItemCount(context.Background())
+		require.NoError(t, err)
+		return count
+	}
+
+	// 4. Result-less responses are never cached and are counted
+	initialEmpty := getCounterValue("ethereum_cache_empty_results_total", "eth_getTransactionReceipt")
+	sendRequest(ports[0], "0x1")
+	sendRequest(ports[1], "0x1")
+	require.Equal(t, int64(0), countEntries())
+	require.Equal(t, initialEmpty+2, getCounterValue("ethereum_cache_empty_results_total", "eth_getTransactionReceipt"))
+
+	// 5. Null results are only cached with negative caching
+	sendRequest(ports[0], "0x2")
+	require.Equal(t, int64(0), countEntries())
+	sendRequest(ports[1], "0x2")
+	require.Equal(t, int64(1), countEntries())
+}
+
+func TestUpstreamPartitions(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup two Mock Upstreams disagreeing on the result
+	requestCounts := map[string]*int32{"current": new(int32), "candidate": new(int32)}
+	newUpstream := func(id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(requestCounts[id], 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"` + id + `"}`))
+		}))
+	}
+	current := newUpstream("current")
+	defer current.Close()
+	candidate := newUpstream("candidate")
+	defer candidate.Close()
+
+	// 3. Start Proxy Server splitting the traffic between both upstreams
+	proxyPort := "8112"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, Upstreams: []config.Upstream{
+		{ID: "current", URL: current.URL, Weight: 1},
+		{ID: "candidate", URL: candidate.URL, Weight: 1},
+	}})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// 4. Each upstream populates its own partition and its cached result is
+	// only ever served to requests routed to it
+	statuses := map[string][]string{}
+	for i := 0; i < 100 && (len(statuses["current"]) < 2 || len(statuses["candidate"]) < 2); i++ {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`))
+		require.NoError(t, err)
+		var rpcResp struct {
+			Result string `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rpcResp))
+		resp.Body.Close()
+
+		id := resp.Header.Get("X-Upstream")
+		require.Equal(t, id, rpcResp.Result)
+		statuses[id] = append(statuses[id], resp.Header.Get("X-Cache"))
+	}
+	for id, count := range requestCounts {
+		require.GreaterOrEqual(t, len(statuses[id]), 2, "upstream: %s", id)
+		require.Equal(t, "MISS", statuses[id][0], "upstream: %s", id)
+		require.Equal(t, "HIT", statuses[id][1], "upstream: %s", id)
+		require.Equal(t, int32(1), atomic.LoadInt32(count), "upstream: %s", id)
+	}
+
+	// 5. Both partitions hold their own entry
+	count, err := db.GetCacheItemCount(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+}
+
+func TestBlockTraceCaching(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[{"txHash":"0x123","result":{"gas":"0x5208"}}]}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with block traces caching
+	proxyPort := "8113"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, CacheBlockTraces: true})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	sendRequest := func(params string) {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"debug_traceBlockByNumber","params":`+params+`,"id":1}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// 4. A trace at a numeric block hits the upstream once, whatever the
+	// formatting of the tracer config
+	sendRequest(`["0x10",{"tracer":"callTracer","timeout":"10s"}]`)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+	sendRequest(`["0x10", {"timeout": "10s", "tracer": "callTracer"}]`)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+
+	// 5. A trace at latest is never cached
+	sendRequest(`["latest",{"tracer":"callTracer"}]`)
+	sendRequest(`["latest",{"tracer":"callTracer"}]`)
+	require.Equal(t, int32(3), atomic.LoadInt32(&requestCount))
+}
+
+func TestMethodCachingOverride(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x6080"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server
+	proxyPort := "8118"
+	token := "secret-token"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, AuthToken: token})
+	require.NoError(t, err)
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	sendRequest := func() {
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:"+proxyPort,
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getCode","params":["0xabc","0x10"],"id":1}`))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	setOverride := func(method string, rpcMethod string, body string) int {
+		req, err := http.NewRequest(method, "http://localhost:"+proxyPort+"/cache/config/method/"+rpcMethod, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// 4. The code at a numeric block is cached once enabled
+	require.Equal(t, http.StatusNoContent, setOverride(http.MethodPost, "eth_getCode", `{"enabled":true}`))
+	sendRequest()
+	sendRequest()
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+
+	// 5. Once disabled, every call is forwarded
+	require.Equal(t, http.StatusNoContent, setOverride(http.MethodPost, "eth_getCode", `{"enabled":false}`))
+	sendRequest()
+	sendRequest()
+	require.Equal(t, int32(3), atomic.LoadInt32(&requestCount))
+
+	// 6. Removing the override restores the configured behavior, which
+	// does not cache the code
+	require.Equal(t, http.StatusNoContent, setOverride(http.MethodDelete, "eth_getCode", ""))
+	sendRequest()
+	require.Equal(t, int32(4), atomic.LoadInt32(&requestCount))
+
+	// 7. A method which can never be cached cannot be enabled
+	require.Equal(t, http.StatusBadRequest, setOverride(http.MethodPost, "eth_blockNumber", `{"enabled":true}`))
+}
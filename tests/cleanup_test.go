@@ -7,9 +7,11 @@ import (
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/clems4ever/ethereum-cache/internal/config"
 	"github.com/clems4ever/ethereum-cache/internal/database"
 	"github.com/clems4ever/ethereum-cache/internal/server"
 	"github.com/clems4ever/ethereum-cache/testdb"
@@ -58,9 +60,10 @@ func TestCacheCleanup(t *testing.T) {
 	// So only 1 entry should remain.
 
 	proxyPort := "8088"
-	maxSize := int64(600)
+	maxSize := "600"
 	slackRatio := 0.5
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, "", maxSize, slackRatio, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, MaxCacheSize: maxSize, CleanupSlackRatio: slackRatio})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -131,3 +134,47 @@ func TestCacheCleanup(t *testing.T) {
 	// We can check by checking if we can retrieve it without upstream call?
 	// Or just trust the count and size.
 }
+
+func TestCacheCleanupByCount(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream returning tiny results
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with an item count limit
+	// Max 10 items, slack ratio 0.5, so cleanup prunes down to 5 items.
+	proxyPort := "8098"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, MaxItemCount: 10, CleanupSlackRatio: 0.5})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// 4. Insert 11 small entries, the last one exceeds the limit
+	for i := 0; i < 11; i++ {
+		body := fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x%x"],"id":1}`, i)
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// 5. Verify the count was pruned to the target
+	require.Eventually(t, func() bool {
+		count, err := db.GetCacheItemCount(context.Background())
+		return err == nil && count == 5
+	}, 2*time.Second, 50*time.Millisecond, "cache was not pruned to the target count")
+}
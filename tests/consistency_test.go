@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/consistency"
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
+	"github.com/clems4ever/ethereum-cache/internal/server"
+	"github.com/clems4ever/ethereum-cache/testdb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConsistencyCheck(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream whose receipt changes after the first fetch
+	var changed atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := "0x1"
+		if changed.Load() {
+			status = "0x0"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"transactionHash":"0x123","status":"` + status + `"}}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server, storing params for the checker
+	proxyPort := "8119"
+	interval := 50 * time.Millisecond
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, ConsistencyCheckInterval: interval})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// 4. Cache the receipt
+	resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","params":["0x123"],"id":1}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	count, err := db.GetCacheItemCount(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	// 5. Sample every entry while the upstream disagrees with the cache
+	changed.Store(true)
+	before := testutil.ToFloat64(metrics.CacheMismatches.WithLabelValues("eth_getTransactionReceipt"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entryUpstream := func(entry database.CacheEntry) (string, bool) {
+		u, ok := srv.Handler().EntryUpstream(entry)
+		return u.URL, ok
+	}
+	go consistency.New(zap.NewNop(), db, entryUpstream, nil, nil, interval, 1).Start(ctx)
+
+	require.Eventually(t, func() bool {
+		count, err := db.GetCacheItemCount(context.Background())
+		return err == nil && count == 0
+	}, 2*time.Second, interval, "mismatching entry was not evicted")
+	require.Equal(t, before+1, testutil.ToFloat64(metrics.CacheMismatches.WithLabelValues("eth_getTransactionReceipt")))
+}
@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/server"
+	"github.com/clems4ever/ethereum-cache/testdb"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCacheExportImport(t *testing.T) {
+	// 1. Setup a populated and a fresh Test Database
+	sourceTDB := testdb.NewDatabase(t)
+	sourceDB, err := database.NewDB(context.Background(), sourceTDB.ConnString())
+	require.NoError(t, err)
+	defer sourceDB.Close()
+
+	targetTDB := testdb.NewDatabase(t)
+	targetDB, err := database.NewDB(context.Background(), targetTDB.ConnString())
+	require.NoError(t, err)
+	defer targetDB.Close()
+
+	// 2. Setup Mock Upstream
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Params []string `json:"params"`
+		}
+		_ = json.Unmarshal(body, &req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"` + req.Params[0] + `"}}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start one Proxy Server per database
+	token := "secret-token"
+	ports := []string{"8114", "8115"}
+	for i, db := range []*database.DB{sourceDB, targetDB} {
+		srv, err := server.New(zap.NewNop(), db, config.Config{Port: ports[i], UpstreamURL: upstream.URL, AuthToken: token})
+		require.NoError(t, err)
+
+		go func() {
+			if err := srv.Start(); err != nil {
+				t.Logf("server error: %v", err)
+			}
+		}()
+		defer srv.Shutdown(context.Background())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	doRequest := func(method string, url string, body io.Reader) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, url, body)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, respBody
+	}
+	sendRPC := func(proxyPort string, hash string) *http.Response {
+		resp, _ := doRequest("POST", "http://localhost:"+proxyPort,
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["`+hash+`"],"id":1}`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	// 4. Populate the source cache
+	hashes := []string{"0x1", "0x2", "0x3"}
+	for _, hash := range hashes {
+		sendRPC(ports[0], hash)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&requestCount))
+
+	// 5. Export the source cache
+	resp, dump := doRequest("GET", "http://localhost:"+ports[0]+"/cache/export", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(string(dump)), "\n")
+	require.Len(t, lines, 3)
+	var entry struct {
+		Key       string          `json:"key"`
+		Method    string          `json:"method"`
+		Response  json.RawMessage `json:"response"`
+		CreatedAt time.Time       `json:"created_at"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.Equal(t, "eth_getTransactionByHash", entry.Method)
+	require.False(t, entry.CreatedAt.IsZero())
+
+	// 6. Import it into the fresh cache, twice
+	resp, body := doRequest("POST", "http://localhost:"+ports[1]+"/cache/import", strings.NewReader(string(dump)))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"imported":3,"skipped":0}`, string(body))
+
+	resp, body = doRequest("POST", "http://localhost:"+ports[1]+"/cache/import", strings.NewReader(string(dump)))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"imported":0,"skipped":3}`, string(body))
+
+	// 7. Imported entries are served from the cache
+	for _, hash := range hashes {
+		resp := sendRPC(ports[1], hash)
+		require.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&requestCount))
+
+	// 8. Malformed dumps are rejected
+	resp, _ = doRequest("POST", "http://localhost:"+ports[1]+"/cache/import", strings.NewReader(`{"key":"k"}`))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// 9. Dumps require authentication
+	resp, err = http.Get("http://localhost:" + ports[0] + "/cache/export")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestWarmupDumpFile(t *testing.T) {
+	// 1. Setup a populated and a fresh Test Database
+	sourceTDB := testdb.NewDatabase(t)
+	sourceDB, err := database.NewDB(context.Background(), sourceTDB.ConnString())
+	require.NoError(t, err)
+	defer sourceDB.Close()
+
+	targetTDB := testdb.NewDatabase(t)
+	targetDB, err := database.NewDB(context.Background(), targetTDB.ConnString())
+	require.NoError(t, err)
+	defer targetDB.Close()
+
+	// 2. Setup Mock Upstream
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x1"}}`))
+	}))
+	defer upstream.Close()
+
+	startServer := func(db *database.DB, cfg config.Config) {
+		srv, err := server.New(zap.NewNop(), db, cfg)
+		require.NoError(t, err)
+		go func() {
+			if err := srv.Start(); err != nil {
+				t.Logf("server error: %v", err)
+			}
+		}()
+		t.Cleanup(func() { srv.Shutdown(context.Background()) })
+		time.Sleep(100 * time.Millisecond)
+	}
+	sendRPC := func(proxyPort string) *http.Response {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x1"],"id":1}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	// 3. Populate the source cache and export it, followed by a corrupt
+	// line
+	token := "secret-token"
+	startServer(sourceDB, config.Config{Port: "8125", UpstreamURL: upstream.URL, AuthToken: token})
+	sendRPC("8125")
+	req, err := http.NewRequest("GET", "http://localhost:8125/cache/export", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	dump, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	dumpFile := filepath.Join(t.TempDir(), "dump.ndjson")
+	require.NoError(t, os.WriteFile(dumpFile, append(dump, "not json\n"...), 0o600))
+
+	// 4. The fresh cache serves the dumped entries right away, the corrupt
+	// line only being logged
+	startServer(targetDB, config.Config{Port: "8126", UpstreamURL: upstream.URL, WarmupDumpFile: dumpFile})
+	require.Equal(t, "HIT", sendRPC("8126").Header.Get("X-Cache"))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+
+	// 5. A missing dump does not prevent starting
+	startServer(targetDB, config.Config{Port: "8127", UpstreamURL: upstream.URL, WarmupDumpFile: filepath.Join(t.TempDir(), "missing.ndjson")})
+	require.Equal(t, "HIT", sendRPC("8127").Header.Get("X-Cache"))
+}
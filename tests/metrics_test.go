@@ -8,17 +8,22 @@ import (
 	"net/http/httptest"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/clems4ever/ethereum-cache/internal/config"
 	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/metrics"
 	"github.com/clems4ever/ethereum-cache/internal/server"
 	"github.com/clems4ever/ethereum-cache/testdb"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestPrometheusMetrics(t *testing.T) {
@@ -38,7 +43,8 @@ func TestPrometheusMetrics(t *testing.T) {
 
 	// 3. Start Proxy Server
 	proxyPort := "8090"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, "", 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -125,7 +131,8 @@ func TestPrometheusMetricsAuth(t *testing.T) {
 	// 3. Start Proxy Server with Auth
 	proxyPort := "8091"
 	authToken := "secret-metrics-token"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, authToken, 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, AuthToken: authToken})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -157,3 +164,159 @@ func TestPrometheusMetricsAuth(t *testing.T) {
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 	resp.Body.Close()
 }
+
+// getCounterValue reads a counter labeled by method from the default
+// registry, which the proxy servers started by the tests share.
+func getCounterValue(name string, method string) float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return -1
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "method" && label.GetValue() == method {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestShutdownSummary(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server logging to an observer
+	core, logs := observer.New(zap.InfoLevel)
+	proxyPort := "8116"
+	srv, err := server.New(zap.New(core), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	hits := metrics.Total(metrics.CacheHits)
+	misses := metrics.Total(metrics.CacheMisses)
+	servedBytes := metrics.Total(metrics.ServedBytes)
+
+	// 4. A miss then a hit
+	var served int
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`))
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		served += len(body)
+	}
+
+	// 5. Shutdown logs the totals
+	require.NoError(t, srv.Shutdown(context.Background()))
+
+	entries := logs.FilterMessage("shutdown summary").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, int64(hits)+1, fields["cache_hits"])
+	require.Equal(t, int64(misses)+1, fields["cache_misses"])
+	require.Equal(t, int64(servedBytes)+int64(served), fields["served_bytes"])
+}
+
+func TestRequestsMetric(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream failing eth_chainId with an HTML page
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "eth_chainId") {
+			w.Write([]byte(`<html>Bad Gateway</html>`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server
+	proxyPort := "8122"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	getRequests := func(method, result string) float64 {
+		resp, err := http.Get("http://localhost:" + proxyPort + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		re := regexp.MustCompile(fmt.Sprintf(`ethereum_cache_requests_total\{method="%s",result="%s"\} ([0-9\.]+)`, method, result))
+		matches := re.FindSubmatch(body)
+		if len(matches) < 2 {
+			return 0
+		}
+		val, err := strconv.ParseFloat(string(matches[1]), 64)
+		require.NoError(t, err)
+		return val
+	}
+	sendRequest := func(method string) {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"`+method+`","params":["0x123"],"id":1}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	series := []struct {
+		method string
+		result string
+	}{
+		{"eth_getTransactionByHash", "miss"},
+		{"eth_getTransactionByHash", "hit"},
+		{"eth_blockNumber", "bypass"},
+		{"eth_chainId", "error"},
+	}
+	before := make([]float64, len(series))
+	for i, s := range series {
+		before[i] = getRequests(s.method, s.result)
+	}
+
+	// 4. A miss, a hit, a bypass and an error
+	sendRequest("eth_getTransactionByHash")
+	sendRequest("eth_getTransactionByHash")
+	sendRequest("eth_blockNumber")
+	sendRequest("eth_chainId")
+
+	for i, s := range series {
+		require.Equal(t, before[i]+1, getRequests(s.method, s.result), "method: %s, result: %s", s.method, s.result)
+	}
+}
@@ -2,13 +2,21 @@ package tests
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/clems4ever/ethereum-cache/internal/config"
 	"github.com/clems4ever/ethereum-cache/internal/database"
 	"github.com/clems4ever/ethereum-cache/internal/server"
 	"github.com/clems4ever/ethereum-cache/testdb"
@@ -37,7 +45,8 @@ func TestProxy(t *testing.T) {
 
 	// 3. Start Proxy Server
 	proxyPort := "8087"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, "", 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -80,7 +89,8 @@ func TestAuthentication(t *testing.T) {
 	// 3. Start Proxy Server with Auth
 	proxyPort := "8088"
 	authToken := "secret-token"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, authToken, 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, AuthToken: authToken})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -126,7 +136,8 @@ func TestEthClient(t *testing.T) {
 
 	// 3. Start Proxy Server
 	proxyPort := "8089"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, "", 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -176,7 +187,8 @@ func TestEthClientWithAuth(t *testing.T) {
 	// 3. Start Proxy Server with Auth
 	proxyPort := "8090"
 	authToken := "secret-token"
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, authToken, 0, 0, 0)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, AuthToken: authToken})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -205,3 +217,717 @@ func TestEthClientWithAuth(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, uint64(0x1234), bn)
 }
+
+func TestStrictContentType(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1234"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with strict Content-Type validation
+	proxyPort := "8100"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, StrictContentType: true})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	sendRequest := func(contentType string) *http.Response {
+		resp, err := http.Post("http://localhost:"+proxyPort, contentType,
+			bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// 4. Wrong Content-Type is rejected
+	resp := sendRequest("text/plain")
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	// 5. JSON Content-Type, with or without charset, is accepted
+	for _, contentType := range []string{"application/json", "application/json; charset=utf-8"} {
+		resp = sendRequest(contentType)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestCacheEntryEndpoint(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with Auth
+	proxyPort := "8101"
+	authToken := "secret-token"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, AuthToken: authToken})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{}
+	entryURL := "http://localhost:" + proxyPort + "/cache/entry?" + url.Values{
+		"method": {"eth_getTransactionByHash"},
+		"params": {`["0x123"]`},
+	}.Encode()
+
+	getEntry := func(token string) *http.Response {
+		req, err := http.NewRequest("GET", entryURL, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// 4. Endpoint requires authentication
+	resp := getEntry("")
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// 5. Entry is not cached yet
+	resp = getEntry(authToken)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// 6. Cache the entry through the proxy
+	req, err := http.NewRequest("POST", "http://localhost:"+proxyPort,
+		bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+authToken)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 7. Fetch the entry metadata
+	resp = getEntry(authToken)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var entry struct {
+		Method         string          `json:"method"`
+		Response       json.RawMessage `json:"response"`
+		ResultLength   int64           `json:"result_length"`
+		CreatedAt      time.Time       `json:"created_at"`
+		LastAccessedAt time.Time       `json:"last_accessed_at"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entry))
+	require.Equal(t, "eth_getTransactionByHash", entry.Method)
+	require.JSONEq(t, `{"hash":"0x123"}`, string(entry.Response))
+	require.Equal(t, int64(len(`{"hash":"0x123"}`)), entry.ResultLength)
+	require.False(t, entry.CreatedAt.IsZero())
+	require.False(t, entry.LastAccessedAt.IsZero())
+}
+
+func TestGzipUpstream(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream which always gzips its responses
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		gz.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server
+	proxyPort := "8102"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// 4. The client receives decoded JSON
+	resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+		bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_getTransactionByHash","params":["0x123"],"id":1}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x123"}}`, string(body))
+
+	// 5. The decoded result is cached
+	var cached []byte
+	err = tdb.Pool().QueryRow(context.Background(), "SELECT response FROM rpc_cache WHERE method = $1", "eth_getTransactionByHash").Scan(&cached)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"hash":"0x123"}`, string(cached))
+}
+
+func TestBasicAuthentication(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with both Bearer and Basic Auth
+	proxyPort := "8103"
+	authToken := "secret-token"
+	srv, err := server.New(zap.NewNop(), db, config.Config{
+		Port:              proxyPort,
+		UpstreamURL:       upstream.URL,
+		AuthToken:         authToken,
+		BasicAuthUser:     "user",
+		BasicAuthPassword: "password",
+	})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{}
+	sendRequest := func(setAuth func(req *http.Request)) *http.Response {
+		req, err := http.NewRequest("POST", "http://localhost:"+proxyPort,
+			bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		setAuth(req)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// 4. Valid Basic credentials are accepted
+	resp := sendRequest(func(req *http.Request) { req.SetBasicAuth("user", "password") })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 5. The Bearer token is still accepted
+	resp = sendRequest(func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+authToken) })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 6. Invalid Basic credentials are rejected with a challenge
+	for _, creds := range [][2]string{{"user", "wrong"}, {"wrong", "password"}} {
+		resp = sendRequest(func(req *http.Request) { req.SetBasicAuth(creds[0], creds[1]) })
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(t, `Basic realm="ethereum-cache"`, resp.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestUpstreamHeaders(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream requiring credentials
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "upstream-key" || r.Header.Get("Authorization") != "Bearer upstream-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1234"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server forwarding the credentials
+	proxyPort := "8104"
+	srv, err := server.New(zap.NewNop(), db, config.Config{
+		Port:              proxyPort,
+		UpstreamURL:       upstream.URL,
+		UpstreamAuthToken: "upstream-token",
+		UpstreamHeaders:   map[string]string{"x-api-key": "upstream-key"},
+	})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// 4. The upstream accepts the proxied call
+	rpcClient, err := rpc.Dial("http://localhost:" + proxyPort)
+	require.NoError(t, err)
+
+	var result string
+	err = rpcClient.CallContext(context.Background(), &result, "eth_blockNumber")
+	require.NoError(t, err)
+	require.Equal(t, "0x1234", result)
+}
+
+func TestUpstreamPath(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream only serving JSON-RPC on /rpc
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("apikey") != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1234"}`))
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with the upstream path
+	proxyPort := "8109"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL + "?apikey=secret", UpstreamPath: "/rpc"})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// 4. Requests reach the upstream path with the query preserved
+	rpcClient, err := rpc.Dial("http://localhost:" + proxyPort)
+	require.NoError(t, err)
+
+	var result string
+	err = rpcClient.CallContext(context.Background(), &result, "eth_blockNumber")
+	require.NoError(t, err)
+	require.Equal(t, "0x1234", result)
+}
+
+func TestGetRequests(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	var requestCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		_ = json.Unmarshal(body, &req)
+		if r.Method != http.MethodPost || req.Method != "eth_getTransactionByHash" || string(req.Params) != `["0x123"]` {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":7,"result":{"hash":"0x123"}}`))
+	}))
+	defer upstream.Close()
+
+	sendRequest := func(port string, query url.Values) *http.Response {
+		resp, err := http.Get("http://localhost:" + port + "/?" + query.Encode())
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	query := url.Values{"method": {"eth_getTransactionByHash"}, "params": {`["0x123"]`}, "id": {"7"}}
+
+	// 3. GET requests are rejected by default
+	proxyPort := "8110"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	resp := sendRequest(proxyPort, query)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// 4. Start Proxy Server with GET requests enabled
+	proxyPort = "8111"
+	srv, err = server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, AllowGetRequests: true})
+	require.NoError(t, err)
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// 5. First request is forwarded as POST, second is served from the cache
+	for _, status := range []string{"MISS", "HIT"} {
+		resp, err := http.Get("http://localhost:" + proxyPort + "/?" + query.Encode())
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, status, resp.Header.Get("X-Cache"))
+		require.JSONEq(t, `{"jsonrpc":"2.0","id":7,"result":{"hash":"0x123"}}`, string(body))
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+
+	// 6. Mutating methods are never allowed
+	resp = sendRequest(proxyPort, url.Values{"method": {"eth_sendRawTransaction"}, "params": {`["0xdead"]`}})
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// 7. Malformed params are rejected with a JSON-RPC parse error
+	resp, err = http.Get("http://localhost:" + proxyPort + "/?" + url.Values{"method": {"eth_getTransactionByHash"}, "params": {`[`}}.Encode())
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid query parameters"}}`, string(body))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requestCount))
+}
+
+func TestListenAddrs(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server on a TCP address and a Unix socket
+	socketPath := filepath.Join(t.TempDir(), "proxy.sock")
+	srv, err := server.New(zap.NewNop(), db, config.Config{
+		ListenAddrs: []string{"127.0.0.1:8117", "unix:" + socketPath},
+		UpstreamURL: upstream.URL,
+	})
+	require.NoError(t, err)
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+
+	// 4. eth_blockNumber is served on both addresses
+	for _, client := range []*http.Client{http.DefaultClient, unixClient} {
+		resp, err := client.Post("http://127.0.0.1:8117", "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x10"}`, string(body))
+	}
+}
+
+func TestAdminListener(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server with a separate admin listener
+	proxyPort := "8120"
+	adminAddr := "localhost:8121"
+	adminToken := "admin-token"
+	srv, err := server.New(zap.NewNop(), db, config.Config{
+		Port:        proxyPort,
+		UpstreamURL: upstream.URL,
+		AdminAddr:   adminAddr,
+		AdminToken:  adminToken,
+	})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	get := func(url, token string) (int, string) {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// 4. The admin endpoints are not served on the main listener
+	_, body := get("http://localhost:"+proxyPort+"/cache/stats", adminToken)
+	require.NotContains(t, body, "entries_by_source")
+
+	// 5. The admin listener requires the admin token
+	status, _ := get("http://"+adminAddr+"/cache/stats", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	status, body = get("http://"+adminAddr+"/cache/stats", adminToken)
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "entries_by_source")
+
+	// 6. The main listener still proxies JSON-RPC requests
+	resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream holding the requests
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))
+	}))
+	defer upstream.Close()
+	// Released before closing the upstream, which waits for its handlers
+	defer close(release)
+
+	// 3. Start Proxy Server
+	proxyPort := "8123"
+	shutdownTimeout := 300 * time.Millisecond
+	srv, err := server.New(zap.NewNop(), db, config.Config{
+		Port:            proxyPort,
+		UpstreamURL:     upstream.URL,
+		ShutdownTimeout: shutdownTimeout,
+	})
+	require.NoError(t, err)
+	require.Equal(t, shutdownTimeout, srv.ShutdownTimeout())
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// 4. Leave a request in flight
+	go func() {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// 5. Shutdown waits for the configured timeout, then gives up
+	ctx, cancel := context.WithTimeout(context.Background(), srv.ShutdownTimeout())
+	defer cancel()
+	start := time.Now()
+	err = srv.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.GreaterOrEqual(t, time.Since(start), shutdownTimeout-50*time.Millisecond)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestH2C(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server
+	proxyPort := "8124"
+	srv, err := server.New(zap.NewNop(), db, config.Config{
+		Port:        proxyPort,
+		UpstreamURL: upstream.URL,
+		EnableH2C:   true,
+	})
+	require.NoError(t, err)
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	// send returns the major HTTP version of a successful eth_blockNumber
+	// call, 0 on failure
+	send := func(client *http.Client) int {
+		resp, err := client.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+		if err != nil {
+			return 0
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK || string(body) != `{"jsonrpc":"2.0","id":1,"result":"0x10"}` {
+			return 0
+		}
+		return resp.ProtoMajor
+	}
+
+	// 4. Concurrent requests multiplexed over a single h2c connection
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	h2c := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	versions := make(chan int)
+	for i := 0; i < 5; i++ {
+		go func() {
+			versions <- send(h2c)
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		require.Equal(t, 2, <-versions)
+	}
+
+	// 5. HTTP/1.1 keeps working
+	require.Equal(t, 1, send(http.DefaultClient))
+}
+
+func TestRequestID(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// 2. Setup Mock Upstream recording the forwarded request ids
+	forwarded := make(chan string, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("X-Request-ID")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server
+	proxyPort := "8128"
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL})
+	require.NoError(t, err)
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	send := func(requestID string) string {
+		req, err := http.NewRequest("POST", "http://localhost:"+proxyPort,
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Header.Get("X-Request-ID")
+	}
+
+	// 4. A supplied id is echoed and forwarded to the upstream
+	require.Equal(t, "abc-123", send("abc-123"))
+	require.Equal(t, "abc-123", <-forwarded)
+
+	// 5. An id is generated when absent
+	generated := send("")
+	require.Len(t, generated, 32)
+	require.Equal(t, generated, <-forwarded)
+}
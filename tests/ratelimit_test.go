@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/clems4ever/ethereum-cache/internal/config"
 	"github.com/clems4ever/ethereum-cache/internal/database"
 	"github.com/clems4ever/ethereum-cache/internal/server"
 	"github.com/clems4ever/ethereum-cache/testdb"
@@ -33,7 +34,8 @@ func TestRateLimiting(t *testing.T) {
 	// Rate Limit = 1 request per second. Burst = 2.
 	proxyPort := "8089"
 	rateLimit := 1.0
-	srv := server.New(zap.NewNop(), ":"+proxyPort, upstream.URL, db, "", 0, 0, rateLimit)
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, RateLimit: rateLimit})
+	require.NoError(t, err)
 
 	go func() {
 		if err := srv.Start(); err != nil {
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clems4ever/ethereum-cache/internal/config"
+	"github.com/clems4ever/ethereum-cache/internal/database"
+	"github.com/clems4ever/ethereum-cache/internal/reorg"
+	"github.com/clems4ever/ethereum-cache/internal/server"
+	"github.com/clems4ever/ethereum-cache/testdb"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestReorgEviction(t *testing.T) {
+	// 1. Setup Test Database
+	tdb := testdb.NewDatabase(t)
+	db, err := database.NewDB(context.Background(), tdb.ConnString())
+	require.NoError(t, err)
+	defer db.Close()
+
+	orphanedHash := "0x00000000000000000000000000000000000000000000000000000000000000aa"
+	canonicalHash := "0x00000000000000000000000000000000000000000000000000000000000000bb"
+
+	// 2. Setup Mock Upstream whose canonical block 0x10 changes after a reorg
+	var reorged atomic.Bool
+	var receiptCount int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Method string `json:"method"`
+		}
+		_ = json.Unmarshal(body, &req)
+
+		hash := orphanedHash
+		if reorged.Load() {
+			hash = canonicalHash
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Method {
+		case "eth_blockNumber":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x12"}`))
+		case "eth_getBlockByNumber":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"number":"0x10","hash":"` + hash + `"}}`))
+		case "eth_getTransactionReceipt":
+			atomic.AddInt32(&receiptCount, 1)
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"transactionHash":"0x123","blockNumber":"0x10","blockHash":"` + hash + `"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	// 3. Start Proxy Server and Reorg Watcher
+	proxyPort := "8097"
+	interval := 50 * time.Millisecond
+	srv, err := server.New(zap.NewNop(), db, config.Config{Port: proxyPort, UpstreamURL: upstream.URL, ReorgWatchInterval: interval})
+	require.NoError(t, err)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reorg.New(zap.NewNop(), db, []string{upstream.URL}, nil, nil, interval, 10).Start(ctx)
+
+	sendRequest := func() {
+		resp, err := http.Post("http://localhost:"+proxyPort, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","params":["0x123"],"id":1}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// 4. Cache the receipt while block 0x10 is canonical
+	sendRequest()
+	require.Equal(t, int32(1), atomic.LoadInt32(&receiptCount))
+
+	// Entries of a canonical block are kept
+	time.Sleep(3 * interval)
+	count, err := db.GetCacheItemCount(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	// 5. Reorg block 0x10, the stale receipt gets evicted
+	reorged.Store(true)
+	require.Eventually(t, func() bool {
+		count, err := db.GetCacheItemCount(context.Background())
+		return err == nil && count == 0
+	}, 2*time.Second, interval, "stale entry was not evicted")
+
+	// 6. The receipt is fetched again from the upstream
+	sendRequest()
+	require.Equal(t, int32(2), atomic.LoadInt32(&receiptCount))
+}